@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Account is a single IMAP account to back up. Accounts come from the
+// command line (--user or --account) or from the --config file; settings
+// left empty default to the corresponding command line flags.
+type Account struct {
+	Server   string `json:"server"`
+	Username string `json:"user"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+	TLS      string `json:"tls"`
+	Output   string `json:"outfile"`
+	Preset   string `json:"preset"`
+
+	// Exclude lists additional folders to skip.
+	Exclude []string `json:"exclude"`
+
+	// Map renames folders, in addition to the --map rules.
+	Map map[string]string `json:"map"`
+
+	// Connections limits the concurrent connections to the account,
+	// 0 means only the global --connections limit applies.
+	Connections int `json:"connections"`
+
+	// Schedule is a cron expression for daemon mode.
+	Schedule string `json:"schedule"`
+
+	// MasterUser logs in with the master user's password, Password,
+	// on behalf of the account.
+	MasterUser string `json:"master_user"`
+
+	Stats Stats `json:"-"`
+
+	// slots holds a token for each open connection if Connections is set.
+	slots chan struct{}
+	setup bool
+
+	schedule *Schedule
+
+	// upload is the URL of a remote output, which is staged in Output.
+	upload string
+	// outputBase and uploadBase are the names of an --incremental
+	// archive in --outdir, before the time of the run is added.
+	outputBase, uploadBase string
+
+	fetchInterval time.Duration
+
+	msgCh        chan *Message
+	msgIdCounter int
+
+	state *State
+
+	// serverMetadata are the server annotations found by the lister.
+	serverMetadata map[string]string
+
+	// folders maps the listed mailboxes to their folder names, and
+	// uses maps them to their special-use attributes.
+	folders map[string]string
+	uses    map[string]string
+
+	// duplicates are the messages --skip-duplicates leaves out, by
+	// folder and UID, with the folder holding the kept copy.
+	duplicates map[string]map[uint32]string
+
+	// checkpoint and progress describe the interrupted run
+	// being resumed, if any.
+	checkpoint []*CheckpointRecord
+	progress   map[string]*FolderProgress
+
+	// pending counts the mailboxes queued but not yet downloaded,
+	// jobs is where they are queued.
+	pending sync.WaitGroup
+	jobs    chan<- *Job
+
+	// expected are the folders to back up, done those the writer
+	// received completely, to report the others.
+	expected []string
+	done     map[string]bool
+	// excluded are the folders skipped by their name.
+	excluded []string
+
+	// folderBytes counts the data downloaded from each folder, limited
+	// the size limits reached, see limits.go. folderStart is when each
+	// folder was started, see timeouts.go.
+	folderBytes map[string]int64
+	folderStart map[string]time.Time
+	limited     map[string]bool
+
+	// idle is the lister's connection, waiting for a worker. It keeps
+	// its connection slot.
+	idle *imap.Client
+
+	mu  sync.Mutex
+	err error
+}
+
+// Stats are the per-account results of a run. Errors is updated by the
+// downloaders, the expected totals from STATUS and the planned ones from
+// --prefetch-headers by the lister, the other counters only by the
+// writer.
+type Stats struct {
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+	Errors   int64 `json:"errors"`
+	Skipped  int64 `json:"skipped,omitempty"`
+
+	ExpectedMessages int64 `json:"expected_messages,omitempty"`
+	ExpectedBytes    int64 `json:"expected_bytes,omitempty"`
+	PlannedMessages  int64 `json:"planned_messages,omitempty"`
+	PlannedBytes     int64 `json:"planned_bytes,omitempty"`
+}
+
+// Config is the format of the --config file.
+type Config struct {
+	OutDir   string     `json:"outdir"`
+	Accounts []*Account `json:"accounts"`
+}
+
+// stringsFlag collects the values of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// accountFlag collects repeated --account user[:password]@host flags.
+type accountFlag []*Account
+
+func (f *accountFlag) String() string {
+	return ""
+}
+
+func (f *accountFlag) Set(spec string) error {
+	i := strings.LastIndex(spec, "@")
+	if i <= 0 {
+		return errors.New("expected user[:password]@host")
+	}
+	a := &Account{Server: spec[i+1:]}
+	a.Username, a.Password, _ = strings.Cut(spec[:i], ":")
+	*f = append(*f, a)
+	return nil
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &cfg, nil
+}
+
+// LoadUsers reads a --users-file: one user or user:password per line,
+// blank lines and lines starting with # are ignored. Accounts without a
+// password use --password, the keyring or --master-user.
+func LoadUsers(path string) ([]*Account, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var accts []*Account
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		a := &Account{}
+		a.Username, a.Password, _ = strings.Cut(line, ":")
+		accts = append(accts, a)
+	}
+	return accts, nil
+}
+
+// Setup fills in defaults and checks the account settings, resolving
+// keyring passwords and autodiscovering the server if necessary.
+func (a *Account) Setup(outDir string) error {
+	if a.Username == "" {
+		return errors.New("missing username")
+	}
+	if a.setup {
+		return nil
+	}
+	a.fetchInterval = FetchInterval()
+	if a.Preset == "" {
+		a.Preset = *preset
+	}
+	if a.Preset != "" {
+		if err := a.ApplyPreset(a.Preset); err != nil {
+			return err
+		}
+	}
+	if a.Connections > 0 {
+		a.slots = make(chan struct{}, a.Connections)
+	}
+	if a.Auth == "" {
+		a.Auth = *auth
+	}
+	explicitTLS := a.TLS != "" || IsFlagSet("tls") || *notls
+	if a.TLS == "" {
+		a.TLS = *tlsMode
+	}
+
+	if a.Server == "" {
+		a.Server = *server
+	}
+	if a.MasterUser == "" {
+		a.MasterUser = *masterUser
+	}
+
+	switch a.Auth {
+	case "login":
+		if a.Password == "" {
+			a.Password = *password
+		}
+		if a.Password == "" && IsLocal(a.Server) {
+			// Local connections are usually PREAUTH.
+			break
+		}
+		if a.Password == "" {
+			a.Password = "keyring:" + a.Username
+			if a.MasterUser != "" {
+				a.Password = "keyring:" + a.MasterUser
+			}
+		}
+		var err error
+		if a.Password, err = ResolvePassword(a.Password); err != nil {
+			return err
+		}
+		if a.Password == "" {
+			return errors.New("missing password")
+		}
+	case "gmail", "o365-device":
+	default:
+		return fmt.Errorf("unknown authentication method '%s'", a.Auth)
+	}
+
+	switch a.TLS {
+	case "implicit", "starttls", "none":
+	default:
+		return fmt.Errorf("unknown TLS mode '%s'", a.TLS)
+	}
+	if *strictReadonly && a.TLS == "starttls" && !IsLocal(a.Server) {
+		return errors.New("--strict-readonly cannot check commands sent after STARTTLS, use --tls=implicit")
+	}
+
+	switch {
+	case *repo != "":
+		// The repository is shared, only the snapshots are per account.
+		a.Output = SnapshotDir(*repo, a.Username)
+	case a.Output != "":
+	case outDir == "":
+		return errors.New("no output file, use --outfile, --outdir or --repo")
+	default:
+		name := strings.Replace(a.Username, "/", "_", -1)
+		switch {
+		case IsS3(outDir):
+		case *format == "zip" && !*perFolder:
+			name += ".zip"
+		case *format == "tar":
+			name += ".tar"
+		}
+		if IsRemote(outDir) || IsS3(outDir) {
+			a.Output = RemoteJoin(outDir, name)
+		} else {
+			a.Output = filepath.Join(outDir, name)
+		}
+		if *incremental && SingleFile(a.Output) {
+			a.outputBase = a.Output
+		}
+	}
+	if IsS3(a.Output) && (*repo != "" || *perFolder) {
+		return errors.New("s3:// outputs cannot be used with --repo or --per-folder-output")
+	}
+	if IsRemote(a.Output) {
+		if *format != "zip" || *repo != "" || *perFolder {
+			return errors.New("only ZIP archives can be uploaded")
+		}
+		a.upload = a.Output
+		a.Output = StagingPath(a.upload)
+		if a.outputBase != "" {
+			a.uploadBase, a.outputBase = a.upload, a.Output
+		}
+	}
+
+	if a.Server == "" {
+		cfg, err := Discover(a.Username)
+		if err != nil {
+			return fmt.Errorf("autodiscovery failed, please specify the server: %s", err)
+		}
+		log.Printf("%s: discovered IMAP server %s (TLS: %s)", a.Username, cfg.Addr, cfg.TLS)
+		a.Server = cfg.Addr
+		if !explicitTLS {
+			a.TLS = cfg.TLS
+		}
+	}
+	a.setup = true
+	return nil
+}
+
+// SingleFile reports whether an output is one archive file, which a run
+// writes anew.
+func SingleFile(output string) bool {
+	return *repo == "" && *storeCmd == "" && !IsS3(output) && output != "-" &&
+		(*format == "zip" && !*perFolder || *format == "tar")
+}
+
+// Stamped returns an archive name with a time added before its
+// extension, as in <user>-20240101T120000Z.zip.
+func Stamped(name string, t time.Time) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + t.UTC().Format(snapshotTime) + ext
+}
+
+// RunOutput chooses the output of a run. Incremental runs only hold the
+// messages added since the previous one, so each writes its own archive
+// in --outdir, and the archive of an interrupted run is continued with
+// --resume. An explicit --outfile is not overwritten.
+func (a *Account) RunOutput(start time.Time) error {
+	if a.outputBase == "" {
+		if *incremental && !*resume && SingleFile(a.Output) && a.upload == "" {
+			if _, err := os.Stat(a.Output); err == nil {
+				return fmt.Errorf("%s exists, an incremental run would overwrite it; use --outdir for an archive per run", a.Output)
+			}
+		}
+		return nil
+	}
+	a.Output, a.upload = Stamped(a.outputBase, start), ""
+	if a.uploadBase != "" {
+		a.upload = Stamped(a.uploadBase, start)
+	}
+	if !*resume {
+		return nil
+	}
+	ext := filepath.Ext(a.outputBase)
+	base := strings.TrimSuffix(a.outputBase, ext)
+	interrupted, _ := filepath.Glob(base + "-*" + ext + ".checkpoint")
+	if len(interrupted) == 0 {
+		return nil
+	}
+	sort.Strings(interrupted)
+	a.Output = strings.TrimSuffix(interrupted[len(interrupted)-1], ".checkpoint")
+	if a.uploadBase != "" {
+		// The same time, as in -20240101T120000Z.zip.
+		suffix := strings.TrimPrefix(a.Output, base)
+		a.upload = strings.TrimSuffix(a.uploadBase, filepath.Ext(a.uploadBase)) + suffix
+	}
+	return nil
+}
+
+// Destination returns where the backup of the account ends up.
+func (a *Account) Destination() string {
+	dest := a.Output
+	if a.upload != "" {
+		dest = a.upload
+	}
+	if *compression == "zstd" {
+		dest += ".zst"
+	}
+	return dest
+}
+
+// Excluded reports whether a folder should not be backed up. Exclusions
+// are matched by MatchFolder.
+func (a *Account) Excluded(mbox *imap.MailboxInfo) bool {
+	// Skip some unwanted mailboxes.
+	name := FolderName(mbox.Name)
+	use := SpecialUse(mbox)
+	switch {
+	case name == "dovecot.sieve":
+		return true
+	case use == `\Trash` && !*includeTrash && *trashMaxAge == "":
+		return true
+	case use == `\Junk` && !*includeSpam && *trashMaxAge == "":
+		return true
+	}
+	for _, list := range [][]string{a.Exclude, skipFolders} {
+		for _, ex := range list {
+			if MatchFolder(ex, mbox) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsTrash reports whether a folder holds deleted mail or spam.
+func IsTrash(mbox *imap.MailboxInfo) bool {
+	use := SpecialUse(mbox)
+	return use == `\Trash` || use == `\Junk`
+}
+
+// ParseAge parses a duration that may also be given in days or weeks,
+// such as 30d or 2w.
+func ParseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			days, err := strconv.Atoi(n)
+			if err != nil || days < 0 {
+				return 0, fmt.Errorf("invalid age '%s'", s)
+			}
+			return time.Duration(days) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// Reset clears the results of a previous run.
+func (a *Account) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.err = nil
+	a.Stats = Stats{}
+	a.msgIdCounter = 0
+	a.checkpoint = nil
+	a.progress = nil
+	a.serverMetadata = nil
+	a.folders = nil
+	a.uses = nil
+	a.duplicates = nil
+	a.expected = nil
+	a.done = make(map[string]bool)
+	a.folderBytes = make(map[string]int64)
+	a.folderStart = make(map[string]time.Time)
+	a.limited = make(map[string]bool)
+}
+
+// IncompleteFolders returns the folders that were not fully backed up.
+func (a *Account) IncompleteFolders() []string {
+	var list []string
+	for _, folder := range a.expected {
+		if !a.done[folder] {
+			list = append(list, folder)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Acquire waits until the account's connection limit allows another
+// connection. Release must be called when it is closed.
+func (a *Account) Acquire() {
+	if a.slots != nil {
+		a.slots <- struct{}{}
+	}
+}
+
+func (a *Account) Release() {
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
+// Fail records the first error that prevented a complete backup.
+func (a *Account) Fail(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err == nil {
+		log.Printf("%s: %s", a.Username, err)
+		a.err = err
+	}
+}
+
+func (a *Account) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// Job is a mailbox waiting to be downloaded by a worker, or part of one
+// if Chunk is set.
+type Job struct {
+	Account *Account
+	Mailbox *imap.MailboxInfo
+	Chunk   *Chunk
+
+	// received are the UIDs already passed to the writer, when the job
+	// is queued again after its connection was dropped.
+	received map[uint32]bool
+	attempts int
+}
+
+// maxReconnects limits how often a job is started again after its
+// connection was dropped.
+const maxReconnects = 3
+
+// Dropped reports whether the server closed the connection.
+func Dropped(c *imap.Client) bool {
+	return c.State() == imap.Closed
+}
+
+// Retry reports whether the job failed because its connection was dropped
+// and will be queued again. Errors are then not counted.
+func (j *Job) Retry(c *imap.Client) bool {
+	return Dropped(c) && j.attempts < maxReconnects
+}
+
+// Received records that a message of the job was passed to the writer.
+func (j *Job) Received(uid uint32) {
+	if j.received == nil {
+		j.received = make(map[uint32]bool)
+	}
+	j.received[uid] = true
+}
+
+// Queue adds jobs for the workers. They are queued from a new
+// goroutine, the workers that would receive them may all be busy queueing
+// their own.
+func (a *Account) Queue(jobs ...*Job) {
+	a.pending.Add(len(jobs))
+	go func() {
+		for _, job := range jobs {
+			a.jobs <- job
+		}
+	}()
+}
+
+// HandOff keeps the lister's connection for the first worker that
+// downloads a mailbox of the account.
+func (a *Account) HandOff(c *imap.Client) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.idle = c
+}
+
+// TakeIdle returns the connection handed off by the lister, if it was
+// not taken yet and is still open. Its slot is released by the worker.
+func (a *Account) TakeIdle() *imap.Client {
+	a.mu.Lock()
+	c := a.idle
+	a.idle = nil
+	a.mu.Unlock()
+	if c != nil && Dropped(c) {
+		a.Release()
+		return nil
+	}
+	return c
+}
+
+// CloseIdle logs out the lister's connection if no worker took it.
+func (a *Account) CloseIdle() {
+	if c := a.TakeIdle(); c != nil {
+		Close(c)
+		a.Release()
+	}
+}
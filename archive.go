@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"flag"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Writer stores the messages of a backup in one of the output formats.
+type Writer interface {
+	// Add stores a new message under the given Maildir style name.
+	Add(name string, msg *Message) error
+	// UpdateFlags records the new flags of a message from an earlier backup.
+	UpdateFlags(msg *Message) error
+	// Expunge records that a message from an earlier backup was deleted
+	// on the server.
+	Expunge(msg *Message) error
+	// Complete records that all messages of a folder have been written.
+	Complete(msg *Message) error
+	// Close finalizes the output, complete is false if the backup
+	// did not finish.
+	Close(complete bool) error
+}
+
+// ZIP archive writer with checkpoints.
+//
+// Messages are compressed in memory and stored with CreateRaw, so the
+// position and size of each entry's data is known. Every written entry is
+// recorded in a checkpoint journal next to the archive. If the run is
+// interrupted, --resume copies the entries listed in the journal from the
+// partial archive into a new one and continues with the first message not
+// yet written.
+//
+// Bodies are deflated at the --compression level. With "store" they are
+// stored as they are, which saves CPU time for mail that is mostly
+// compressed attachments, "best" makes text-heavy archives smaller. With
+// "zstd" the whole archive is compressed at the end, see zstd.go. During
+// a backup the bodies are deflated on several cores, see compress.go.
+
+var (
+	resume             = flag.Bool("resume", false, "Resume an interrupted backup from its checkpoint")
+	checkpointInterval = flag.Duration("checkpoint-interval", 10*time.Second, "How often to checkpoint the archive")
+	compression        = flag.String("compression", "default", "Compression of ZIP archives: store, fast, default, best or zstd")
+)
+
+// compressionLevels are the deflate levels of the --compression values,
+// besides store.
+var compressionLevels = map[string]int{
+	"fast":    flate.BestSpeed,
+	"default": flate.DefaultCompression,
+	"best":    flate.BestCompression,
+}
+
+// CheckpointRecord is a line of the checkpoint journal. It describes an
+// archive entry or a flag update, or marks a folder as completely written.
+type CheckpointRecord struct {
+	Name        string    `json:"name,omitempty"`
+	Folder      string    `json:"folder"`
+	UID         uint32    `json:"uid,omitempty"`
+	UIDValidity uint32    `json:"uidvalidity,omitempty"`
+	Flags       []string  `json:"flags,omitempty"`
+	FlagUpdate  bool      `json:"flag_update,omitempty"`
+	Expunged    bool      `json:"expunged,omitempty"`
+	ModSeq      uint64    `json:"modseq,omitempty"`
+	Modified    time.Time `json:"modified,omitempty"`
+	CRC32       uint32    `json:"crc32,omitempty"`
+	Offset      int64     `json:"offset,omitempty"`
+	Compressed  uint64    `json:"compressed,omitempty"`
+	Size        uint64    `json:"size,omitempty"`
+	Stored      bool      `json:"stored,omitempty"`
+	Complete    bool      `json:"complete,omitempty"`
+
+	// InternalDate and RFC822Size are the server's attributes of a new
+	// message, ThreadID its Gmail conversation and MessageID its
+	// Message-ID header.
+	InternalDate time.Time `json:"internaldate,omitzero"`
+	RFC822Size   uint32    `json:"rfc822_size,omitempty"`
+	ThreadID     string    `json:"gmail_thread_id,omitempty"`
+	MessageID    string    `json:"message_id,omitempty"`
+
+	// Metadata are the folder's annotations, in complete records.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// FolderProgress is how far a folder got in an interrupted run. Folders
+// split across connections are not written in UID order, so all written
+// UIDs are kept.
+type FolderProgress struct {
+	UIDValidity uint32
+	UIDs        map[uint32]bool
+	Complete    bool
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type ZipWriter struct {
+	Manifest *Manifest
+
+	file    *os.File
+	cw      *countWriter
+	zw      *zip.Writer
+	jfile   *os.File
+	journal *bufio.Writer
+	last    time.Time
+}
+
+func CheckpointPath(output string) string {
+	return output + ".checkpoint"
+}
+
+// LoadCheckpoint reads the journal of an interrupted run. A truncated
+// last line is expected and ignored.
+func LoadCheckpoint(output string) ([]*CheckpointRecord, error) {
+	f, err := os.Open(CheckpointPath(output))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*CheckpointRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r CheckpointRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			break
+		}
+		records = append(records, &r)
+	}
+	return records, scanner.Err()
+}
+
+// Progress summarizes checkpoint records by folder.
+func Progress(records []*CheckpointRecord) map[string]*FolderProgress {
+	progress := make(map[string]*FolderProgress)
+	for _, r := range records {
+		p := progress[r.Folder]
+		if p == nil {
+			p = &FolderProgress{UIDs: make(map[uint32]bool)}
+			progress[r.Folder] = p
+		}
+		if r.Complete {
+			p.Complete = true
+			continue
+		}
+		if r.FlagUpdate || r.Expunged {
+			continue
+		}
+		p.UIDValidity = r.UIDValidity
+		p.UIDs[r.UID] = true
+	}
+	return progress
+}
+
+// NewZipWriter creates the archive. An output of "-" streams it to
+// stdout, without a checkpoint since it cannot be resumed.
+func NewZipWriter(output string, m *Manifest) (*ZipWriter, error) {
+	if output == "-" {
+		cw := &countWriter{w: os.Stdout}
+		return &ZipWriter{Manifest: m, cw: cw, zw: zip.NewWriter(cw), last: time.Now()}, nil
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return nil, err
+	}
+	jfile, err := os.Create(CheckpointPath(output))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	cw := &countWriter{w: file}
+	return &ZipWriter{
+		Manifest: m,
+		file:     file,
+		cw:       cw,
+		zw:       zip.NewWriter(cw),
+		jfile:    jfile,
+		journal:  bufio.NewWriter(jfile),
+		last:     time.Now(),
+	}, nil
+}
+
+// ResumeZipWriter starts a new archive containing the checkpointed
+// entries of the partial one.
+func ResumeZipWriter(output string, m *Manifest, records []*CheckpointRecord) (*ZipWriter, error) {
+	partial := output + ".partial"
+	if err := os.Rename(output, partial); err != nil {
+		return nil, err
+	}
+	old, err := os.Open(partial)
+	if err != nil {
+		return nil, err
+	}
+	defer old.Close()
+
+	w, err := NewZipWriter(output, m)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r.Complete || r.FlagUpdate || r.Expunged {
+			w.record(r)
+			continue
+		}
+		data := io.NewSectionReader(old, r.Offset, int64(r.Compressed))
+		if err := w.writeRaw(r, data); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Checkpoint(); err != nil {
+		return nil, err
+	}
+	os.Remove(partial)
+	return w, nil
+}
+
+// Add compresses and stores a message.
+func (w *ZipWriter) Add(name string, msg *Message) error {
+	return w.entry(name, msg, msg.deflated)
+}
+
+// Create starts an entry of the archive, it is written when closed.
+// Entries of messages are checkpointed, those without meta are not.
+func (w *ZipWriter) Create(folder, name string, meta *Message) (io.WriteCloser, error) {
+	return &storeFile{store: func(data []byte) error {
+		if meta == nil {
+			zf, err := w.zw.Create(name)
+			if err != nil {
+				return err
+			}
+			_, err = zf.Write(data)
+			return err
+		}
+		msg := *meta
+		msg.Body = data
+		// The deflated body is only of use if it is the same.
+		var deflated []byte
+		if bytes.Equal(data, meta.Body) {
+			deflated = meta.deflated
+		}
+		return w.entry(name, &msg, deflated)
+	}}, nil
+}
+
+// Finalize closes a complete archive.
+func (w *ZipWriter) Finalize() error {
+	return w.Close(true)
+}
+
+// entry writes the entry of a message. The compression workers may have
+// deflated it already.
+func (w *ZipWriter) entry(name string, msg *Message, deflated []byte) error {
+	data, crc := deflated, msg.crc32
+	stored := *compression == "store" || *compression == "zstd"
+	if stored {
+		data, crc = msg.Body, crc32.ChecksumIEEE(msg.Body)
+	} else if data == nil {
+		data, crc = DeflateBody(msg.Body), crc32.ChecksumIEEE(msg.Body)
+	}
+
+	r := &CheckpointRecord{
+		Name:        name,
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Flags:       msg.Flags,
+		Modified:    EntryTime(msg),
+		CRC32:       crc,
+		Compressed:  uint64(len(data)),
+		Size:        uint64(len(msg.Body)),
+		Stored:      stored,
+
+		InternalDate: msg.InternalDate,
+		RFC822Size:   msg.Size,
+		ThreadID:     msg.ThreadID,
+		MessageID:    msg.MessageID,
+	}
+	return w.writeRaw(r, bytes.NewReader(data))
+}
+
+// EntryTime returns the modification time of a message's entry. With
+// --filename=uid it is the internal date or Date of the message rather
+// than the time of the backup, so that every run writes the same entry
+// for it.
+func EntryTime(msg *Message) time.Time {
+	if *filenames != "uid" {
+		return time.Now()
+	}
+	if !msg.InternalDate.IsZero() {
+		return msg.InternalDate
+	}
+	if t := MessageDate(msg.Body); t != nil {
+		return *t
+	}
+	return time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (w *ZipWriter) writeRaw(r *CheckpointRecord, data io.Reader) error {
+	method := zip.Deflate
+	if r.Stored {
+		method = zip.Store
+	}
+	zf, err := w.zw.CreateRaw(&zip.FileHeader{
+		Name:               r.Name,
+		Method:             method,
+		Modified:           r.Modified,
+		CRC32:              r.CRC32,
+		CompressedSize64:   r.Compressed,
+		UncompressedSize64: r.Size,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zf, data); err != nil {
+		return err
+	}
+	// The journal needs the position of the data, which is only known
+	// once the zip writer's buffer has been flushed.
+	if err := w.zw.Flush(); err != nil {
+		return err
+	}
+	r.Offset = w.cw.n - int64(r.Compressed)
+	w.record(r)
+	return w.maybeCheckpoint()
+}
+
+func (w *ZipWriter) Complete(msg *Message) error {
+	w.record(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UIDValidity: msg.UIDValidity,
+		ModSeq:      msg.ModSeq,
+		Complete:    true,
+		Metadata:    msg.Metadata,
+	})
+	return w.maybeCheckpoint()
+}
+
+func (w *ZipWriter) UpdateFlags(msg *Message) error {
+	w.record(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Flags:       msg.Flags,
+		FlagUpdate:  true,
+	})
+	return w.maybeCheckpoint()
+}
+
+func (w *ZipWriter) Expunge(msg *Message) error {
+	w.record(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Expunged:    true,
+	})
+	return w.maybeCheckpoint()
+}
+
+func (w *ZipWriter) record(r *CheckpointRecord) {
+	w.Manifest.Add(r)
+	if w.journal == nil {
+		return
+	}
+	data, _ := json.Marshal(r)
+	w.journal.Write(data)
+	w.journal.WriteByte('\n')
+}
+
+func (w *ZipWriter) maybeCheckpoint() error {
+	if time.Since(w.last) < *checkpointInterval {
+		return nil
+	}
+	return w.Checkpoint()
+}
+
+// Checkpoint makes sure that everything in the journal is on disk. The
+// archive data is synced first, so the journal never refers to entries
+// that were not written.
+func (w *ZipWriter) Checkpoint() error {
+	w.last = time.Now()
+	if err := w.zw.Flush(); err != nil {
+		return err
+	}
+	if w.file == nil {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.journal.Flush(); err != nil {
+		return err
+	}
+	return w.jfile.Sync()
+}
+
+// Close finalizes the archive. The checkpoint is kept if the backup is
+// not complete, so that it can be resumed.
+func (w *ZipWriter) Close(complete bool) error {
+	err := w.writeManifest()
+	if err == nil {
+		err = w.zw.SetComment(archiveMarker())
+	}
+	if cerr := w.zw.Close(); err == nil {
+		err = cerr
+	}
+	if w.file == nil {
+		return err
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.journal.Flush()
+	w.jfile.Close()
+	if err == nil && complete {
+		if rerr := os.Remove(w.jfile.Name()); rerr != nil {
+			log.Printf("could not remove checkpoint: %s", rerr)
+		}
+	}
+	return err
+}
+
+func (w *ZipWriter) writeManifest() error {
+	data, err := w.Manifest.Marshal()
+	if err != nil {
+		return err
+	}
+	return Store(w, "", manifestName, nil, data)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// An interrupted archive is resumed from its checkpoint: the entries in
+// the journal survive, a half-written journal line is ignored.
+func TestResume(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "user.zip")
+	w, err := NewZipWriter(output, &Manifest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for uid := uint32(1); uid <= 3; uid++ {
+		msg := &Message{Folder: "INBOX", UID: uid, UIDValidity: 10, Body: []byte(fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", uid))}
+		if err := w.Add(fmt.Sprintf("INBOX/%d.eml", uid), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Complete(&Message{Folder: "INBOX", UIDValidity: 10})
+	if err := w.Add("Sent/1.eml", &Message{Folder: "Sent", UID: 1, UIDValidity: 20, Body: []byte("sent\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	w.file.Close()
+	w.jfile.Close()
+	f, err := os.OpenFile(CheckpointPath(output), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"name":"Sent/2.eml","fol`)
+	f.Close()
+
+	records, err := LoadCheckpoint(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("got %d checkpoint records, want 5", len(records))
+	}
+	progress := Progress(records)
+	if p := progress["INBOX"]; p == nil || !p.Complete || len(p.UIDs) != 3 || !p.UIDs[3] || p.UIDValidity != 10 {
+		t.Errorf("INBOX progress = %+v", p)
+	}
+	if p := progress["Sent"]; p == nil || p.Complete || len(p.UIDs) != 1 || !p.UIDs[1] || p.UIDValidity != 20 {
+		t.Errorf("Sent progress = %+v", p)
+	}
+
+	w, err = ResumeZipWriter(output, &Manifest{}, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(CheckpointPath(output)); !os.IsNotExist(err) {
+		t.Error("the checkpoint of a complete archive was kept")
+	}
+	zr, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, zf := range zr.File {
+		if zf.Name == manifestName {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err != nil {
+			t.Errorf("%s: %s", zf.Name, err)
+		}
+		r.Close()
+		names = append(names, zf.Name)
+	}
+	if fmt.Sprint(names) != "[INBOX/1.eml INBOX/2.eml INBOX/3.eml Sent/1.eml]" {
+		t.Errorf("resumed archive holds %v", names)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// --strict-readonly inspects every command written to the server: any
+// command that could change the mailbox is refused before it is sent,
+// and all of them are logged as an audit trail. Passwords and
+// authentication data are not logged.
+//
+// The check sits below the IMAP client on the plain-text connection, so
+// it cannot see commands after STARTTLS; strict mode requires implicit
+// TLS, no TLS or a local connection.
+
+var strictReadonly = flag.Bool("strict-readonly", false, "Refuse to send any command that could change the server, and log all commands sent")
+
+// mutating lists the commands that change server state. SELECT is
+// included since, unlike EXAMINE, it can clear \Recent and set \Seen.
+var mutating = map[string]bool{
+	"SELECT": true, "STORE": true, "COPY": true, "MOVE": true, "APPEND": true,
+	"CREATE": true, "DELETE": true, "RENAME": true, "SUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "EXPUNGE": true, "CLOSE": true, "SETMETADATA": true,
+	"SETACL": true, "DELETEACL": true, "SETQUOTA": true, "SETANNOTATION": true,
+}
+
+var errMutating = errors.New("command refused by --strict-readonly")
+
+var literalSuffix = regexp.MustCompile(`\{(\d+)\+?\}\r?$`)
+
+// auditConn audits the commands written to a connection.
+type auditConn struct {
+	net.Conn
+	server string
+
+	line    []byte
+	literal int  // bytes of literal data still to pass through
+	cont    bool // the next line continues a command after a literal
+	discard bool // the literal and lines are of a refused command
+}
+
+func AuditConn(conn net.Conn, server string) net.Conn {
+	return &auditConn{Conn: conn, server: server}
+}
+
+// Write passes the audited lines of p to the server. A refused command
+// is dropped with its literals, even if they come in later writes, such
+// as the non-synchronizing literals of LITERAL+; the lines around it are
+// still sent. Writes that drop data return the number of bytes before
+// it and errMutating.
+func (c *auditConn) Write(p []byte) (int, error) {
+	var out []byte
+	dropped := -1 // the position of the first byte dropped
+	var refused error
+	for i := 0; i < len(p); {
+		if c.literal > 0 {
+			n := min(c.literal, len(p)-i)
+			if !c.discard {
+				out = append(out, p[i:i+n]...)
+			} else if dropped < 0 {
+				dropped = i
+			}
+			c.literal -= n
+			i += n
+			continue
+		}
+		j := bytes.IndexByte(p[i:], '\n')
+		if j < 0 {
+			c.line = append(c.line, p[i:]...)
+			break
+		}
+		start := i
+		c.line = append(c.line, p[i:i+j+1]...)
+		i += j + 1
+		err := c.check()
+		if err != nil && refused == nil {
+			refused = err
+		}
+		if err != nil || c.discard {
+			// The line ends the refused command unless a literal
+			// follows.
+			if dropped < 0 {
+				dropped = start
+			}
+			c.discard = c.cont
+		} else {
+			out = append(out, c.line...)
+		}
+		c.line = nil
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	if dropped >= 0 {
+		if refused == nil {
+			refused = errMutating
+		}
+		return dropped, refused
+	}
+	return len(p), nil
+}
+
+// check audits a complete line and notes literals following it.
+func (c *auditConn) check() error {
+	line := strings.TrimRight(string(c.line), "\r\n")
+	cont := c.cont
+	c.cont = false
+	if m := literalSuffix.FindStringSubmatch(line); m != nil {
+		c.literal, _ = strconv.Atoi(m[1])
+		c.cont = true
+	}
+	if cont {
+		return nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		// A SASL response or the end of IDLE.
+		log.Printf("audit: %s: C: <%d bytes of data>", c.server, len(line))
+		return nil
+	}
+	name := strings.ToUpper(fields[1])
+	if name == "UID" && len(fields) > 2 {
+		name = strings.ToUpper(fields[2])
+	}
+	logged := line
+	switch name {
+	case "LOGIN", "AUTHENTICATE":
+		logged = strings.Join(fields[:2], " ") + " <credentials>"
+		if name == "AUTHENTICATE" && len(fields) > 2 {
+			logged = strings.Join(fields[:3], " ") + " <credentials>"
+		}
+	}
+	if mutating[name] {
+		log.Printf("audit: %s: refused: %s", c.server, logged)
+		return fmt.Errorf("%s: %w", name, errMutating)
+	}
+	log.Printf("audit: %s: C: %s", c.server, logged)
+	return nil
+}
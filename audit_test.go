@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+// sinkConn keeps what is written to it.
+type sinkConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *sinkConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+// audit writes to an audited connection and returns what reached the
+// server, the audit log and the first error.
+func audit(writes ...string) (sent, logged string, err error) {
+	var logBuf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logBuf)
+	conn := &sinkConn{}
+	c := AuditConn(conn, "imap.example.com")
+	for _, w := range writes {
+		if _, werr := c.Write([]byte(w)); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return conn.buf.String(), logBuf.String(), err
+}
+
+func TestAuditPassesReadCommands(t *testing.T) {
+	sent, logged, err := audit("a1 EXAMINE INBOX\r\n", "a2 UID FETCH 1:* (BODY.PEEK[])\r\n", "a3 NO", "OP\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a1 EXAMINE INBOX\r\na2 UID FETCH 1:* (BODY.PEEK[])\r\na3 NOOP\r\n"; sent != want {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+	if !strings.Contains(logged, "C: a3 NOOP") {
+		t.Errorf("a command split across writes is not logged:\n%s", logged)
+	}
+}
+
+func TestAuditRefusesMutations(t *testing.T) {
+	for _, cmd := range []string{"a1 SELECT INBOX\r\n", "a1 uid store 1 +FLAGS (\\Seen)\r\n", "a1 EXPUNGE\r\n", "a1 APPEND INBOX {5}\r\n"} {
+		sent, logged, err := audit(cmd)
+		if !errors.Is(err, errMutating) {
+			t.Errorf("%q: error %v", cmd, err)
+		}
+		if sent != "" {
+			t.Errorf("%q: sent %q", cmd, sent)
+		}
+		if !strings.Contains(logged, "refused") {
+			t.Errorf("%q: refusal not logged:\n%s", cmd, logged)
+		}
+	}
+}
+
+func TestAuditLiterals(t *testing.T) {
+	// Literal data is passed through without being taken for commands,
+	// and the line after it continues the command.
+	writes := []string{"a1 SEARCH TEXT {12}\r\n", "a2 STORE 1 x", " SUBJECT {3}\r\n", "abc\r\n"}
+	sent, _, err := audit(writes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(writes, ""); sent != want {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+}
+
+func TestAuditHidesCredentials(t *testing.T) {
+	_, logged, err := audit("a1 LOGIN user s3cret\r\n", "a2 AUTHENTICATE PLAIN AHVzZXIAczNjcmV0\r\n", "AHVzZXIAczNjcmV0\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logged, "s3cret") || strings.Contains(logged, "AHVzZXIAczNjcmV0") {
+		t.Errorf("credentials in the audit log:\n%s", logged)
+	}
+}
+
+func TestAuditRefusedLiteral(t *testing.T) {
+	// The non-synchronizing literal of a refused APPEND arrives in the
+	// next writes; it is dropped rather than taken for a command, and
+	// the command after it is sent.
+	sent, logged, err := audit("a1 APPEND INBOX {13+}\r\na2 DEL", "ETE x\r\n", "\r\n", "a3 NOOP\r\n")
+	if !errors.Is(err, errMutating) {
+		t.Errorf("error %v", err)
+	}
+	if sent != "a3 NOOP\r\n" {
+		t.Errorf("sent %q", sent)
+	}
+	if strings.Contains(logged, "DELETE") || strings.Count(logged, "refused") != 1 {
+		t.Errorf("literal data audited as a command:\n%s", logged)
+	}
+}
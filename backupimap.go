@@ -3,29 +3,44 @@
 package main
 
 import (
-	"archive/zip"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mxk/go-imap/imap"
 )
 
 var (
-	server   = flag.String("server", "mail.autistici.org", "IMAP server address")
-	username = flag.String("user", "", "Username")
-	password = flag.String("password", "", "Password")
-	output   = flag.String("outfile", "", "Output ZIP file name")
-	notls    = flag.Bool("notls", false, "Do *NOT* use TLS protocol")
+	server      = flag.String("server", "", "IMAP server host[:port], unix:/socket or exec:command (default: autodiscover from --user)")
+	username    = flag.String("user", "", "Username")
+	password    = flag.String("password", "", "Password, or keyring:<account> to read it from the system keyring")
+	output      = flag.String("outfile", "", "Output ZIP file name, - to write to stdout")
+	outDir      = flag.String("outdir", "", "Output directory for per-account ZIP files")
+	configFile  = flag.String("config", "", "JSON configuration file listing the accounts to back up")
+	usersFile   = flag.String("users-file", "", "File listing accounts to back up, one user or user:password per line")
+	tlsMode     = flag.String("tls", "implicit", "TLS mode: implicit, starttls or none")
+	notls       = flag.Bool("notls", false, "Deprecated, same as --tls=starttls")
+	auth        = flag.String("auth", "login", "Authentication method (login, gmail, o365-device)")
+	stateDir    = flag.String("statedir", defaultStateDir(), "Directory for cached tokens and other state")
+	connections = flag.Int("connections", concurrentConnections, "Number of concurrent IMAP connections, shared by all accounts")
+	watch       = flag.Duration("watch", 0, "Keep running, repeating the backup at this interval")
+	lockWait    = flag.Bool("lock-wait", false, "Wait for a concurrent backup of the same account instead of giving up")
+	headersOnly = flag.Bool("headers-only", false, "Only back up message headers, for an index of the account")
 
-	mboxCh       = make(chan *imap.MailboxInfo, 5)
-	msgCh        = make(chan *Message, 100)
-	msgIdCounter = 0
+	includeTrash = flag.Bool("include-trash", false, "Back up the Trash folder, which is skipped by default")
+	includeSpam  = flag.Bool("include-spam", false, "Back up the Spam and Junk folders, which are skipped by default")
+	trashMaxAge  = flag.String("trash-max-age", "", "Back up Trash, Spam and Junk, but only messages younger than this, e.g. 30d")
+	skipFolders  stringsFlag
+	folderMap    stringsFlag
+
+	accounts accountFlag
 
 	hostname string
 )
@@ -39,77 +54,370 @@ func init() {
 
 	// We might need a very big buffer.
 	imap.BufferSize = 1 << 20
+
+	flag.Var(&accounts, "account", "Account to back up as user[:password]@host, may be repeated")
+	flag.Var(&skipFolders, "skip-folder", "Folder, by name or role such as role:drafts, not to back up from any account, may be repeated")
+	flag.Var(&folderMap, "map", "Rename a folder as 'from=to' when backing up and restoring, may be repeated")
+	flag.Var(&gpgRecipients, "gpg-recipient", "Encrypt each message to this GnuPG key, may be repeated")
+	flag.Var(&teeOutputs, "tee", "Also write the backup to this directory or upload URL, may be repeated")
+	flag.Var(&maxTotalBytes, "max-total-bytes", "Stop downloading after `size` of message data in a run, e.g. 20G (0 for no limit)")
+	flag.Var(&maxFolderBytes, "max-folder-bytes", "Stop downloading a folder after `size` of message data, e.g. 1G (0 for no limit)")
 }
 
 type Message struct {
-	Folder string
-	Body   []byte
+	Folder      string
+	UID         uint32
+	UIDValidity uint32
+	Flags       []string
+	Labels      []string
+	Body        []byte
+
+	// ThreadID is the Gmail conversation of the message.
+	ThreadID string
+	// MessageID is the Message-ID header, taken before the body is
+	// encrypted, so that the manifest can be searched for it.
+	MessageID string
+
+	// Skipped is the reason the message, or the folder if UID is 0, is
+	// not backed up. Postponed messages are downloaded by the next
+	// incremental run.
+	Skipped   string
+	Subject   string
+	Postponed bool
+
+	// InternalDate and Size are the INTERNALDATE and RFC822.SIZE of the
+	// message on the server.
+	InternalDate time.Time
+	Size         uint32
+
+	// FlagUpdate carries only new flags of a message backed up earlier,
+	// Expunged reports that such a message was deleted.
+	FlagUpdate bool
+	Expunged   bool
+
+	// Complete marks the end of a folder rather than a message, ModSeq
+	// is the folder's HIGHESTMODSEQ when the download started, Metadata
+	// its annotations.
+	Complete bool
+	ModSeq   uint64
+	Metadata map[string]string
+
+	// fetchedSize is the size of the body as downloaded, deflated and
+	// crc32 the body compressed for ZIP archives, and err why it could
+	// not be prepared, see compress.go.
+	fetchedSize int64
+	deflated    []byte
+	crc32       uint32
+	err         error
 }
 
-func Check(cmd *imap.Command, err error) *imap.Command {
+// Result waits for cmd to complete and returns an error unless it
+// succeeded.
+func Result(cmd *imap.Command, err error) (*imap.Command, error) {
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	if _, err := cmd.Result(imap.OK); err != nil {
-		log.Fatal("IMAP error: ", err)
+		return nil, fmt.Errorf("IMAP error: %s", err)
+	}
+	return cmd, nil
+}
+
+func Check(cmd *imap.Command, err error) *imap.Command {
+	cmd, err = Result(cmd, err)
+	if err != nil {
+		log.Fatal(err)
 	}
 	return cmd
 }
 
-func Connect() *imap.Client {
+// ServerAddr adds the default port for the TLS mode to addr if it has none.
+func ServerAddr(addr, mode string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	if mode == "implicit" {
+		return net.JoinHostPort(addr, "993")
+	}
+	return net.JoinHostPort(addr, "143")
+}
+
+func (a *Account) Connect() (*imap.Client, error) {
 	var err error
 	var c *imap.Client
-	if *notls {
-		c, err = imap.Dial(*server)
-		if c.Caps["STARTTLS"] {
-			Check(c.StartTLS(nil))
-		}
+	addr := ServerAddr(a.Server, a.TLS)
+	if IsLocal(a.Server) {
+		c, err = DialLocal(a.Server)
 	} else {
-		c, err = imap.DialTLS(*server, nil)
+		c, err = DialIMAP(addr, a.TLS == "implicit")
 	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if c.State() == imap.Auth {
+		// PREAUTH, the connection is already logged in.
+		return c, nil
+	}
+	if a.TLS == "starttls" && !IsLocal(a.Server) {
+		if !c.Caps["STARTTLS"] {
+			c.Logout(-1)
+			return nil, fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if _, err := Result(c.StartTLS(TLSConfig(host))); err != nil {
+			c.Logout(-1)
+			return nil, err
+		}
+	}
+
+	switch a.Auth {
+	case "gmail", "o365-device":
+		var token string
+		if a.Auth == "gmail" {
+			token, err = GmailToken(a.Username)
+		} else {
+			token, err = O365Token(a.Username)
+		}
+		if err == nil {
+			_, err = Result(c.Auth(XOAuth2(a.Username, token)))
+		}
+	default:
+		_, err = Result(a.Login(c))
+	}
+	if err != nil {
+		c.Logout(-1)
+		return nil, err
 	}
 
-	Check(c.Login(*username, *password))
+	return c, nil
+}
 
-	return c
+// FolderName returns the name a mailbox is stored under in the backup.
+func FolderName(mbox string) string {
+	return strings.TrimPrefix(mbox, "INBOX/")
 }
 
-func DownloadMailbox(c *imap.Client, mbox *imap.MailboxInfo) {
-	name := mbox.Name
-	if strings.HasPrefix(name, "INBOX/") {
-		name = name[6:]
-	}
+func (a *Account) DownloadMailbox(c *imap.Client, p *Pacer, job *Job) {
+	mbox := job.Mailbox
+	name := a.Folder(mbox.Name)
 
-	// Skip some unwanted mailboxes.
-	if name == "dovecot.sieve" || name == "Spam" || name == "Trash" || name == "Junk" {
+	// Folders that only hold other folders cannot be selected.
+	if a.Excluded(mbox) || mbox.Attrs[`\Noselect`] {
+		return
+	}
+	if job.attempts == 0 && !a.PreFolderHook(name) {
+		a.SkipFolder(name, "pre-folder-hook failed")
 		return
 	}
 
+	var modSeq uint64
+	if HasCondStore(c) {
+		modSeq = HighestModSeq(c, mbox.Name)
+	}
+
 	c.Select(mbox.Name, true)
-	if c.Mailbox == nil {
+	if c.Mailbox == nil && job.Retry(c) {
+		return
+	} else if c.Mailbox == nil {
 		log.Printf("Error selecting mailbox '%s'", mbox.Name)
+		a.SkipFolder(name, "could not be selected")
 		return
 	}
-	log.Printf("%s - %d messages", name, c.Mailbox.Messages)
+	complete := &Message{Folder: name, UIDValidity: c.Mailbox.UIDValidity, Complete: true, ModSeq: modSeq,
+		Metadata: GetMetadata(c, mbox.Name)}
+	log.Printf("%s: %s - %d messages", a.Username, name, c.Mailbox.Messages)
 	if c.Mailbox.Messages == 0 {
+		a.msgCh <- complete
+		return
+	}
+
+	first := uint32(1)
+	if *incremental {
+		first = a.state.FirstUID(a.Username, name, c.Mailbox.UIDValidity)
+	}
+
+	// Continue where an interrupted run stopped.
+	var done map[uint32]bool
+	if prog := a.progress[name]; prog != nil {
+		switch {
+		case prog.Complete:
+			log.Printf("%s: %s already backed up", a.Username, name)
+			return
+		case prog.UIDValidity != c.Mailbox.UIDValidity:
+			log.Printf("%s: %s has changed since the interrupted run, downloading it again", a.Username, name)
+		default:
+			done = prog.UIDs
+		}
+	} else if fs := a.state.Folders[name]; *incremental && fs != nil && first > 1 {
+		a.DetectExpunged(c, name, fs)
+		done = fs.Since(first)
+		if fs.HighestModSeq > 0 && fs.HighestModSeq < modSeq && !a.FetchFlagChanges(c, name, fs) {
+			// Try again from the old mod-sequence next time.
+			complete.ModSeq = 0
+		}
+	}
+
+	if c.Mailbox.UIDNext != 0 && first >= c.Mailbox.UIDNext {
+		a.msgCh <- complete
+		return
+	}
+
+	var criteria []imap.Field
+	if IsTrash(mbox) && *trashMaxAge != "" {
+		age, _ := ParseAge(*trashMaxAge)
+		criteria = []imap.Field{"SINCE", time.Now().Add(-age).Format("2-Jan-2006")}
+	}
+	uids, err := SearchUIDs(c, first, criteria...)
+	if err != nil {
+		if job.Retry(c) {
+			return
+		}
+		atomic.AddInt64(&a.Stats.Errors, 1)
+		log.Printf("%s: could not list messages of %s: %s", a.Username, name, err)
+		a.SkipFolder(name, "could not list messages: "+err.Error())
 		return
 	}
+	if len(criteria) > 0 {
+		if old, err := SearchUIDs(c, first, "BEFORE", criteria[1]); err == nil {
+			a.Skip(c, name, complete.UIDValidity, old, "older than --trash-max-age", true)
+		}
+	}
+	if done != nil || job.received != nil {
+		remaining := uids[:0]
+		for _, uid := range uids {
+			if !done[uid] && !job.received[uid] {
+				remaining = append(remaining, uid)
+			}
+		}
+		uids = remaining
+	}
+	uids = a.SkipDuplicates(c, name, complete.UIDValidity, uids)
+	if *splitFolders > 0 && *connections > 1 && len(uids) > *splitFolders {
+		a.StartFolder(name)
+		a.SplitMailbox(mbox, complete, uids)
+		return
+	}
+	a.StartFolder(name)
+	for len(uids) > 0 {
+		if reason := a.Limit(name); reason != "" {
+			a.Postpone(name, complete.UIDValidity, uids, reason)
+			return
+		}
+		n := min(len(uids), *fetchBatch)
+		p.Wait()
+		if !a.FetchMessages(c, job, name, uids[:n]) {
+			if !job.Retry(c) {
+				a.Postpone(name, complete.UIDValidity, job.NotReceived(uids), "could not be fetched")
+			}
+			return
+		}
+		uids = uids[n:]
+	}
+	a.msgCh <- complete
+}
+
+// SearchUIDs returns the UIDs of the selected mailbox starting at first,
+// matching the additional search criteria if any.
+func SearchUIDs(c *imap.Client, first uint32, criteria ...imap.Field) ([]uint32, error) {
+	spec := append([]imap.Field{"UID", fmt.Sprintf("%d:*", first)}, criteria...)
+	cmd, err := Result(c.UIDSearch(spec...))
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, resp := range cmd.Data {
+		for _, uid := range resp.SearchResults() {
+			// "n:*" always includes the last message, even if
+			// its UID is lower than n.
+			if uid >= first {
+				uids = append(uids, uid)
+			}
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
 
+// FetchMessages downloads a batch of messages of the job from the
+// selected mailbox. If the server says it is throttling the account, the
+// messages not received yet are fetched again after a pause. It returns
+// false if the fetch failed.
+func (a *Account) FetchMessages(c *imap.Client, job *Job, name string, uids []uint32) bool {
+	wait := *throttleWait
+	for retry := 0; ; retry++ {
+		resp, err := a.fetch(c, job, name, uids)
+		if err == nil {
+			return true
+		}
+		if job.Retry(c) {
+			return false
+		}
+		if err != imap.ErrAborted && IsThrottled(resp) && retry < *throttleRetries {
+			log.Printf("%s: %s - throttled by the server (%s), waiting %s", a.Username, name, resp.Info, wait)
+			SdNotify(fmt.Sprintf("STATUS=%s: throttled, waiting %s", a.Username, wait))
+			time.Sleep(wait)
+			wait *= 2
+			var rest []uint32
+			for _, uid := range uids {
+				if !job.received[uid] {
+					rest = append(rest, uid)
+				}
+			}
+			if uids = rest; len(uids) == 0 {
+				return true
+			}
+			continue
+		}
+		atomic.AddInt64(&a.Stats.Errors, 1)
+		if err == imap.ErrAborted {
+			log.Printf("Fetch command aborted")
+		} else {
+			log.Printf("Fetch error: %s", resp.Info)
+		}
+		return false
+	}
+}
+
+// fetch sends a single FETCH for the messages, recording those received
+// in the job, and returns the command result.
+func (a *Account) fetch(c *imap.Client, job *Job, name string, uids []uint32) (*imap.Response, error) {
 	set, _ := imap.NewSeqSet("")
-	set.Add("1:*")
+	set.AddNum(uids...)
 
-	cmd, _ := c.Fetch(set, "BODY[]")
+	// BODY.PEEK[] is returned as BODY[].
+	body, items := "BODY[]", []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "BODY.PEEK[]"}
+	if *headersOnly {
+		body, items[3] = "BODY[HEADER]", "BODY.PEEK[HEADER]"
+	}
+	if c.Caps["X-GM-EXT-1"] {
+		items = append(items, "X-GM-LABELS", "X-GM-THRID")
+	}
+	cmd, _ := c.UIDFetch(set, items...)
 	for cmd.InProgress() {
-		c.Recv(-1)
+		if err := c.Recv(RecvTimeout()); err == imap.ErrTimeout {
+			log.Printf("%s: %s - no data received for %s, closing the connection", a.Username, name, *messageTimeout)
+			c.Logout(0)
+			break
+		}
 
 		for _, resp := range cmd.Data {
+			info := resp.MessageInfo()
 			msg := Message{
-				Folder: name,
-				Body:   imap.AsBytes(resp.MessageInfo().Attrs["BODY[]"]),
+				Folder:      name,
+				UID:         info.UID,
+				UIDValidity: c.Mailbox.UIDValidity,
+				Flags:       FlagList(info.Flags),
+				Labels:      GmailLabels(info),
+				Body:        imap.AsBytes(info.Attrs[body]),
+
+				InternalDate: info.InternalDate,
+				Size:         info.Size,
+				ThreadID:     GmailThreadID(info),
 			}
-			msgCh <- &msg
+			budget.Acquire(int64(len(msg.Body)))
+			a.Fetched(name, len(msg.Body))
+			a.msgCh <- &msg
+			job.Received(info.UID)
 		}
 		cmd.Data = nil
 
@@ -117,110 +425,732 @@ func DownloadMailbox(c *imap.Client, mbox *imap.MailboxInfo) {
 		c.Data = nil
 	}
 
-	if resp, err := cmd.Result(imap.OK); err != nil {
-		if err == imap.ErrAborted {
-			log.Printf("Fetch command aborted")
-		} else {
-			log.Printf("Fetch error: %s", resp.Info)
-		}
-	}
+	return cmd.Result(imap.OK)
 }
 
-func MboxDownloader() {
+// MboxDownloader processes jobs from any account, keeping the connection
+// open while consecutive jobs belong to the same account. The first
+// worker of an account takes over the lister's connection, the others
+// connect when they get a job. If the server drops the connection, the
+// job is queued again for any worker, which continues where it stopped,
+// and this one reconnects for its next job.
+func MboxDownloader(jobs <-chan *Job) {
 	var c *imap.Client
-	for mbox := range mboxCh {
-		if c == nil {
-			c = Connect()
+	var current *Account
+	var p *Pacer
+	for job := range jobs {
+		a := job.Account
+		if a != current && c != nil {
+			Close(c)
+			current.Release()
+			c = nil
+		}
+		current = a
+		if c != nil && Dropped(c) {
+			log.Printf("%s: connection closed by the server, reconnecting", a.Username)
+			a.Release()
+			c = nil
+		}
+		if c == nil && a.Err() == nil {
+			if c = a.TakeIdle(); c == nil {
+				a.Acquire()
+				var err error
+				if c, err = a.Connect(); err != nil {
+					a.Release()
+					a.Fail(err)
+				}
+			}
+			p = NewPacer(a.fetchInterval)
+		}
+		if a.Err() == nil && job.Chunk != nil {
+			a.DownloadChunk(c, p, job)
+		} else if a.Err() == nil {
+			a.DownloadMailbox(c, p, job)
 		}
-		DownloadMailbox(c, mbox)
+		if a.Err() == nil && job.Retry(c) {
+			job.attempts++
+			log.Printf("%s: connection lost while downloading %s, queueing it again", a.Username, job.Mailbox.Name)
+			a.Queue(job)
+		} else if a.Err() == nil && Dropped(c) {
+			atomic.AddInt64(&a.Stats.Errors, 1)
+			log.Printf("%s: giving up on %s, the connection was dropped %d times", a.Username, job.Mailbox.Name, job.attempts+1)
+		}
+		a.pending.Done()
+	}
+	if c != nil {
+		Close(c)
+		current.Release()
+	}
+}
+
+// NewWriter opens an output of the account in the configured format.
+func (a *Account) NewWriter(output string, m *Manifest) (Writer, error) {
+	if *repo != "" {
+		return NewRepoWriter(*repo, output, m)
+	}
+	store, err := a.NewStorer(output, m)
+	if err != nil {
+		return nil, err
+	}
+	// The ZIP and Maildir storers keep their own records.
+	if w, ok := store.(Writer); ok {
+		return w, nil
+	} else if store != nil {
+		return NewStoreWriter(store, m), nil
 	}
-	Close(c)
+	switch *format {
+	case "sdbox":
+		return NewDboxWriter(output, m)
+	case "eml":
+		return NewEmlWriter(output, m)
+	}
+	return NewFolderZipWriter(output, m, a.checkpoint)
 }
 
-func GetMaildirFileName() string {
-	msgIdCounter++
-	return fmt.Sprintf("%d.%d_1.%s:2,S",
-		time.Now().Unix(),
-		msgIdCounter,
-		hostname)
+// NewStorer opens the storage backend of an output, see store.go. It
+// returns nil for the outputs that are only Writers.
+func (a *Account) NewStorer(output string, m *Manifest) (Storer, error) {
+	switch {
+	case *storeCmd != "":
+		return NewExecStore(*storeCmd, output)
+	case IsS3(output):
+		return NewS3Store(output)
+	}
+	switch {
+	case *format == "tar":
+		return NewTarStore(output)
+	case *format == "maildir":
+		return NewMaildirWriter(output, m, a.state)
+	case *format == "sdbox" || *format == "eml" || *perFolder:
+		return nil, nil
+	case a.checkpoint != nil:
+		log.Printf("%s: resuming %s with %d messages", a.Username, output, len(a.checkpoint))
+		return ResumeZipWriter(output, m, a.checkpoint)
+	}
+	return NewZipWriter(output, m)
 }
 
-func MsgWriter() {
-	msgCount := 0
+// Finish compresses, signs and uploads a complete output. It returns
+// false if the upload failed.
+func (a *Account) Finish(w Writer, m *Manifest, output, upload string) bool {
+	if *compression == "zstd" {
+		if compressed, err := ZstdCompress(output); err != nil {
+			a.Fail(fmt.Errorf("could not compress %s: %s", output, err))
+		} else if output = compressed; upload != "" {
+			upload += ".zst"
+		}
+	}
+	var sig string
+	if *signKey != "" {
+		var err error
+		if sig, err = Seal(w, m, output); err != nil {
+			a.Fail(fmt.Errorf("could not sign the backup: %s", err))
+		}
+	}
+	if upload == "" {
+		return true
+	}
+	err := Upload(output, upload)
+	if err == nil && sig != "" {
+		err = Upload(sig, upload+strings.TrimPrefix(sig, output))
+	}
+	if err != nil {
+		a.Fail(fmt.Errorf("upload failed, the archive is kept in %s: %s", output, err))
+		return false
+	}
+	os.Remove(output)
+	if sig != "" {
+		os.Remove(sig)
+	}
+	return true
+}
 
-	file, err := os.Create(*output)
+func (a *Account) MsgWriter() {
+	m := &Manifest{Account: a.Username, Created: time.Now(), Incremental: *incremental, HeadersOnly: *headersOnly,
+		EncryptedTo: gpgRecipients}
+	main, err := a.NewWriter(a.Output, m)
+	var w Writer = main
+	var tee *TeeWriter
+	if err == nil && len(teeOutputs) > 0 {
+		if tee, err = a.NewTeeWriter(main, m); err == nil {
+			w = tee
+		}
+	}
 	if err != nil {
-		log.Fatal(err)
+		a.Fail(err)
+		// Keep the downloaders going, they will stop at the next mailbox.
+		for msg := range a.msgCh {
+			budget.Release(int64(len(msg.Body)))
+		}
+		return
 	}
-	defer file.Close()
 
-	zw := zip.NewWriter(file)
+	var journal *FlagJournal
+	if *flagJournal && !*headersOnly {
+		var jerr error
+		if journal, jerr = OpenFlagJournal(a.Username); jerr != nil {
+			log.Printf("%s: could not read the flag journal: %s", a.Username, jerr)
+		}
+	}
+
+	// Changes written by this run, for the account state.
+	changes := make(Changes)
+	for _, r := range a.checkpoint {
+		if journal != nil && !r.Complete {
+			journal.Record(&Message{Folder: r.Folder, UID: r.UID, UIDValidity: r.UIDValidity, Flags: r.Flags,
+				FlagUpdate: r.FlagUpdate, Expunged: r.Expunged}, r.Modified)
+		}
+		ch := changes.Folder(r.Folder, r.UIDValidity)
+		switch {
+		case r.Complete:
+			a.done[r.Folder] = true
+			ch.Complete = true
+			ch.HighestModSeq = r.ModSeq
+		case r.Expunged:
+			ch.Expunged = append(ch.Expunged, r.UID)
+		case !r.FlagUpdate:
+			ch.Added = append(ch.Added, r.UID)
+		}
+	}
 
-	for msg := range msgCh {
-		zf, err := zw.Create(filepath.Join(msg.Folder, "cur", GetMaildirFileName()))
+	// Messages written by folder, for --post-folder-hook.
+	written := make(map[string]int)
+	_, deflate := compressionLevels[*compression]
+	deflate = deflate && *repo == "" && *storeCmd == "" && !IsS3(a.Output) && *format == "zip"
+	msgs := Prepare(a.msgCh, *compressWorkers, func(msg *Message) { PrepareMessage(msg, deflate) })
+	for msg := range msgs {
+		if msg.Skipped != "" {
+			m.Skipped = append(m.Skipped, &SkippedMessage{Folder: msg.Folder, UIDValidity: msg.UIDValidity, UID: msg.UID,
+				Subject: msg.Subject, Reason: msg.Skipped})
+			a.Stats.Skipped++
+			if msg.Postponed {
+				ch := changes.Folder(msg.Folder, msg.UIDValidity)
+				ch.Postponed = append(ch.Postponed, msg.UID)
+			}
+			continue
+		}
+		ch := changes.Folder(msg.Folder, msg.UIDValidity)
+		switch {
+		case msg.FlagUpdate:
+			err = w.UpdateFlags(msg)
+		case msg.Expunged:
+			ch.Expunged = append(ch.Expunged, msg.UID)
+			err = w.Expunge(msg)
+		case msg.Complete:
+			a.done[msg.Folder] = true
+			ch.Complete = true
+			ch.HighestModSeq = msg.ModSeq
+			if err = w.Complete(msg); err == nil {
+				a.PostFolderHook(msg.Folder, written[msg.Folder])
+			}
+		default:
+			name := a.MessageName(msg)
+			ch.Added = append(ch.Added, msg.UID)
+			if *format == "maildir" {
+				ch.Files[msg.UID] = name
+			}
+			size := msg.fetchedSize
+			// Encryption or compression failed.
+			if err = msg.err; err == nil {
+				err = w.Add(name, msg)
+			}
+			if err == nil {
+				written[msg.Folder]++
+				a.Stats.Messages++
+				a.Stats.Bytes += size
+			}
+			budget.Release(size)
+		}
 		if err != nil {
-			log.Fatal(err)
+			a.Fail(fmt.Errorf("could not write %s: %s", a.Destination(), err))
+			// Keep the downloaders going, they will stop at the next
+			// mailbox.
+			for msg := range msgs {
+				budget.Release(msg.fetchedSize)
+			}
+			break
+		}
+		if journal != nil && !msg.Complete {
+			journal.Record(msg, time.Now())
 		}
-		zf.Write(msg.Body)
-		msgCount++
 	}
 
-	zw.Close()
-	log.Printf("retrieved %d messages, output written to %s", msgCount, *output)
+	// The lister is done once msgCh is closed.
+	if a.serverMetadata != nil {
+		m.SetMetadata("", a.serverMetadata)
+	}
+	m.Mailboxes = a.Renamed()
+	for _, folder := range a.excluded {
+		m.Skipped = append(m.Skipped, &SkippedMessage{Folder: folder, Reason: "excluded folder"})
+	}
+	complete := a.Err() == nil && atomic.LoadInt64(&a.Stats.Errors) == 0
+	if cerr := w.Close(complete); cerr != nil {
+		a.Fail(fmt.Errorf("could not write %s: %s", a.Destination(), cerr))
+		err = cerr
+	}
+	if err != nil {
+		// What was written is not a backup the state can rely on.
+		return
+	}
+	if complete {
+		ok := a.Finish(main, m, a.Output, a.upload)
+		if tee != nil {
+			for _, c := range tee.copies {
+				ok = a.Finish(c.Writer, c.Manifest, c.Output, c.Upload) && ok
+			}
+		}
+		if !ok {
+			// The state is not updated, so that an incremental run
+			// does not skip the messages that did not arrive.
+			return
+		}
+	}
+	// Headers-only runs must not keep later runs from fetching the
+	// complete messages.
+	if !*headersOnly {
+		a.state.Update(changes, *incremental)
+		if err := a.state.Save(a.Username); err != nil {
+			log.Printf("%s: could not save state: %s", a.Username, err)
+		}
+		if journal != nil {
+			if err := journal.Save(); err != nil {
+				log.Printf("%s: could not write the flag journal: %s", a.Username, err)
+			}
+		}
+	}
+	log.Printf("%s: retrieved %d messages, output written to %s", a.Username, a.Stats.Messages, a.Destination())
 }
 
-func ListMailboxes(c *imap.Client) {
-	cmd := Check(c.List("", "*"))
-	for _, response := range cmd.Data {
-		mbox := response.MailboxInfo()
-		mboxCh <- mbox
+// ListMailboxes queues all mailboxes of the account for download.
+func (a *Account) ListMailboxes(jobs chan<- *Job) error {
+	log.Printf("connecting to %s as user %s", a.Server, a.Username)
+	a.Acquire()
+	c, err := a.Connect()
+	if err != nil {
+		a.Release()
+		return err
+	}
+	if err := a.Preflight(c); err != nil {
+		Close(c)
+		a.Release()
+		return err
+	}
+	a.serverMetadata = GetMetadata(c, "")
+	cmd, err := ListAll(c)
+	var queue []*Job
+	if err == nil {
+		queue = a.ScheduleMailboxes(c, cmd.Data)
+		if *prefetchHeaders {
+			queue = a.Prefetch(c, queue)
+		}
+	}
+	if err != nil {
+		Close(c)
+		a.Release()
+		return err
 	}
+	// A worker continues with the connection and its slot.
+	a.HandOff(c)
+
+	for _, job := range queue {
+		a.pending.Add(1)
+		jobs <- job
+	}
+	return nil
+}
+
+// ScheduleMailboxes orders the listed mailboxes largest first, so that
+// the run does not end with a single connection downloading a big folder
+// while the others are idle. The size comes from STATUS, in bytes if the
+// server supports STATUS=SIZE and in messages otherwise. The totals are
+// kept as the expected size of the backup.
+func (a *Account) ScheduleMailboxes(c *imap.Client, list []*imap.Response) []*Job {
+	items := []string{"MESSAGES"}
+	if c.Caps["STATUS=SIZE"] {
+		items = append(items, "SIZE")
+	}
+	var queue []*Job
+	var mboxes []*imap.MailboxInfo
+	a.expected, a.excluded = nil, nil
+	for _, resp := range list {
+		mboxes = append(mboxes, resp.MailboxInfo())
+	}
+	a.folders = a.FolderNames(mboxes)
+	size := make(map[*Job]uint64)
+	var messages, octets uint64
+	for _, resp := range list {
+		job := &Job{Account: a, Mailbox: resp.MailboxInfo()}
+		queue = append(queue, job)
+		if job.Mailbox.Attrs[`\Noselect`] {
+			continue
+		}
+		if a.Excluded(job.Mailbox) {
+			a.excluded = append(a.excluded, a.Folder(job.Mailbox.Name))
+			continue
+		}
+		a.expected = append(a.expected, a.Folder(job.Mailbox.Name))
+		st := StatusValues(c, job.Mailbox.Name, items...)
+		messages += st["MESSAGES"]
+		octets += st["SIZE"]
+		size[job] = st["MESSAGES"]
+		if st["SIZE"] > 0 {
+			size[job] = st["SIZE"]
+		}
+	}
+	sort.SliceStable(queue, func(i, j int) bool { return size[queue[i]] > size[queue[j]] })
+
+	atomic.StoreInt64(&a.Stats.ExpectedMessages, int64(messages))
+	atomic.StoreInt64(&a.Stats.ExpectedBytes, int64(octets))
+	if octets > 0 {
+		log.Printf("%s: %d messages (%d MB) in %d folders", a.Username, messages, octets>>20, len(size))
+	} else {
+		log.Printf("%s: %d messages in %d folders", a.Username, messages, len(size))
+	}
+	return queue
 }
 
 func Close(c *imap.Client) {
-	Check(c.Logout(30 * time.Second))
+	if _, err := Result(c.Logout(30 * time.Second)); err != nil {
+		log.Printf("logout failed: %s", err)
+	}
+}
+
+// Backup runs the backup of all accounts, sharing the connection pool
+// between them. Each account has its own writer.
+func Backup(accts []*Account) {
+	jobs := make(chan *Job, 5)
+
+	var dlGroup sync.WaitGroup
+	for i := 0; i < *connections; i++ {
+		dlGroup.Add(1)
+		go func() {
+			MboxDownloader(jobs)
+			dlGroup.Done()
+		}()
+	}
+
+	var writeGroup sync.WaitGroup
+	for _, a := range accts {
+		a.msgCh = make(chan *Message, 100)
+		a.jobs = jobs
+		writeGroup.Add(1)
+		go func(a *Account) {
+			a.MsgWriter()
+			writeGroup.Done()
+		}(a)
+	}
+
+	// Accounts are listed one after the other, so that workers mostly
+	// see consecutive jobs for the same account and can reuse their
+	// connection.
+	go func() {
+		for _, a := range accts {
+			if err := a.ListMailboxes(jobs); err != nil {
+				a.Fail(err)
+			}
+			go func(a *Account) {
+				a.pending.Wait()
+				a.CloseIdle()
+				close(a.msgCh)
+			}(a)
+		}
+		// Split folders queue more jobs while they are downloaded.
+		for _, a := range accts {
+			a.pending.Wait()
+		}
+		close(jobs)
+	}()
+
+	writeGroup.Wait()
+	dlGroup.Wait()
+}
+
+// IsFlagSet reports whether the named flag was given on the command line.
+func IsFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func Usage() {
 	fmt.Fprintf(os.Stderr, "backupimap - backup your IMAP accounts to ZIP files\n\n")
-	fmt.Fprintf(os.Stderr, "Usage: %s\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [command]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  auth login gmail|o365       obtain and cache an OAuth token for --user\n")
+	fmt.Fprintf(os.Stderr, "  export <backup>...          write .eml files for Outlook, -o <dir>\n")
+	fmt.Fprintf(os.Stderr, "  import <mbox|maildir>...    convert mbox files and Maildirs, -o <zip>\n")
+	fmt.Fprintf(os.Stderr, "  keyring set <account>       store a password in the system keyring\n")
+	fmt.Fprintf(os.Stderr, "  manifest export <backup>... list the messages of backups as CSV, see manifest export -h\n")
+	fmt.Fprintf(os.Stderr, "  merge <backup>... -o <zip>  combine backups into one archive\n")
+	fmt.Fprintf(os.Stderr, "  prune <backup.zip>          drop old messages or folders from an archive, see prune -h\n")
+	fmt.Fprintf(os.Stderr, "  rekey <backup>...           re-encrypt backups to the current --gpg-recipient keys\n")
+	fmt.Fprintf(os.Stderr, "  report <backup>...          show how the backups grew from run to run, see report -h\n")
+	fmt.Fprintf(os.Stderr, "  restore <backup>...         append the messages of backups to --user\n")
+	fmt.Fprintf(os.Stderr, "  restore-message <backup>... append one message, found by its Message-ID, see restore-message -h\n")
+	fmt.Fprintf(os.Stderr, "  service install|uninstall   run with the options as a Windows service\n")
+	fmt.Fprintf(os.Stderr, "  stats <backup>...           summarize backups by folder, sender and year\n")
+	fmt.Fprintf(os.Stderr, "  upgrade <backup>...         convert backups of older versions to the current format\n\n")
 	flag.PrintDefaults()
 }
 
 func main() {
 	flag.Usage = Usage
 	flag.Parse()
+	SetupSystemd()
+	SetupService()
 
-	if *username == "" || *password == "" {
-		fmt.Fprintln(os.Stderr, "You must specify both --user and --password!")
+	if *notls {
+		*tlsMode = "starttls"
+	}
+
+	if flag.NArg() > 0 {
+		RunCommand(flag.Args())
+		return
+	}
+
+	budget = NewBudget(int64(*memoryLimit) << 20)
+	if *selftest {
+		if err := SelfTest(); err != nil {
+			log.Fatalf("selftest failed: %s", err)
+		}
+		return
+	}
+
+	switch *format {
+	case "zip", "maildir", "sdbox", "eml", "tar":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output format '%s'\n", *format)
+		os.Exit(1)
+	}
+	if *perFolder && (*format != "zip" || *repo != "" || *output == "-") {
+		fmt.Fprintf(os.Stderr, "--per-folder-output only works with ZIP archives written to a directory\n")
 		os.Exit(1)
 	}
-	if *output == "" {
-		fmt.Fprintln(os.Stderr, "You must specify an output file with --output!")
+	switch {
+	case *filenames == "uid" && *format != "zip":
+		fmt.Fprintf(os.Stderr, "--filename=uid only applies to ZIP archives\n")
+		os.Exit(1)
+	case *filenames != "uid" && *filenames != "maildir":
+		fmt.Fprintf(os.Stderr, "Unknown --filename '%s'\n", *filenames)
+		os.Exit(1)
+	}
+	if _, ok := compressionLevels[*compression]; !ok && *compression != "store" && *compression != "zstd" {
+		fmt.Fprintf(os.Stderr, "Unknown --compression '%s'\n", *compression)
+		os.Exit(1)
+	}
+	if *compressWorkers < 1 {
+		fmt.Fprintf(os.Stderr, "--compress-workers must be at least 1\n")
+		os.Exit(1)
+	}
+	if len(teeOutputs) > 0 && (*repo != "" || *resume || *output == "-") {
+		fmt.Fprintf(os.Stderr, "--tee cannot be used with --repo, --resume or stdout\n")
+		os.Exit(1)
+	}
+	if *compression == "zstd" && (*format != "zip" || *repo != "" || *perFolder || *output == "-") {
+		fmt.Fprintf(os.Stderr, "--compression=zstd only works with single ZIP archives written to a file\n")
+		os.Exit(1)
+	}
+	if *skipDuplicates {
+		*prefetchHeaders = true
+	}
+	if _, err := ParseAge(*trashMaxAge); err != nil {
+		fmt.Fprintf(os.Stderr, "--trash-max-age: %s\n", err)
+		os.Exit(1)
+	}
+	if *folderTimeout < 0 || *messageTimeout < 0 || *maxErrors < 0 || *maxErrorRate < 0 || *maxErrorRate >= 1 {
+		fmt.Fprintf(os.Stderr, "--folder-timeout, --message-timeout and --max-errors cannot be negative, --max-error-rate must be below 1\n")
+		os.Exit(1)
+	}
+	if *signKey != "" {
+		if _, _, err := ParseSignKey(*signKey); err != nil {
+			fmt.Fprintf(os.Stderr, "--sign-key: %s\n", err)
+			os.Exit(1)
+		}
+		if *output == "-" {
+			fmt.Fprintf(os.Stderr, "--sign-key cannot sign an archive written to stdout\n")
+			os.Exit(1)
+		}
+	}
+	if (*format == "tar" || *storeCmd != "") && *repo != "" {
+		fmt.Fprintf(os.Stderr, "--repo cannot be used with --format=tar or --store-cmd\n")
+		os.Exit(1)
+	}
+	if *output == "-" && (*format != "zip" || *repo != "" || *resume) {
+		fmt.Fprintf(os.Stderr, "Only ZIP archives can be written to stdout, and not resumed\n")
 		os.Exit(1)
 	}
 
-	var dlGroup sync.WaitGroup
-	for i := 0; i < concurrentConnections; i++ {
-		dlGroup.Add(1)
-		go func() {
-			MboxDownloader()
-			dlGroup.Done()
-		}()
+	dir := *outDir
+	accts := []*Account(accounts)
+	if *configFile != "" {
+		cfg, err := LoadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		accts = append(accts, cfg.Accounts...)
+		if dir == "" {
+			dir = cfg.OutDir
+		}
+	}
+	if *usersFile != "" {
+		users, err := LoadUsers(*usersFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		accts = append(accts, users...)
+	}
+	if *username != "" {
+		accts = append(accts, &Account{Username: *username})
+	}
+	if len(accts) == 0 {
+		fmt.Fprintln(os.Stderr, "You must specify --user, --account, --users-file or --config!")
+		os.Exit(1)
+	}
+	if len(accts) > 1 && *output != "" {
+		fmt.Fprintln(os.Stderr, "Use --outdir rather than --outfile with multiple accounts!")
+		os.Exit(1)
+	}
+	if len(accts) == 1 && accts[0].Output == "" {
+		accts[0].Output = *output
 	}
 
-	go func() {
-		dlGroup.Wait()
-		close(msgCh)
-	}()
+	if *metricsAddr != "" {
+		go ServeMetrics(*metricsAddr)
+	}
 
-	go func() {
-		log.Printf("connecting to %s as user %s", *server, *username)
-		c := Connect()
-		ListMailboxes(c)
-		Close(c)
-		close(mboxCh)
-	}()
+	scheduled, err := SetupSchedules(accts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	SdNotify("READY=1")
+	if scheduled {
+		log.Fatal(Daemon(accts, dir))
+	}
+
+	confirmRun = *watch == 0 && !*assumeYes && Interactive()
+	for {
+		summary := Run(accts, dir)
+		if *watch == 0 {
+			if summary.Status != "success" {
+				os.Exit(1)
+			}
+			return
+		}
+		log.Printf("next backup in %s", *watch)
+		time.Sleep(*watch)
+	}
+}
+
+// Run backs up all accounts once and reports the results.
+func Run(accts []*Account, dir string) *Summary {
+	summary := &Summary{Host: hostname, Start: time.Now()}
+	atomic.StoreInt64(&downloaded, 0)
+	SdNotify(fmt.Sprintf("STATUS=Backing up %d accounts", len(accts)))
+	var ready []*Account
+	for _, a := range accts {
+		a.Reset()
+		if err := a.Setup(dir); err != nil {
+			a.Fail(err)
+			continue
+		}
+		if err := a.RunOutput(summary.Start); err != nil {
+			a.Fail(err)
+			continue
+		}
+		if *preHook != "" {
+			if err := RunHook(*preHook, a.HookEnv()...); err != nil {
+				a.Fail(fmt.Errorf("pre-hook failed: %s", err))
+				continue
+			}
+		}
+		// A backup streamed to stdout or stored elsewhere has no
+		// output file to lock.
+		lockPath := a.Output + ".lock"
+		if a.outputBase != "" {
+			lockPath = a.outputBase + ".lock"
+		}
+		if a.Output == "-" || IsS3(a.Output) || *storeCmd != "" {
+			lockPath = StateFile(a.Username) + ".lock"
+		}
+		lock, err := LockFile(lockPath, false)
+		if err == errLocked && *lockWait {
+			log.Printf("%s: waiting for another backup to %s to finish", a.Username, a.Output)
+			lock, err = LockFile(lockPath, true)
+		}
+		if err != nil {
+			a.Fail(fmt.Errorf("could not lock %s: %s", a.Output, err))
+			continue
+		}
+		defer lock.Unlock()
+
+		if a.state, err = LoadState(a.Username); err != nil {
+			a.Fail(fmt.Errorf("could not load state: %s", err))
+			continue
+		}
+		if *resume {
+			load := LoadCheckpoint
+			if *perFolder {
+				load = LoadFolderCheckpoints
+			}
+			records, err := load(a.Output)
+			if err != nil && !os.IsNotExist(err) {
+				a.Fail(err)
+				continue
+			}
+			a.checkpoint = records
+			a.progress = Progress(records)
+			a.msgIdCounter = len(records)
+		} else if _, err := os.Stat(CheckpointPath(a.Output)); err == nil {
+			log.Printf("%s: overwriting interrupted backup, use --resume to continue it", a.Username)
+		}
+		ready = append(ready, a)
+	}
+
+	if confirmRun && len(ready) > 0 {
+		Estimate(ready)
+		if !Confirm("Start the backup?") {
+			log.Fatal("backup cancelled")
+		}
+	}
+	Backup(ready)
 
-	MsgWriter()
+	summary.End = time.Now()
+	summary.Status = "success"
+	for _, a := range accts {
+		s := AccountSummary{User: a.Username, Output: a.Destination(), Status: "success", Stats: a.Stats,
+			Incomplete: a.IncompleteFolders()}
+		if err := a.Err(); err != nil {
+			log.Printf("%s: backup incomplete: %s", a.Username, err)
+			s.Status, s.Error = "failure", err.Error()
+			summary.Status = "failure"
+		} else if limits := a.Limits(); len(limits) > 0 {
+			log.Printf("%s: backup partial: %s", a.Username, strings.Join(limits, "; "))
+			s.Status, s.Error = "partial", strings.Join(limits, "; ")
+			if summary.Status == "success" {
+				summary.Status = "partial"
+			}
+		}
+		if len(s.Incomplete) > 0 {
+			log.Printf("%s: %d folders not fully backed up: %s", a.Username, len(s.Incomplete), strings.Join(s.Incomplete, ", "))
+		}
+		PostHook(a, &s)
+		summary.Accounts = append(summary.Accounts, s)
+	}
+	if len(accts) > 1 {
+		failed := 0
+		for _, s := range summary.Accounts {
+			if s.Status != "success" {
+				failed++
+			}
+		}
+		log.Printf("backed up %d of %d accounts", len(accts)-failed, len(accts))
+	}
+	RecordMetrics(summary)
+	Notify(summary)
+	SdNotify(fmt.Sprintf("STATUS=Last backup finished at %s: %s", summary.End.Format("2006-01-02 15:04"), summary.Status))
+	return summary
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Commands are invoked as 'backupimap [options] <command> [args]'.
+var commands = map[string]func(args []string) error{
+	"auth":            AuthCommand,
+	"export":          ExportCommand,
+	"import":          ImportCommand,
+	"keyring":         KeyringCommand,
+	"manifest":        ManifestCommand,
+	"merge":           MergeCommand,
+	"prune":           PruneCommand,
+	"rekey":           RekeyCommand,
+	"report":          ReportCommand,
+	"restore":         RestoreCommand,
+	"restore-message": RestoreMessageCommand,
+	"service":         ServiceCommand,
+	"stats":           StatsCommand,
+	"upgrade":         UpgradeCommand,
+}
+
+func RunCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", args[0])
+		os.Exit(1)
+	}
+	if err := cmd(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ParseCommandFlags parses the options of a command, which may be mixed
+// with its arguments, and returns the arguments.
+func ParseCommandFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return rest, nil
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// AuthCommand implements 'auth login <provider>'.
+func AuthCommand(args []string) error {
+	if len(args) != 2 || args[0] != "login" {
+		return fmt.Errorf("usage: auth login gmail|o365")
+	}
+	if *username == "" {
+		return fmt.Errorf("you must specify --user")
+	}
+	switch args[1] {
+	case "gmail":
+		return GmailLogin(*username)
+	case "o365":
+		t, err := O365DeviceFlow()
+		if err != nil {
+			return err
+		}
+		return SaveToken(TokenPath("o365", *username), t)
+	}
+	return fmt.Errorf("unknown provider '%s'", args[1])
+}
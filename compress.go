@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"flag"
+	"hash/crc32"
+	"runtime"
+)
+
+// Parallel compression. On fast links a single goroutine deflating every
+// message cannot keep up with the downloads, so the CPU-heavy part of
+// writing a message, sanitizing, encrypting and deflating it, is done by
+// --compress-workers goroutines. The writer still gets the messages in
+// the order they were received, one at a time, so the entries, the
+// checkpoint journal and the central directory are written as before,
+// and a folder is only complete after all its messages.
+
+var compressWorkers = flag.Int("compress-workers", runtime.NumCPU(), "Number of messages compressed and encrypted at once")
+
+// Prepare passes the messages of in to out in the same order, once
+// prepare was called for each of them, by up to workers at once.
+func Prepare(in <-chan *Message, workers int, prepare func(*Message)) <-chan *Message {
+	out := make(chan *Message, workers)
+	pending := make(chan chan *Message, workers)
+	go func() {
+		sem := make(chan struct{}, workers)
+		for msg := range in {
+			done := make(chan *Message, 1)
+			pending <- done
+			sem <- struct{}{}
+			go func(msg *Message) {
+				prepare(msg)
+				<-sem
+				done <- msg
+			}(msg)
+		}
+		close(pending)
+	}()
+	go func() {
+		for done := range pending {
+			out <- <-done
+		}
+		close(out)
+	}()
+	return out
+}
+
+// PrepareMessage transforms a new message as it is written, and deflates
+// it if deflate is set, for ZipWriter.
+func PrepareMessage(msg *Message, deflate bool) {
+	if msg.Skipped != "" || msg.FlagUpdate || msg.Expunged || msg.Complete {
+		return
+	}
+	msg.fetchedSize = int64(len(msg.Body))
+	if *sanitize || *sanitizeHeaders {
+		msg.Body = Sanitize(msg)
+	}
+	msg.MessageID = MessageID(msg.Body)
+	if len(gpgRecipients) > 0 {
+		var err error
+		if msg.Body, err = Encrypt(msg.Body); err != nil {
+			msg.err = err
+			return
+		}
+	}
+	if deflate {
+		msg.deflated = DeflateBody(msg.Body)
+		msg.crc32 = crc32.ChecksumIEEE(msg.Body)
+	}
+}
+
+// DeflateBody compresses a message at the --compression level.
+func DeflateBody(body []byte) []byte {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, compressionLevels[*compression])
+	fw.Write(body)
+	fw.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Flag synchronization for incremental backups using CONDSTORE (RFC 7162).
+// The HIGHESTMODSEQ of each folder is saved in the account state, the next
+// run asks only for the flags of messages changed since then.
+
+// HasCondStore reports whether the server supports mod-sequences.
+func HasCondStore(c *imap.Client) bool {
+	return c.Caps["CONDSTORE"] || c.Caps["QRESYNC"]
+}
+
+// HighestModSeq returns the HIGHESTMODSEQ of a mailbox, or 0 if the
+// server does not report it. It uses STATUS, so it must be called before
+// the mailbox is selected.
+func HighestModSeq(c *imap.Client, mbox string) uint64 {
+	return StatusValues(c, mbox, "HIGHESTMODSEQ")["HIGHESTMODSEQ"]
+}
+
+// StatusValues returns the numeric STATUS items of a mailbox. Items the
+// server did not return are missing from the map.
+func StatusValues(c *imap.Client, mbox string, items ...string) map[string]uint64 {
+	values := make(map[string]uint64)
+	cmd, err := Result(c.Status(mbox, items...))
+	if err != nil {
+		return values
+	}
+	for _, resp := range cmd.Data {
+		if resp.Label != "STATUS" || len(resp.Fields) < 3 {
+			continue
+		}
+		attrs := imap.AsList(resp.Fields[2])
+		for i := 0; i+1 < len(attrs); i += 2 {
+			// Mod-sequences and sizes can exceed 32 bits, don't
+			// rely on the parser's uint32 numbers.
+			n, err := strconv.ParseUint(fmt.Sprint(attrs[i+1]), 10, 64)
+			if err == nil {
+				values[strings.ToUpper(imap.AsAtom(attrs[i]))] = n
+			}
+		}
+	}
+	return values
+}
+
+// FlagList converts a flag set into a sorted list.
+func FlagList(flags imap.FlagSet) []string {
+	list := make([]string, 0, len(flags))
+	for f, set := range flags {
+		if set {
+			list = append(list, f)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// FetchFlagChanges sends flag updates for the messages of a previous
+// backup whose flags changed since its HIGHESTMODSEQ. The mailbox must
+// be selected. It returns false if the changes could not be fetched.
+func (a *Account) FetchFlagChanges(c *imap.Client, name string, fs *FolderState) bool {
+	set, _ := imap.NewSeqSet("")
+	set.AddRange(1, fs.LastUID)
+	changedSince := []imap.Field{"CHANGEDSINCE", strconv.FormatUint(fs.HighestModSeq, 10)}
+	items := []imap.Field{"FLAGS"}
+	if c.Caps["X-GM-EXT-1"] {
+		items = append(items, "X-GM-LABELS")
+	}
+	cmd, err := c.Send("UID FETCH", set, items, changedSince)
+	if err != nil {
+		atomic.AddInt64(&a.Stats.Errors, 1)
+		log.Printf("%s: could not fetch flag changes of %s: %s", a.Username, name, err)
+		return false
+	}
+
+	n := 0
+	for cmd.InProgress() {
+		if err := c.Recv(RecvTimeout()); err == imap.ErrTimeout {
+			log.Printf("%s: %s - no data received for %s, closing the connection", a.Username, name, *messageTimeout)
+			c.Logout(0)
+			break
+		}
+		for _, resp := range cmd.Data {
+			info := resp.MessageInfo()
+			a.msgCh <- &Message{
+				Folder:      name,
+				UID:         info.UID,
+				UIDValidity: fs.UIDValidity,
+				Flags:       FlagList(info.Flags),
+				Labels:      GmailLabels(info),
+				FlagUpdate:  true,
+			}
+			n++
+		}
+		cmd.Data = nil
+		c.Data = nil
+	}
+	if _, err := cmd.Result(imap.OK); err != nil {
+		atomic.AddInt64(&a.Stats.Errors, 1)
+		log.Printf("%s: could not fetch flag changes of %s: %s", a.Username, name, err)
+		return false
+	}
+	if n > 0 {
+		log.Printf("%s: %s - %d flag changes", a.Username, name, n)
+	}
+	return true
+}
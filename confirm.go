@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// When run from a terminal, backupimap first lists the accounts, prints
+// what it is about to download and asks before starting, so that a big
+// backup is not started by accident, e.g. over a metered connection.
+// --yes skips the question, and it is never asked in daemon mode.
+
+var assumeYes = flag.Bool("yes", false, "Start the backup without asking for confirmation in a terminal")
+
+// confirmRun is set when the backup should be confirmed.
+var confirmRun bool
+
+// Interactive reports whether backupimap runs in a terminal.
+func Interactive() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Estimate lists the mailboxes of each account, as the backup will, and
+// prints what it would download.
+func Estimate(accts []*Account) {
+	fmt.Fprintf(os.Stderr, "\n%-30s %8s %10s %10s  %s\n", "Account", "Folders", "Messages", "Size", "Destination")
+	for _, a := range accts {
+		a.Acquire()
+		c, err := a.Connect()
+		if err != nil {
+			a.Release()
+			log.Printf("%s: %s", a.Username, err)
+			continue
+		}
+		cmd, err := ListAll(c)
+		if err == nil {
+			queue := a.ScheduleMailboxes(c, cmd.Data)
+			if *prefetchHeaders {
+				a.Prefetch(c, queue)
+			}
+		}
+		Close(c)
+		a.Release()
+		if err != nil {
+			log.Printf("%s: could not list folders: %s", a.Username, err)
+			continue
+		}
+		messages, size := a.Stats.ExpectedMessages, "unknown"
+		if a.Stats.ExpectedBytes > 0 {
+			size = FormatSize(a.Stats.ExpectedBytes)
+		}
+		if *prefetchHeaders {
+			messages, size = a.Stats.PlannedMessages, FormatSize(a.Stats.PlannedBytes)
+		}
+		fmt.Fprintf(os.Stderr, "%-30s %8d %10d %10s  %s\n", a.Username, len(a.expected), messages, size, a.Destination())
+	}
+	if *incremental && !*prefetchHeaders {
+		fmt.Fprintf(os.Stderr, "\nIncremental backups only download the messages added since the last run.\n")
+	}
+}
+
+// Confirm asks a yes or no question on the terminal.
+func Confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
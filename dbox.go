@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Dovecot sdbox output. Each message is a dbox file named after its UID in
+// mailboxes/<folder>/dbox-Mails, so the tree can be copied into a Dovecot
+// mail location and indexed with "doveadm force-resync -u <user> '*'".
+// The dbox files do not hold flags, those are only in the manifest.
+
+const (
+	dboxVersion    = 2
+	dboxMsgHdrSize = 0x1e
+	dboxMagicPre   = "\x01\x02"
+	dboxMagicPost  = "\n\x01\x03\n"
+)
+
+type DboxWriter struct {
+	Manifest *Manifest
+
+	dir string
+}
+
+func NewDboxWriter(dir string, m *Manifest) (*DboxWriter, error) {
+	dir = LongPath(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "mailboxes"), 0700); err != nil {
+		return nil, err
+	}
+	return &DboxWriter{Manifest: m, dir: dir}, nil
+}
+
+// DboxReplaceBody returns a dbox file with the message of data replaced
+// by body.
+func DboxReplaceBody(data, body []byte) ([]byte, error) {
+	old, err := DboxBody(data)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(data, '\n')
+	meta := data[i+1+dboxMsgHdrSize+len(old):]
+	if !bytes.HasPrefix(meta, []byte(dboxMagicPost)) {
+		return nil, errors.New("corrupt dbox file")
+	}
+	out := fmt.Appendf(slices.Clone(data[:i+1]), "%sN%10s%016X\n", dboxMagicPre, "", len(body))
+	out = append(out, body...)
+	out = append(out, dboxMagicPost...)
+	for _, line := range bytes.SplitAfter(meta[len(dboxMagicPost):], []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("Z")) {
+			line = fmt.Appendf(nil, "Z%x\n", len(body))
+		}
+		out = append(out, line...)
+	}
+	return out, nil
+}
+
+// DboxName returns the path of a message relative to the sdbox root.
+func DboxName(folder string, uid uint32) string {
+	return path.Join("mailboxes", folder, "dbox-Mails", fmt.Sprintf("u.%d", uid))
+}
+
+// Add writes the message as a single-message dbox file. The Maildir name
+// is not used, sdbox files must be named after the UID.
+func (w *DboxWriter) Add(name string, msg *Message) error {
+	name = DboxName(msg.Folder, msg.UID)
+	file, err := LocalPath(w.dir, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	var guid [16]byte
+	rand.Read(guid[:])
+	now := time.Now().Unix()
+	received := now
+	if !msg.InternalDate.IsZero() {
+		received = msg.InternalDate.Unix()
+	}
+
+	// File header, then the message header with the body size and the
+	// body itself, followed by the metadata block.
+	data := fmt.Appendf(nil, "%d M%x C%x\n", dboxVersion, dboxMsgHdrSize, now)
+	data = fmt.Appendf(data, "%sN%10s%016X\n", dboxMagicPre, "", len(msg.Body))
+	data = append(data, msg.Body...)
+	data = append(data, dboxMagicPost...)
+	data = fmt.Appendf(data, "G%s\nR%x\nZ%x\nB%s\n\n", hex.EncodeToString(guid[:]), received, len(msg.Body), msg.Folder)
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+	w.Manifest.Add(&CheckpointRecord{
+		Name:         name,
+		Folder:       msg.Folder,
+		UID:          msg.UID,
+		UIDValidity:  msg.UIDValidity,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		RFC822Size:   msg.Size,
+		ThreadID:     msg.ThreadID,
+		MessageID:    msg.MessageID,
+	})
+	return nil
+}
+
+func (w *DboxWriter) UpdateFlags(msg *Message) error {
+	w.Manifest.Add(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Flags:       msg.Flags,
+		FlagUpdate:  true,
+	})
+	return nil
+}
+
+func (w *DboxWriter) Expunge(msg *Message) error {
+	r := &CheckpointRecord{
+		Name:        DboxName(msg.Folder, msg.UID),
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Expunged:    true,
+	}
+	if *mirror {
+		file, err := LocalPath(w.dir, r.Name)
+		if err == nil {
+			err = os.Remove(file)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.Manifest.Add(r)
+	return nil
+}
+
+func (w *DboxWriter) Complete(msg *Message) error {
+	w.Manifest.Add(&CheckpointRecord{Folder: msg.Folder, Complete: true, Metadata: msg.Metadata})
+	return nil
+}
+
+func (w *DboxWriter) Close(complete bool) error {
+	data, err := w.Manifest.Marshal()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("manifest-%s.json", w.Manifest.Created.UTC().Format("20060102T150405Z"))
+	return os.WriteFile(filepath.Join(w.dir, name), data, 0600)
+}
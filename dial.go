@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Dialing IMAP servers. IPv4 and IPv6 addresses are raced (Happy
+// Eyeballs, RFC 6555), so a broken address family only costs the
+// fallback delay instead of a connect timeout per address.
+
+var (
+	sourceIP       = flag.String("source-ip", "", "Local address to connect from, on multi-homed hosts")
+	ipFamily       = flag.String("ip", "any", "Address family to connect with: any, 4 or 6")
+	connectTimeout = flag.Duration("connect-timeout", 30*time.Second, "Timeout for connecting to the server")
+)
+
+// Dialer returns the dialer for connections to server and the network
+// to use with it.
+func Dialer() (*net.Dialer, string, error) {
+	d := &net.Dialer{
+		Timeout:       *connectTimeout,
+		FallbackDelay: 300 * time.Millisecond,
+		KeepAlive:     time.Minute,
+	}
+	network := "tcp"
+	switch *ipFamily {
+	case "4", "6":
+		network += *ipFamily
+	case "any":
+	default:
+		return nil, "", fmt.Errorf("unknown address family '%s'", *ipFamily)
+	}
+	if *sourceIP != "" {
+		ip := net.ParseIP(*sourceIP)
+		if ip == nil {
+			return nil, "", fmt.Errorf("invalid source address '%s'", *sourceIP)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+		// Only addresses of the source's family can be reached.
+		if ip.To4() != nil {
+			network = "tcp4"
+		} else {
+			network = "tcp6"
+		}
+	}
+	return d, network, nil
+}
+
+// DialIMAP connects to addr, with TLS if implicit is set.
+func DialIMAP(addr string, implicit bool) (*imap.Client, error) {
+	d, network, err := Dialer()
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if implicit {
+		tc := tls.Client(conn, TLSConfig(host))
+		tc.SetDeadline(time.Now().Add(*connectTimeout))
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+	if *strictReadonly {
+		conn = AuditConn(conn, addr)
+	}
+	c, err := imap.NewClient(conn, host, *connectTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// TLSConfig returns the TLS configuration for a server. Certificates are
+// verified by the system: on Windows that is the certificate store, with
+// the roots and intermediates installed by group policy or the
+// administrator, as for other Windows programs.
+func TLSConfig(host string) *tls.Config {
+	return &tls.Config{ServerName: host}
+}
+
+// Local connections: a server of the form unix:/path connects to a UNIX
+// socket, exec:command runs a command speaking IMAP on its standard input
+// and output, e.g. "exec:ssh mail dovecot --exec-mail imap". Neither uses
+// TLS. If the server greets with PREAUTH, no login is needed.
+
+// IsLocal reports whether a server address is a socket or a command.
+func IsLocal(server string) bool {
+	return strings.HasPrefix(server, "unix:") || strings.HasPrefix(server, "exec:")
+}
+
+func DialLocal(server string) (*imap.Client, error) {
+	var conn net.Conn
+	if path, ok := strings.CutPrefix(server, "unix:"); ok {
+		var err error
+		if conn, err = net.DialTimeout("unix", path, *connectTimeout); err != nil {
+			return nil, err
+		}
+	} else {
+		args := strings.Fields(strings.TrimPrefix(server, "exec:"))
+		if len(args) == 0 {
+			return nil, errors.New("exec: missing command")
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		conn = &cmdConn{cmd: cmd, Reader: stdout, stdin: stdin}
+	}
+	if *strictReadonly {
+		conn = AuditConn(conn, server)
+	}
+	c, err := imap.NewClient(conn, "localhost", *connectTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmdConn is a connection to a command's standard input and output.
+type cmdConn struct {
+	cmd *exec.Cmd
+	io.Reader
+	stdin io.WriteCloser
+}
+
+func (c *cmdConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close ends the command's input and waits for it to exit.
+func (c *cmdConn) Close() error {
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+type cmdAddr string
+
+func (a cmdAddr) Network() string { return "exec" }
+func (a cmdAddr) String() string  { return string(a) }
+
+func (c *cmdConn) LocalAddr() net.Addr  { return cmdAddr("local") }
+func (c *cmdConn) RemoteAddr() net.Addr { return cmdAddr(c.cmd.Path) }
+
+// Pipes have no deadlines, timeouts are not enforced.
+func (c *cmdConn) SetDeadline(t time.Time) error      { return nil }
+func (c *cmdConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *cmdConn) SetWriteDeadline(t time.Time) error { return nil }
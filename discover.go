@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Autodiscovery of the IMAP server from the email address, using RFC 6186
+// SRV records and Mozilla (Thunderbird) autoconfig files.
+
+// ServerConfig is the result of autodiscovery. TLS is a --tls mode.
+type ServerConfig struct {
+	Addr string
+	TLS  string
+}
+
+// Discover looks up the IMAP server for the given email address.
+func Discover(email string) (*ServerConfig, error) {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return nil, errors.New("username is not an email address")
+	}
+	domain := email[i+1:]
+
+	if cfg := discoverSRV(domain); cfg != nil {
+		return cfg, nil
+	}
+	for _, u := range []string{
+		"https://autoconfig." + domain + "/mail/config-v1.1.xml?emailaddress=" + url.QueryEscape(email),
+		"https://" + domain + "/.well-known/autoconfig/mail/config-v1.1.xml",
+		"https://autoconfig.thunderbird.net/v1.1/" + domain,
+	} {
+		if cfg := discoverAutoconfig(u); cfg != nil {
+			return cfg, nil
+		}
+	}
+	return nil, fmt.Errorf("no IMAP server found for %s", domain)
+}
+
+func discoverSRV(domain string) *ServerConfig {
+	for _, service := range []string{"imaps", "imap"} {
+		_, addrs, err := net.LookupSRV(service, "tcp", domain)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		// A target of "." means the service is explicitly not provided.
+		target := strings.TrimSuffix(addrs[0].Target, ".")
+		if target == "" {
+			continue
+		}
+		cfg := &ServerConfig{
+			Addr: net.JoinHostPort(target, strconv.Itoa(int(addrs[0].Port))),
+			TLS:  "starttls",
+		}
+		if service == "imaps" {
+			cfg.TLS = "implicit"
+		}
+		return cfg
+	}
+	return nil
+}
+
+type autoconfig struct {
+	Servers []struct {
+		Type       string `xml:"type,attr"`
+		Hostname   string `xml:"hostname"`
+		Port       int    `xml:"port"`
+		SocketType string `xml:"socketType"`
+	} `xml:"emailProvider>incomingServer"`
+}
+
+func discoverAutoconfig(u string) *ServerConfig {
+	client := http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var ac autoconfig
+	if err := xml.NewDecoder(resp.Body).Decode(&ac); err != nil {
+		return nil
+	}
+	for _, s := range ac.Servers {
+		if s.Type != "imap" || s.Hostname == "" {
+			continue
+		}
+		cfg := &ServerConfig{Addr: s.Hostname, TLS: "none"}
+		switch s.SocketType {
+		case "SSL":
+			cfg.TLS = "implicit"
+		case "STARTTLS":
+			cfg.TLS = "starttls"
+		}
+		if s.Port != 0 {
+			cfg.Addr = net.JoinHostPort(s.Hostname, strconv.Itoa(s.Port))
+		}
+		return cfg
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procGetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleMode")
+	procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+)
+
+const enableEchoInput = 0x4
+
+// SetEcho turns the echo of the console on standard input on or off.
+func SetEcho(on bool) error {
+	var mode uint32
+	h := os.Stdin.Fd()
+	if r, _, err := procGetConsoleMode.Call(h, uintptr(unsafe.Pointer(&mode))); r == 0 {
+		return err
+	}
+	if on {
+		mode |= enableEchoInput
+	} else {
+		mode &^= enableEchoInput
+	}
+	if r, _, err := procSetConsoleMode.Call(h, uintptr(mode)); r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// EML output: each message is stored as <folder>/<uidvalidity>.<uid>.eml
+// and every folder has an index.csv listing its messages, the layout
+// e-discovery and Outlook import tools expect. Incremental runs append to
+// the index. A folder recreated with a new UIDVALIDITY thus does not
+// overwrite the messages of the old one.
+
+type EmlWriter struct {
+	Manifest *Manifest
+
+	dir   string
+	index map[string][][]string
+}
+
+func NewEmlWriter(dir string, m *Manifest) (*EmlWriter, error) {
+	dir = LongPath(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &EmlWriter{Manifest: m, dir: dir, index: make(map[string][][]string)}, nil
+}
+
+// EmlName returns the path of a message relative to the output directory.
+func EmlName(folder string, uidValidity, uid uint32) string {
+	return path.Join(folder, fmt.Sprintf("%d.%d.eml", uidValidity, uid))
+}
+
+func (w *EmlWriter) Add(name string, msg *Message) error {
+	name = EmlName(msg.Folder, msg.UIDValidity, msg.UID)
+	file, err := LocalPath(w.dir, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file+".tmp", msg.Body, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	w.index[msg.Folder] = append(w.index[msg.Folder], IndexRow(msg, path.Base(name)))
+	w.Manifest.Add(&CheckpointRecord{
+		Name:         name,
+		Folder:       msg.Folder,
+		UID:          msg.UID,
+		UIDValidity:  msg.UIDValidity,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		RFC822Size:   msg.Size,
+		ThreadID:     msg.ThreadID,
+		MessageID:    msg.MessageID,
+	})
+	return nil
+}
+
+var emlIndexHeader = []string{"uid", "file", "date", "from", "subject", "flags"}
+
+// IndexRow returns the index line of a message.
+func IndexRow(msg *Message, file string) []string {
+	var date, from, subject string
+	if m, err := mail.ReadMessage(bytes.NewReader(msg.Body)); err == nil {
+		date = m.Header.Get("Date")
+		from = DecodedHeader(m.Header, "From")
+		subject = DecodedHeader(m.Header, "Subject")
+	}
+	return []string{fmt.Sprint(msg.UID), file, date, from, subject, strings.Join(msg.Flags, " ")}
+}
+
+// DecodedHeader returns a header field with its MIME encoded-words
+// decoded, or as it is if they cannot be.
+func DecodedHeader(h mail.Header, name string) string {
+	value, err := new(mime.WordDecoder).DecodeHeader(h.Get(name))
+	if err != nil {
+		return h.Get(name)
+	}
+	return value
+}
+
+func (w *EmlWriter) UpdateFlags(msg *Message) error {
+	w.Manifest.Add(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Flags:       msg.Flags,
+		FlagUpdate:  true,
+	})
+	return nil
+}
+
+func (w *EmlWriter) Expunge(msg *Message) error {
+	r := &CheckpointRecord{
+		Name:        EmlName(msg.Folder, msg.UIDValidity, msg.UID),
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Expunged:    true,
+	}
+	if *mirror {
+		file, err := LocalPath(w.dir, r.Name)
+		if err == nil {
+			err = os.Remove(file)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.Manifest.Add(r)
+	return nil
+}
+
+func (w *EmlWriter) Complete(msg *Message) error {
+	w.Manifest.Add(&CheckpointRecord{Folder: msg.Folder, Complete: true, Metadata: msg.Metadata})
+	return nil
+}
+
+// Close appends the new messages to the folder indexes and writes the
+// manifest.
+func (w *EmlWriter) Close(complete bool) error {
+	for folder, rows := range w.index {
+		if err := w.appendIndex(folder, rows); err != nil {
+			return err
+		}
+	}
+	data, err := w.Manifest.Marshal()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("manifest-%s.json", w.Manifest.Created.UTC().Format("20060102T150405Z"))
+	return os.WriteFile(filepath.Join(w.dir, name), data, 0600)
+}
+
+func (w *EmlWriter) appendIndex(folder string, rows [][]string) error {
+	file, err := LocalPath(w.dir, path.Join(folder, "index.csv"))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(file)
+	exists := err == nil
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	if !exists {
+		cw.Write(emlIndexHeader)
+	}
+	cw.WriteAll(rows)
+	if err := cw.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
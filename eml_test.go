@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A folder recreated with a new UIDVALIDITY reuses UIDs, the messages of
+// the old one are kept.
+func TestEmlUIDValidity(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewEmlWriter(dir, &Manifest{Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uidValidity := range []uint32{10, 11} {
+		msg := &Message{Folder: "INBOX", UID: 1, UIDValidity: uidValidity, Body: []byte("Subject: a\r\n\r\nbody\r\n")}
+		if err := w.Add("", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"10.1.eml", "11.1.eml", "index.csv"} {
+		if _, err := os.Stat(filepath.Join(dir, "INBOX", name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ExportCommand implements 'export <backup>... -o <dir>', which writes
+// the messages present at the end of the backups in the EML layout: one
+// directory per folder with a .eml file per message and an index.csv.
+// Outlook cannot read ZIP archives or Maildirs, but it imports .eml files
+// dragged from Explorer into one of its folders; the folder names are
+// made valid on Windows. Writing PST files is not supported.
+func ExportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("o", "", "Directory to write")
+	format := fs.String("format", "eml", "Export format, only eml is supported")
+	files, err := ParseCommandFlags(fs, args)
+	if err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(files) == 0 || *out == "" {
+		return errors.New("usage: export <backup>... -o <dir>")
+	}
+	if *format != "eml" {
+		return fmt.Errorf("cannot export to %s: PST files cannot be written, use --format=eml and import the .eml files into Outlook", *format)
+	}
+	var sources []*Source
+	for _, path := range files {
+		src, err := OpenSource(path, time.Time{})
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		sources = append(sources, src)
+	}
+
+	w, err := NewEmlWriter(*out, &Manifest{Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	// Messages are numbered again, UIDs of different backups or of an
+	// old UIDVALIDITY could collide.
+	uids := make(map[string]uint32)
+	for _, e := range CollectMessages(sources) {
+		body, err := e.src.Read(e.ManifestMessage)
+		if err != nil {
+			return err
+		}
+		folder := WindowsFolder(e.Folder)
+		uids[folder]++
+		msg := &Message{Folder: folder, UID: uids[folder], UIDValidity: e.UIDValidity, Flags: e.Flags, Body: body,
+			InternalDate: e.InternalDate, Size: e.RFC822Size, ThreadID: e.ThreadID, MessageID: MessageID(body)}
+		if err := w.Add("", msg); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(true); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(*out, "README.txt"), []byte(outlookHelp), 0600); err != nil {
+		return err
+	}
+	log.Printf("exported %d messages to %s", len(w.Manifest.Messages), *out)
+	return nil
+}
+
+const outlookHelp = `Importing into Outlook
+----------------------
+
+Every folder of the backup is a directory. To import one, create the
+folder in Outlook, open the directory in Explorer, select all .eml files
+and drag them onto the folder. index.csv lists the date, sender, subject
+and flags of each message.
+`
+
+// reservedNames are the device names Windows does not allow as file
+// names, with any extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// WindowsFolder replaces the characters Windows does not allow in file
+// names, and trailing dots and spaces, in each part of a folder name.
+// Reserved device names get an underscore.
+func WindowsFolder(folder string) string {
+	parts := strings.Split(folder, "/")
+	for i, p := range parts {
+		p = strings.Map(func(r rune) rune {
+			if r < 32 || strings.ContainsRune(`<>:"\|?*`, r) {
+				return '_'
+			}
+			return r
+		}, p)
+		if t := strings.TrimRight(p, ". "); t != p {
+			p = t + "_"
+		}
+		if base, _, _ := strings.Cut(p, "."); reservedNames[strings.ToUpper(base)] {
+			p = "_" + p
+		}
+		parts[i] = p
+	}
+	return strings.Join(parts, "/")
+}
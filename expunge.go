@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// DetectExpunged sends tombstones for the messages of previous backups
+// that are no longer on the server. The mailbox must be selected.
+func (a *Account) DetectExpunged(c *imap.Client, name string, fs *FolderState) {
+	known := ParseUIDs(fs.UIDs)
+	if len(known) == 0 {
+		return
+	}
+
+	set, _ := imap.NewSeqSet("")
+	set.AddRange(1, fs.LastUID)
+	cmd, err := Result(c.UIDSearch("UID", set))
+	if err != nil {
+		atomic.AddInt64(&a.Stats.Errors, 1)
+		log.Printf("%s: could not check %s for deleted messages: %s", a.Username, name, err)
+		return
+	}
+	present := make(map[uint32]bool)
+	for _, resp := range cmd.Data {
+		for _, uid := range resp.SearchResults() {
+			present[uid] = true
+		}
+	}
+
+	n := 0
+	for _, uid := range known {
+		if !present[uid] {
+			a.msgCh <- &Message{Folder: name, UID: uid, UIDValidity: fs.UIDValidity, Expunged: true}
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("%s: %s - %d messages deleted on the server", a.Username, name, n)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Flag change journal: with --flag-journal every run appends the flags of
+// the messages it backed up, and the flags they gained or lost since, to
+// <user>.flags.jsonl in the state directory. Backups keep only the last
+// flags of a message, the journal tells when it was read, answered or
+// flagged. Replaying the journal gives the flags known last.
+
+var flagJournal = flag.Bool("flag-journal", false, "Record the flag changes of each run in a journal in --statedir")
+
+// FlagEvent is a line of the journal. New messages list their flags in
+// Flags, changed ones the flags Added and Removed.
+type FlagEvent struct {
+	Time        time.Time `json:"time"`
+	Folder      string    `json:"folder"`
+	UIDValidity uint32    `json:"uidvalidity"`
+	UID         uint32    `json:"uid"`
+	Flags       []string  `json:"flags,omitempty"`
+	Added       []string  `json:"added,omitempty"`
+	Removed     []string  `json:"removed,omitempty"`
+	Expunged    bool      `json:"expunged,omitempty"`
+}
+
+type FlagJournal struct {
+	path   string
+	flags  map[string][]string
+	events []*FlagEvent
+}
+
+func FlagJournalPath(user string) string {
+	return StatePath(strings.Replace(user, "/", "_", -1) + ".flags.jsonl")
+}
+
+// OpenFlagJournal replays the journal of an account.
+func OpenFlagJournal(user string) (*FlagJournal, error) {
+	j := &FlagJournal{path: FlagJournalPath(user), flags: make(map[string][]string)}
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e FlagEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// An interrupted write.
+			continue
+		}
+		j.apply(&e)
+	}
+	return j, scanner.Err()
+}
+
+func (j *FlagJournal) apply(e *FlagEvent) {
+	key := messageKey(e.Folder, e.UIDValidity, e.UID)
+	switch {
+	case e.Expunged:
+		delete(j.flags, key)
+	case e.Added == nil && e.Removed == nil:
+		j.flags[key] = e.Flags
+	default:
+		flags := slices.DeleteFunc(slices.Clone(j.flags[key]), func(f string) bool {
+			return slices.Contains(e.Removed, f)
+		})
+		j.flags[key] = append(flags, e.Added...)
+	}
+}
+
+// Record notes a message written by the run. Flag updates that do not
+// change the known flags are not recorded.
+func (j *FlagJournal) Record(msg *Message, t time.Time) {
+	e := &FlagEvent{Time: t, Folder: msg.Folder, UIDValidity: msg.UIDValidity, UID: msg.UID}
+	key := messageKey(msg.Folder, msg.UIDValidity, msg.UID)
+	old, known := j.flags[key]
+	switch {
+	case msg.Expunged:
+		if !known {
+			return
+		}
+		e.Expunged = true
+	case msg.FlagUpdate && known:
+		for _, f := range msg.Flags {
+			if !slices.Contains(old, f) {
+				e.Added = append(e.Added, f)
+			}
+		}
+		for _, f := range old {
+			if !slices.Contains(msg.Flags, f) {
+				e.Removed = append(e.Removed, f)
+			}
+		}
+		if e.Added == nil && e.Removed == nil {
+			return
+		}
+	default:
+		e.Flags = msg.Flags
+	}
+	j.apply(e)
+	j.events = append(j.events, e)
+}
+
+// Save appends the recorded events to the journal.
+func (j *FlagJournal) Save() error {
+	if len(j.events) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range j.events {
+		data, _ := json.Marshal(e)
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	j.events = nil
+	return err
+}
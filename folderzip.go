@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Per-folder output: each mailbox gets its own ZIP archive in the output
+// directory, e.g. INBOX.zip and Archive/2020.zip, with its own manifest
+// and checkpoint. An archive is finished as soon as its folder is
+// complete, but its checkpoint is kept until the whole run succeeds, so
+// --resume knows which folders are done.
+
+var perFolder = flag.Bool("per-folder-output", false, "Write a separate ZIP archive for each folder into the output directory")
+
+type FolderZipWriter struct {
+	Manifest *Manifest
+
+	dir      string
+	records  map[string][]*CheckpointRecord
+	open     map[string]*ZipWriter
+	finished []string
+}
+
+func NewFolderZipWriter(dir string, m *Manifest, checkpoint []*CheckpointRecord) (*FolderZipWriter, error) {
+	dir = LongPath(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	w := &FolderZipWriter{
+		Manifest: m,
+		dir:      dir,
+		records:  make(map[string][]*CheckpointRecord),
+		open:     make(map[string]*ZipWriter),
+	}
+	for _, r := range checkpoint {
+		w.records[r.Folder] = append(w.records[r.Folder], r)
+	}
+	return w, nil
+}
+
+// FolderArchive returns the archive of a folder in a per-folder output.
+func FolderArchive(dir, folder string) string {
+	return filepath.Join(dir, filepath.FromSlash(folder)+".zip")
+}
+
+// LoadFolderCheckpoints reads the checkpoints of all folder archives.
+func LoadFolderCheckpoints(dir string) ([]*CheckpointRecord, error) {
+	var records []*CheckpointRecord
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !strings.HasSuffix(path, ".zip") {
+			return err
+		}
+		r, err := LoadCheckpoint(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		records = append(records, r...)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return records, err
+}
+
+// folder returns the open archive of a folder, resuming it if the
+// interrupted run had started it.
+func (w *FolderZipWriter) folder(name string) (*ZipWriter, error) {
+	if zw := w.open[name]; zw != nil {
+		return zw, nil
+	}
+	path := FolderArchive(w.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	m := &Manifest{Account: w.Manifest.Account, Created: w.Manifest.Created, Incremental: w.Manifest.Incremental,
+		HeadersOnly: w.Manifest.HeadersOnly, EncryptedTo: w.Manifest.EncryptedTo}
+	var zw *ZipWriter
+	var err error
+	if records := w.records[name]; records != nil {
+		zw, err = ResumeZipWriter(path, m, records)
+	} else {
+		zw, err = NewZipWriter(path, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.open[name] = zw
+	return zw, nil
+}
+
+func (w *FolderZipWriter) Add(name string, msg *Message) error {
+	zw, err := w.folder(msg.Folder)
+	if err != nil {
+		return err
+	}
+	return zw.Add(name, msg)
+}
+
+func (w *FolderZipWriter) UpdateFlags(msg *Message) error {
+	zw, err := w.folder(msg.Folder)
+	if err != nil {
+		return err
+	}
+	return zw.UpdateFlags(msg)
+}
+
+func (w *FolderZipWriter) Expunge(msg *Message) error {
+	zw, err := w.folder(msg.Folder)
+	if err != nil {
+		return err
+	}
+	return zw.Expunge(msg)
+}
+
+// Complete finishes the folder's archive, keeping its checkpoint.
+func (w *FolderZipWriter) Complete(msg *Message) error {
+	zw, err := w.folder(msg.Folder)
+	if err != nil {
+		return err
+	}
+	if err := zw.Complete(msg); err != nil {
+		return err
+	}
+	delete(w.open, msg.Folder)
+	w.finished = append(w.finished, FolderArchive(w.dir, msg.Folder))
+	return zw.Close(false)
+}
+
+func (w *FolderZipWriter) Close(complete bool) error {
+	var err error
+	for _, zw := range w.open {
+		if cerr := zw.Close(false); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil && complete {
+		for _, path := range w.finished {
+			os.Remove(CheckpointPath(path))
+		}
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Gmail authentication using an installed-application OAuth2 client.
+// Google does not allow sharing client credentials, so users need to
+// create their own in the Google Cloud console.
+
+var (
+	gmailClientID     = flag.String("gmail-client-id", "", "Google OAuth client ID for --auth=gmail")
+	gmailClientSecret = flag.String("gmail-client-secret", "", "Google OAuth client secret for --auth=gmail")
+)
+
+const (
+	gmailAuthURL  = "https://accounts.google.com/o/oauth2/v2/auth"
+	gmailTokenURL = "https://oauth2.googleapis.com/token"
+	gmailScope    = "https://mail.google.com/"
+)
+
+func gmailForm() url.Values {
+	return url.Values{"client_id": {*gmailClientID}, "client_secret": {*gmailClientSecret}}
+}
+
+// GmailToken returns a valid access token from the cache created by
+// 'auth login gmail', refreshing it if it has expired.
+func GmailToken(user string) (string, error) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+
+	path := TokenPath("gmail", user)
+	t, err := LoadToken(path)
+	if err != nil {
+		return "", fmt.Errorf("no Gmail token for %s, run '%s --user %s auth login gmail' first", user, os.Args[0], user)
+	}
+	if t.Valid() {
+		return t.AccessToken, nil
+	}
+	if t, err = RefreshToken(gmailTokenURL, gmailForm(), t); err != nil {
+		return "", fmt.Errorf("could not refresh Gmail token: %s", err)
+	}
+	CacheToken(path, t)
+	return t.AccessToken, nil
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// GmailLogin runs the authorization code flow with PKCE, receiving the
+// code on a local redirect listener, and caches the resulting token.
+func GmailLogin(user string) error {
+	if *gmailClientID == "" || *gmailClientSecret == "" {
+		return errors.New("you must specify --gmail-client-id and --gmail-client-secret")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	redirect := fmt.Sprintf("http://%s/", l.Addr())
+
+	verifier := randomString(32)
+	challenge := sha256.Sum256([]byte(verifier))
+	state := randomString(16)
+	authURL := gmailAuthURL + "?" + url.Values{
+		"client_id":             {*gmailClientID},
+		"redirect_uri":          {redirect},
+		"response_type":         {"code"},
+		"scope":                 {gmailScope},
+		"access_type":           {"offline"},
+		"prompt":                {"consent"},
+		"login_hint":            {user},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+	fmt.Fprintf(os.Stderr, "Open the following URL in your browser to authorize access:\n\n%s\n\n", authURL)
+
+	codeCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("state") != state:
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		case q.Get("error") != "":
+			errCh <- errors.New(q.Get("error"))
+			fmt.Fprintln(w, "Authorization failed, you can close this window.")
+		default:
+			codeCh <- q.Get("code")
+			fmt.Fprintln(w, "Authorization complete, you can close this window.")
+		}
+	}))
+
+	var code string
+	select {
+	case code = <-codeCh:
+	case err := <-errCh:
+		return err
+	}
+
+	form := gmailForm()
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirect)
+	form.Set("code_verifier", verifier)
+	var r tokenResponse
+	if err := PostForm(gmailTokenURL, form, &r); err != nil {
+		return err
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	if err := SaveToken(TokenPath("gmail", user), r.Token(nil)); err != nil {
+		return err
+	}
+	log.Printf("Gmail token for %s saved", user)
+	return nil
+}
@@ -0,0 +1,5 @@
+module backupimap
+
+go 1.22
+
+require github.com/mxk/go-imap v0.0.0-20150429134902-531c36c3f12d
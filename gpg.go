@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Per-message encryption with --gpg-recipient: each body is encrypted on
+// its own with gpg, while names and the manifest stay readable. Encrypted
+// bodies differ on every run, so a --repo no longer deduplicates them.
+
+var (
+	gpgRecipients stringsFlag
+	gpgBinary     = flag.String("gpg", "gpg", "GnuPG binary used by --gpg-recipient")
+)
+
+// Decrypt decrypts a message body encrypted by Encrypt, with a secret key
+// from the gpg keyring.
+func Decrypt(body []byte) ([]byte, error) {
+	cmd := exec.Command(*gpgBinary, "--batch", "--quiet", "--decrypt")
+	cmd.Stdin = bytes.NewReader(body)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("gpg: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Plaintext returns a message body, decrypted if it is encrypted.
+func Plaintext(body []byte) ([]byte, error) {
+	if !IsEncrypted(body) {
+		return body, nil
+	}
+	return Decrypt(body)
+}
+
+// IsEncrypted reports whether a body is an OpenPGP message encrypted to
+// a key or a passphrase, rather than mail.
+func IsEncrypted(body []byte) bool {
+	if len(body) == 0 || body[0]&0x80 == 0 {
+		return false
+	}
+	tag := body[0] & 0x3f
+	if body[0]&0x40 == 0 {
+		// Old format packet header.
+		tag = (body[0] >> 2) & 0x0f
+	}
+	return tag == 1 || tag == 3
+}
+
+// Encrypt encrypts a message body to the --gpg-recipient keys.
+func Encrypt(body []byte) ([]byte, error) {
+	args := []string{"--batch", "--yes", "--quiet", "--trust-model", "always", "--encrypt"}
+	for _, r := range gpgRecipients {
+		args = append(args, "--recipient", r)
+	}
+	cmd := exec.Command(*gpgBinary, args...)
+	cmd.Stdin = bytes.NewReader(body)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("gpg: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
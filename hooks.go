@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Hooks are programs run around the backup of each account and each
+// folder, for instance to mount an encrypted volume first and snapshot
+// the destination filesystem when done, or to send custom notifications.
+// Like exec: servers, a hook is a program and its arguments, not a shell
+// command. It gets the environment of backupimap and these variables:
+//
+//	BACKUPIMAP_ACCOUNT    the account being backed up
+//	BACKUPIMAP_OUTPUT     where its backup ends up
+//	BACKUPIMAP_FOLDER     the folder, for the folder hooks
+//	BACKUPIMAP_STATUS     success, partial or failure, for --post-hook
+//	BACKUPIMAP_ERROR      why the backup failed or is partial
+//	BACKUPIMAP_MESSAGES   messages written, by --post-hook for the run
+//	                      and by --post-folder-hook for the folder
+//	BACKUPIMAP_BYTES      the size of the messages written
+//	BACKUPIMAP_ERRORS     the number of errors
+//	BACKUPIMAP_SKIPPED    the number of skipped messages
+//	BACKUPIMAP_INCOMPLETE the folders not fully backed up, one per line
+//
+// An account whose --pre-hook fails is not backed up, and neither is a
+// folder whose --pre-folder-hook fails. Failures of the other hooks are
+// only logged.
+
+var (
+	preHook        = flag.String("pre-hook", "", "Program to run before backing up each account")
+	postHook       = flag.String("post-hook", "", "Program to run after backing up each account, with the results in its environment")
+	preFolderHook  = flag.String("pre-folder-hook", "", "Program to run before downloading each folder")
+	postFolderHook = flag.String("post-folder-hook", "", "Program to run once each folder is written")
+)
+
+// RunHook runs a hook with the given variables added to its environment.
+func RunHook(hook string, env ...string) error {
+	args := strings.Fields(hook)
+	if len(args) == 0 {
+		return errors.New("missing command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// HookEnv returns the hook variables describing the account.
+func (a *Account) HookEnv() []string {
+	return []string{"BACKUPIMAP_ACCOUNT=" + a.Username, "BACKUPIMAP_OUTPUT=" + a.Destination()}
+}
+
+// PostHook runs --post-hook with the results of the account's backup.
+func PostHook(a *Account, s *AccountSummary) {
+	if *postHook == "" {
+		return
+	}
+	env := append(a.HookEnv(),
+		"BACKUPIMAP_STATUS="+s.Status,
+		"BACKUPIMAP_ERROR="+s.Error,
+		fmt.Sprintf("BACKUPIMAP_MESSAGES=%d", s.Messages),
+		fmt.Sprintf("BACKUPIMAP_BYTES=%d", s.Bytes),
+		fmt.Sprintf("BACKUPIMAP_ERRORS=%d", s.Errors),
+		fmt.Sprintf("BACKUPIMAP_SKIPPED=%d", s.Skipped),
+		"BACKUPIMAP_INCOMPLETE="+strings.Join(s.Incomplete, "\n"))
+	if err := RunHook(*postHook, env...); err != nil {
+		log.Printf("%s: post-hook failed: %s", a.Username, err)
+	}
+}
+
+// PreFolderHook runs --pre-folder-hook, it reports whether the folder
+// should be downloaded.
+func (a *Account) PreFolderHook(folder string) bool {
+	if *preFolderHook == "" {
+		return true
+	}
+	if err := RunHook(*preFolderHook, append(a.HookEnv(), "BACKUPIMAP_FOLDER="+folder)...); err != nil {
+		log.Printf("%s: pre-folder-hook failed for %s: %s", a.Username, folder, err)
+		return false
+	}
+	return true
+}
+
+// PostFolderHook runs --post-folder-hook once a folder is written.
+func (a *Account) PostFolderHook(folder string, messages int) {
+	if *postFolderHook == "" {
+		return
+	}
+	env := append(a.HookEnv(), "BACKUPIMAP_FOLDER="+folder, fmt.Sprintf("BACKUPIMAP_MESSAGES=%d", messages))
+	if err := RunHook(*postFolderHook, env...); err != nil {
+		log.Printf("%s: post-folder-hook failed for %s: %s", a.Username, folder, err)
+	}
+}
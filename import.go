@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ImportCommand implements 'import <mbox|maildir>... -o <archive.zip>',
+// which converts mbox files, Maildirs and Google Takeout exports into an
+// archive with a manifest, so they can be restored, merged and pruned
+// like backups. With --restore, the archive is then restored to --user.
+func ImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	out := fs.String("o", "", "Archive to write")
+	folder := fs.String("folder", "", "Folder for the messages of mbox files (default: the file name, or the Gmail labels of Takeout exports)")
+	restore := fs.Bool("restore", false, "Restore the archive to --user afterwards")
+	files, err := ParseCommandFlags(fs, args)
+	if err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(files) == 0 || *out == "" {
+		return errors.New("usage: import <mbox|maildir>... -o <archive.zip>")
+	}
+
+	w, err := NewZipWriter(*out, &Manifest{Account: *username, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	im := &importer{w: w, uidValidity: uint32(time.Now().Unix()), uids: make(map[string]uint32)}
+	for _, path := range files {
+		fi, err := os.Stat(path)
+		if err == nil && fi.IsDir() {
+			err = im.maildir(path)
+		} else if err == nil {
+			err = im.mbox(path, *folder)
+		}
+		if err != nil {
+			w.Close(false)
+			return err
+		}
+	}
+	for folder := range im.uids {
+		w.Complete(&Message{Folder: folder, UIDValidity: im.uidValidity})
+	}
+	if err := w.Close(true); err != nil {
+		return err
+	}
+	archive, err := FinishArchive(*out)
+	if err != nil {
+		return err
+	}
+	log.Printf("imported %d messages into %s", im.n, archive)
+	if *restore {
+		return RestoreCommand([]string{archive})
+	}
+	return nil
+}
+
+type importer struct {
+	w           *ZipWriter
+	uidValidity uint32
+	uids        map[string]uint32
+	n           int
+}
+
+func (im *importer) add(folder string, flags []string, body []byte) error {
+	im.uids[folder]++
+	msg := &Message{Folder: folder, UID: im.uids[folder], UIDValidity: im.uidValidity, Flags: flags,
+		Body: normalizeCRLF(body)}
+	msg.MessageID = MessageID(msg.Body)
+	im.n++
+	return im.w.Add(path.Join(folder, fmt.Sprintf("%d.%d.eml", msg.UIDValidity, msg.UID)), msg)
+}
+
+// mbox imports an mbox file, reading one message at a time since
+// Takeout exports can be very large. Lines quoted as ">From " are
+// unquoted as in mboxrd.
+func (im *importer) mbox(file, folder string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if folder == "" {
+		folder = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+
+	r := bufio.NewReader(f)
+	var msg []byte
+	started := false
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		// The blank line before the next "From " belongs to the mbox.
+		body := msg
+		if bytes.HasSuffix(body, []byte("\n\n")) {
+			body = body[:len(body)-1]
+		}
+		msg = nil
+		name, flags := MboxFolder(body, folder)
+		return im.add(name, flags, body)
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := flush(); err != nil {
+					return err
+				}
+				started = true
+			case started:
+				if q := bytes.TrimLeft(line, ">"); len(q) < len(line) && bytes.HasPrefix(q, []byte("From ")) {
+					line = line[1:]
+				}
+				msg = append(msg, line...)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// MboxFolder returns the folder and flags of a message from an mbox
+// file. Google Takeout exports list the Gmail labels of each message in
+// X-Gmail-Labels, other mbox files keep the flags in Status and X-Status.
+func MboxFolder(body []byte, folder string) (string, []string) {
+	m, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return folder, nil
+	}
+	var flags []string
+	if labels := m.Header.Get("X-Gmail-Labels"); labels != "" {
+		name := ""
+		seen := true
+		for _, l := range strings.Split(labels, ",") {
+			switch l = strings.TrimSpace(l); {
+			case l == "Unread":
+				seen = false
+			case l == "Starred":
+				flags = append(flags, `\Flagged`)
+			case l == "Inbox":
+				name = "INBOX"
+			case l == "Opened", l == "Important", l == "Archived", strings.HasPrefix(l, "Category "):
+			case name == "":
+				name = l
+			}
+		}
+		if seen {
+			flags = append(flags, `\Seen`)
+		}
+		if name == "" {
+			name = "Archive"
+		}
+		return name, flags
+	}
+	if strings.Contains(m.Header.Get("Status"), "R") {
+		flags = append(flags, `\Seen`)
+	}
+	xstatus := m.Header.Get("X-Status")
+	for c, f := range map[string]string{"A": `\Answered`, "F": `\Flagged`, "D": `\Deleted`, "T": `\Draft`} {
+		if strings.Contains(xstatus, c) {
+			flags = append(flags, f)
+		}
+	}
+	sort.Strings(flags)
+	return folder, flags
+}
+
+// MaildirInfo returns the flags part of a Maildir file name, after ":2,"
+// or, in names written on Windows, ";2," or "!2,".
+func MaildirInfo(name string) (string, bool) {
+	for _, sep := range []string{":2,", ";2,", "!2,"} {
+		if _, info, ok := strings.Cut(name, sep); ok {
+			return info, true
+		}
+	}
+	return "", false
+}
+
+// maildirFlags are the flags of Maildir file names.
+var maildirFlags = map[rune]string{'D': `\Draft`, 'F': `\Flagged`, 'R': `\Answered`, 'S': `\Seen`, 'T': `\Deleted`}
+
+// maildir imports a Maildir and its subfolders, in Maildir++ (.Sub.Folder)
+// or nested layout.
+func (im *importer) maildir(root string) error {
+	return filepath.WalkDir(root, func(dir string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		switch d.Name() {
+		case "cur", "new", "tmp":
+			return fs.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(dir, "cur")); err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, dir)
+		folder := filepath.ToSlash(rel)
+		switch {
+		case folder == ".":
+			folder = "INBOX"
+		case strings.HasPrefix(folder, "."):
+			folder = strings.ReplaceAll(folder[1:], ".", "/")
+		}
+		for _, sub := range []string{"cur", "new"} {
+			entries, err := os.ReadDir(filepath.Join(dir, sub))
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if e.IsDir() {
+					continue
+				}
+				body, err := os.ReadFile(filepath.Join(dir, sub, e.Name()))
+				if err != nil {
+					return err
+				}
+				var flags []string
+				if info, ok := MaildirInfo(e.Name()); ok {
+					for _, c := range info {
+						if f, ok := maildirFlags[c]; ok {
+							flags = append(flags, f)
+						}
+					}
+				}
+				if err := im.add(folder, flags, body); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Passwords can be kept in the system keyring and referenced on the
+// command line as 'keyring:<account>'. The platform specific keyringGet
+// and keyringSet functions store secrets under keyringService.
+
+const keyringService = "backupimap"
+
+// ResolvePassword returns the secret referenced by a 'keyring:' password,
+// or the password itself.
+func ResolvePassword(password string) (string, error) {
+	account, ok := strings.CutPrefix(password, "keyring:")
+	if !ok {
+		return password, nil
+	}
+	secret, err := keyringGet(account)
+	if err != nil {
+		return "", fmt.Errorf("keyring lookup of '%s' failed: %s", account, err)
+	}
+	return secret, nil
+}
+
+// KeyringCommand implements 'keyring set <account>', reading the secret
+// from standard input, without echoing it in a terminal.
+func KeyringCommand(args []string) error {
+	if len(args) != 2 || args[0] != "set" {
+		return fmt.Errorf("usage: keyring set <account>")
+	}
+	fmt.Fprintf(os.Stderr, "Secret for %s: ", args[1])
+	if Interactive() {
+		if err := SetEcho(false); err != nil {
+			return fmt.Errorf("could not turn off echo: %s", err)
+		}
+		defer fmt.Fprintln(os.Stderr)
+		defer SetEcho(true)
+	}
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && secret == "" {
+		return err
+	}
+	return keyringSet(args[1], strings.TrimRight(secret, "\r\n"))
+}
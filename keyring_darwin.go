@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// macOS Keychain access through security(1).
+
+func keyringGet(account string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keyringService, "-a", account, "-w").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// keyringSet runs the command in security's interactive mode, so that the
+// secret is passed on standard input rather than on the command line,
+// where other users could see it.
+func keyringSet(account, secret string) error {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s \"%s\" -a \"%s\" -w \"%s\"\n",
+		quote.Replace(keyringService), quote.Replace(account), quote.Replace(secret)))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return err
+	}
+	// Errors of interactive commands do not change the exit status,
+	// anything but the prompt is one.
+	if msg := strings.TrimSpace(strings.ReplaceAll(string(out), "security>", "")); msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
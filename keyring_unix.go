@@ -0,0 +1,26 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// Secret Service (GNOME Keyring, KWallet) access through libsecret's
+// secret-tool.
+
+func keyringGet(account string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keyringService, "account", account).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+func keyringSet(account, secret string) error {
+	cmd := exec.Command("secret-tool", "store", "--label", keyringService+" "+account,
+		"service", keyringService, "account", account)
+	cmd.Stdin = strings.NewReader(secret)
+	return cmd.Run()
+}
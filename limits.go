@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Size limits for metered connections and small destinations: once
+// --max-total-bytes of messages were downloaded in a run, no more are
+// fetched from any account, and a folder stops at --max-folder-bytes.
+// The limits are checked before each FETCH, so they can be exceeded by
+// one batch. The backup is finished normally and reported as partial,
+// with the folders left incomplete. The messages left out are postponed,
+// so the next incremental run downloads them, see State.Update.
+
+var maxTotalBytes, maxFolderBytes sizeFlag
+
+// downloaded counts the message data fetched in the current run.
+var downloaded int64
+
+// sizeFlag is a size in bytes, with an optional K, M, G or T suffix.
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	if s == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeFlag) Set(value string) error {
+	n, err := ParseSize(value)
+	*s = sizeFlag(n)
+	return err
+}
+
+// ParseSize parses a size such as 500M or 20G, in powers of 1024.
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	shift := 0
+	if num != "" {
+		if i := strings.IndexByte("KMGT", num[len(num)-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n << shift, nil
+}
+
+// Fetched counts a message downloaded from a folder.
+func (a *Account) Fetched(folder string, size int) {
+	atomic.AddInt64(&downloaded, int64(size))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.folderBytes[folder] += int64(size)
+}
+
+// Limit returns the size, time or error limit that keeps more messages of
+// a folder from being downloaded, if any.
+func (a *Account) Limit(folder string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var reason string
+	switch {
+	case maxTotalBytes > 0 && atomic.LoadInt64(&downloaded) >= int64(maxTotalBytes):
+		reason = fmt.Sprintf("--max-total-bytes of %s reached", FormatSize(int64(maxTotalBytes)))
+	case maxFolderBytes > 0 && a.folderBytes[folder] >= int64(maxFolderBytes):
+		reason = fmt.Sprintf("--max-folder-bytes of %s reached in %s", FormatSize(int64(maxFolderBytes)), folder)
+	default:
+		if reason = a.abortLimit(folder); reason == "" {
+			return ""
+		}
+	}
+	if !a.limited[reason] {
+		log.Printf("%s: %s, stopping", a.Username, reason)
+		a.limited[reason] = true
+	}
+	return reason
+}
+
+// Limits returns the limits the run reached.
+func (a *Account) Limits() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var list []string
+	for reason := range a.limited {
+		list = append(list, reason)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]int64{
+		"0":     0,
+		"1234":  1234,
+		"10B":   10,
+		"1K":    1 << 10,
+		"500M":  500 << 20,
+		"500mb": 500 << 20,
+		"20G":   20 << 30,
+		"2T":    2 << 40,
+	}
+	for s, want := range sizes {
+		if n, err := ParseSize(s); err != nil || n != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", s, n, err, want)
+		}
+	}
+	for _, s := range []string{"", "M", "-1M", "1.5G", "12X"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) succeeded", s)
+		}
+	}
+}
+
+func TestFolderLimit(t *testing.T) {
+	defer func(total, folder sizeFlag) { maxTotalBytes, maxFolderBytes = total, folder }(maxTotalBytes, maxFolderBytes)
+	maxTotalBytes, maxFolderBytes = 0, 1000
+	a := &Account{}
+	a.Reset()
+	a.Fetched("INBOX", 600)
+	if reason := a.Limit("INBOX"); reason != "" {
+		t.Errorf("limit reached after 600 bytes: %s", reason)
+	}
+	a.Fetched("INBOX", 600)
+	if reason := a.Limit("INBOX"); reason == "" {
+		t.Error("no limit after 1200 bytes")
+	}
+	if reason := a.Limit("Sent"); reason != "" {
+		t.Errorf("the limit of INBOX applies to Sent: %s", reason)
+	}
+	if limits := a.Limits(); len(limits) != 1 {
+		t.Errorf("limits reached: %v", limits)
+	}
+}
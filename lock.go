@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Lock files prevent two runs from writing the same output at once.
+
+var errLocked = errors.New("locked by another process")
+
+type Lock struct {
+	f *os.File
+}
+
+// LockFile takes an exclusive lock on path, creating it if necessary. If
+// wait is false and the file is already locked, errLocked is returned.
+// The lock is released when the process exits, so stale lock files left
+// behind by a crash are harmless.
+func LockFile(path string, wait bool) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return &Lock{f}, nil
+}
+
+func (l *Lock) Unlock() {
+	l.f.Close()
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// LongPath returns dir, paths are not limited in length.
+func LongPath(dir string) string {
+	return dir
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// LongPath returns a directory as an absolute \\?\ path, so that the
+// files below it are not limited to the 260 characters of Windows paths,
+// which deep folder trees with long Maildir names easily exceed. Paths
+// with the prefix are used as they are.
+func LongPath(dir string) string {
+	if strings.HasPrefix(dir, `\\?\`) {
+		return dir
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	if unc, ok := strings.CutPrefix(abs, `\\`); ok {
+		return `\\?\UNC\` + unc
+	}
+	return `\\?\` + abs
+}
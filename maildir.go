@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Maildir output: messages are written directly into a directory tree,
+// which is kept up to date by successive incremental runs. The manifest
+// of each run is saved in the top directory.
+
+var (
+	format = flag.String("format", "zip", "Output format: zip, maildir, sdbox, eml or tar")
+	mirror = flag.Bool("mirror", false, "Remove messages deleted on the server from directory output (with --incremental)")
+)
+
+type MaildirWriter struct {
+	Manifest *Manifest
+
+	dir   string
+	state *State
+	tags  strings.Builder
+}
+
+func NewMaildirWriter(dir string, m *Manifest, state *State) (*MaildirWriter, error) {
+	dir = LongPath(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &MaildirWriter{Manifest: m, dir: dir, state: state}, nil
+}
+
+// Create starts a file of the tree, it is moved into place when closed.
+// Messages are delivered through the tmp directory of their folder, as
+// the Maildir specification requires, other files go to the top.
+func (w *MaildirWriter) Create(folder, name string, meta *Message) (io.WriteCloser, error) {
+	path, err := LocalPath(w.dir, name)
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if meta != nil {
+		dir := filepath.Dir(filepath.Dir(path))
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+				return nil, err
+			}
+		}
+		tmp = filepath.Join(dir, "tmp", filepath.Base(path))
+	}
+	return &storeFile{store: func(data []byte) error {
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+		// Dovecot and others take the internal date from the mtime.
+		if meta != nil && !meta.InternalDate.IsZero() {
+			os.Chtimes(path, meta.InternalDate, meta.InternalDate)
+		}
+		return nil
+	}}, nil
+}
+
+// Finalize writes the manifest of a complete run.
+func (w *MaildirWriter) Finalize() error {
+	return w.Close(true)
+}
+
+func (w *MaildirWriter) Add(name string, msg *Message) error {
+	if err := Store(w, msg.Folder, name, msg, msg.Body); err != nil {
+		return err
+	}
+	w.tags.WriteString(NotmuchLine(NotmuchID(msg.Body), NotmuchTags(msg.Flags, msg.Labels)))
+	w.Manifest.Add(&CheckpointRecord{
+		Name:         name,
+		Folder:       msg.Folder,
+		UID:          msg.UID,
+		UIDValidity:  msg.UIDValidity,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		RFC822Size:   msg.Size,
+		ThreadID:     msg.ThreadID,
+		MessageID:    msg.MessageID,
+	})
+	return nil
+}
+
+func (w *MaildirWriter) UpdateFlags(msg *Message) error {
+	// The message id is only in the file written by an earlier run.
+	if fs := w.state.Folders[msg.Folder]; fs != nil && fs.Files[msg.UID] != "" {
+		file, err := LocalPath(w.dir, fs.Files[msg.UID])
+		var body []byte
+		if err == nil {
+			body, err = os.ReadFile(file)
+		}
+		if err == nil {
+			w.tags.WriteString(NotmuchLine(NotmuchID(body), NotmuchTags(msg.Flags, msg.Labels)))
+		}
+	}
+	w.Manifest.Add(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Flags:       msg.Flags,
+		FlagUpdate:  true,
+	})
+	return nil
+}
+
+func (w *MaildirWriter) Expunge(msg *Message) error {
+	r := &CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Expunged:    true,
+	}
+	if fs := w.state.Folders[msg.Folder]; fs != nil {
+		r.Name = fs.Files[msg.UID]
+	}
+	if *mirror && r.Name != "" {
+		file, err := LocalPath(w.dir, r.Name)
+		if err == nil {
+			err = os.Remove(file)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.Manifest.Add(r)
+	return nil
+}
+
+func (w *MaildirWriter) Complete(msg *Message) error {
+	w.Manifest.Add(&CheckpointRecord{Folder: msg.Folder, Complete: true, Metadata: msg.Metadata})
+	return nil
+}
+
+func (w *MaildirWriter) Close(complete bool) error {
+	data, err := w.Manifest.Marshal()
+	if err != nil {
+		return err
+	}
+	stamp := w.Manifest.Created.UTC().Format("20060102T150405Z")
+	if w.tags.Len() > 0 {
+		name := fmt.Sprintf("notmuch-%s.tags", stamp)
+		if err := Store(w, "", name, nil, []byte(w.tags.String())); err != nil {
+			return err
+		}
+	}
+	return Store(w, "", fmt.Sprintf("manifest-%s.json", stamp), nil, data)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Every archive ends with a manifest describing its contents. For
+// incremental backups it also records the flag changes and deletions of
+// messages stored in earlier archives.
+
+const manifestName = "manifest.json"
+
+// manifestVersion is the version of the archive layout and manifest
+// written by this program. Manifests without a version are version 1.
+// Older versions are upgraded when they are read; 'upgrade' rewrites
+// them. ZIP archives also carry the version in their comment.
+//
+// Version 2 added the version itself, all other additions are optional
+// fields.
+const manifestVersion = 2
+
+// archiveMarker is the comment of ZIP archives.
+func archiveMarker() string {
+	return fmt.Sprintf("backupimap archive version %d", manifestVersion)
+}
+
+type Manifest struct {
+	Version     int                `json:"version"`
+	Account     string             `json:"account"`
+	Created     time.Time          `json:"created"`
+	Incremental bool               `json:"incremental"`
+	HeadersOnly bool               `json:"headers_only,omitempty"`
+	EncryptedTo []string           `json:"encrypted_to,omitempty"`
+	Messages    []*ManifestMessage `json:"messages"`
+	FlagUpdates []*ManifestMessage `json:"flag_updates,omitempty"`
+	Tombstones  []*ManifestMessage `json:"tombstones,omitempty"`
+
+	// Metadata holds the annotations of the folders and, under "",
+	// of the server.
+	Metadata map[string]map[string]string `json:"metadata,omitempty"`
+
+	// Skipped lists the messages and folders that were not backed up.
+	Skipped []*SkippedMessage `json:"skipped,omitempty"`
+
+	// Mailboxes are the server names of folders that were renamed
+	// because they differ from another only by case.
+	Mailboxes map[string]string `json:"mailboxes,omitempty"`
+}
+
+type ManifestMessage struct {
+	Name        string   `json:"name,omitempty"`
+	Folder      string   `json:"folder"`
+	UID         uint32   `json:"uid"`
+	UIDValidity uint32   `json:"uidvalidity"`
+	Flags       []string `json:"flags,omitempty"`
+	// Hash is the SHA-256 of the body in --repo snapshots, the name of
+	// its object. NormalizedHash is that of its canonical form, with
+	// --normalize-hash.
+	Hash           string `json:"hash,omitempty"`
+	NormalizedHash string `json:"normalized_hash,omitempty"`
+
+	InternalDate time.Time `json:"internaldate,omitzero"`
+	RFC822Size   uint32    `json:"rfc822_size,omitempty"`
+	// ThreadID is the X-GM-THRID of Gmail messages in hex, as in the
+	// conversation URLs of the web interface.
+	ThreadID string `json:"gmail_thread_id,omitempty"`
+	// MessageID is the Message-ID header, so that restore --message-id
+	// finds the message without reading the bodies.
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// Add records a checkpointed entry or flag update in the manifest.
+func (m *Manifest) Add(r *CheckpointRecord) {
+	if r.Complete {
+		if r.Metadata != nil {
+			m.SetMetadata(r.Folder, r.Metadata)
+		}
+		return
+	}
+	mm := &ManifestMessage{
+		Name:        r.Name,
+		Folder:      r.Folder,
+		UID:         r.UID,
+		UIDValidity: r.UIDValidity,
+		Flags:       r.Flags,
+
+		InternalDate: r.InternalDate,
+		RFC822Size:   r.RFC822Size,
+		ThreadID:     r.ThreadID,
+		MessageID:    r.MessageID,
+	}
+	switch {
+	case r.FlagUpdate:
+		m.FlagUpdates = append(m.FlagUpdates, mm)
+	case r.Expunged:
+		m.Tombstones = append(m.Tombstones, mm)
+	default:
+		m.Messages = append(m.Messages, mm)
+	}
+}
+
+func (m *Manifest) SetMetadata(folder string, entries map[string]string) {
+	if m.Metadata == nil {
+		m.Metadata = make(map[string]map[string]string)
+	}
+	m.Metadata[folder] = entries
+}
+
+// Marshal encodes the manifest in the current version.
+func (m *Manifest) Marshal() ([]byte, error) {
+	m.Version = manifestVersion
+	return json.MarshalIndent(m, "", " ")
+}
+
+// ParseManifest decodes a manifest read from the named file, upgrading
+// it to the current version.
+func ParseManifest(name string, data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("%s: written by a newer version of backupimap (version %d), please upgrade", name, m.Version)
+	}
+	// Upgrades from each version to the next go here. Version 1 only
+	// lacks the version number.
+	m.Version = manifestVersion
+	return &m, nil
+}
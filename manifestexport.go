@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ManifestCommand implements 'manifest export <backup>...', which lists
+// the messages present at the end of the backups as a CSV file, one line
+// per message with its folder, date, sender, subject, size and file in
+// the backup, for review in a spreadsheet. The sender and subject of
+// encrypted messages cannot be read, they are left empty.
+func ManifestCommand(args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return errors.New("usage: manifest export [--format=csv] [-o <file>] <backup>...")
+	}
+	fs := flag.NewFlagSet("manifest export", flag.ContinueOnError)
+	format := fs.String("format", "csv", "Listing format, only csv is supported")
+	out := fs.String("o", "-", "File to write, - for stdout")
+	files, err := ParseCommandFlags(fs, args[1:])
+	if err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("usage: manifest export [--format=csv] [-o <file>] <backup>...")
+	}
+	if *format != "csv" {
+		return fmt.Errorf("unknown format '%s', only csv is supported", *format)
+	}
+	var sources []*Source
+	for _, path := range files {
+		src, err := OpenSource(path, time.Time{})
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		sources = append(sources, src)
+	}
+
+	entries := CollectMessages(sources)
+	rows := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		body, err := e.src.Raw(e.ManifestMessage)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, ListingRow(e.ManifestMessage, body))
+	}
+	// By folder, then by date.
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i][0] != rows[j][0] {
+			return rows[i][0] < rows[j][0]
+		}
+		return rows[i][1] < rows[j][1]
+	})
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"folder", "date", "from", "subject", "size", "filename"})
+	cw.WriteAll(rows)
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+// ListingRow returns the CSV line of a message. Dates are in the local
+// time zone, in a form spreadsheets recognize and sort.
+func ListingRow(mm *ManifestMessage, body []byte) []string {
+	date := mm.InternalDate
+	var from, subject string
+	if m, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+		if d, err := m.Header.Date(); err == nil {
+			date = d
+		}
+		from = DecodedHeader(m.Header, "From")
+		subject = DecodedHeader(m.Header, "Subject")
+	}
+	var when string
+	if !date.IsZero() {
+		when = date.Local().Format("2006-01-02 15:04:05")
+	}
+	size := int64(mm.RFC822Size)
+	if size == 0 {
+		size = int64(len(body))
+	}
+	return []string{mm.Folder, when, from, subject, strconv.FormatInt(size, 10), mm.Name}
+}
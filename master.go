@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Master user logins let an administrator back up any account on a
+// server with a single password. Dovecot accepts "user*master" as login
+// name; other servers take the account as the SASL PLAIN authorization
+// identity, with --authzid.
+
+var (
+	masterUser      = flag.String("master-user", "", "Log in as this master user on behalf of each account, with its password")
+	masterSeparator = flag.String("master-separator", "*", "Separator in user<sep>master login names")
+	authzid         = flag.Bool("authzid", false, "Authenticate the master user with SASL PLAIN, authorizing as the account")
+)
+
+// Login authenticates with the account's password, or the master user's.
+func (a *Account) Login(c *imap.Client) (*imap.Command, error) {
+	switch {
+	case a.MasterUser == "":
+		return c.Login(a.Username, a.Password)
+	case *authzid:
+		return c.Auth(imap.PlainAuth(a.MasterUser, a.Password, a.Username))
+	default:
+		return c.Login(a.Username+*masterSeparator+a.MasterUser, a.Password)
+	}
+}
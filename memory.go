@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"sync"
+)
+
+var memoryLimit = flag.Int("memory-limit", 512, "Limit of message data waiting to be written, in MB (0 for no limit)")
+
+// budget bounds the size of the messages between the downloaders and
+// the writers: downloaders wait when the writers fall behind.
+var budget = NewBudget(0)
+
+// Budget is a semaphore counting bytes.
+type Budget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	used  int64
+	limit int64
+}
+
+func NewBudget(limit int64) *Budget {
+	b := &Budget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Acquire waits until n bytes fit in the budget. A message larger than
+// the whole budget is let through once nothing else is held.
+func (b *Budget) Acquire(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.limit > 0 && b.used > 0 && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+func (b *Budget) Release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/mail"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MergeCommand implements 'merge <backup>... -o <combined.zip>', which
+// writes the messages of several backups, such as an old export and the
+// backups of the current provider, into one archive. A message found in
+// more than one backup is stored once per folder, recognized by its
+// Message-ID or, without one, by its content. Folders are renamed by the
+// --map rules, and folders differing only by case are merged. The
+// messages get new UIDs.
+func MergeCommand(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	out := fs.String("o", "", "Combined archive to write")
+	files, err := ParseCommandFlags(fs, args)
+	if err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(files) < 2 || *out == "" {
+		return errors.New("usage: merge <backup>... -o <combined.zip>")
+	}
+	var sources []*Source
+	for _, path := range files {
+		src, err := OpenSource(path, time.Time{})
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		sources = append(sources, src)
+	}
+
+	merged := &Manifest{Created: time.Now()}
+	for _, src := range sources {
+		for _, m := range src.Manifests {
+			if merged.Account == "" {
+				merged.Account = m.Account
+			}
+			for _, r := range m.EncryptedTo {
+				if !slices.Contains(merged.EncryptedTo, r) {
+					merged.EncryptedTo = append(merged.EncryptedTo, r)
+				}
+			}
+		}
+	}
+	w, err := NewZipWriter(*out, merged)
+	if err != nil {
+		return err
+	}
+
+	a := &Account{}
+	folders := make(map[string]string)
+	uidValidity := uint32(time.Now().Unix())
+	uids := make(map[string]uint32)
+	seen := make(map[string]*Message)
+	total, dups := 0, 0
+	for _, src := range sources {
+		// Backups are merged one by one, so that the messages of
+		// an incremental chain are read in order.
+		for _, e := range CollectMessages([]*Source{src}) {
+			folder := a.MapFolder(e.Folder)
+			if name, ok := folders[strings.ToLower(folder)]; ok {
+				folder = name
+			} else {
+				folders[strings.ToLower(folder)] = folder
+			}
+			// Encrypted messages are stored as they are, and
+			// recognized by their plaintext.
+			body, err := src.Raw(e.ManifestMessage)
+			var plain []byte
+			if err == nil {
+				plain, err = Plaintext(body)
+			}
+			if err != nil {
+				w.Close(false)
+				return fmt.Errorf("%s: %s", e.Name, err)
+			}
+			key := strings.ToLower(folder) + "\x00" + MessageKey(plain)
+			if msg := seen[key]; msg != nil {
+				for _, f := range e.Flags {
+					if !slices.Contains(msg.Flags, f) {
+						msg.Flags = append(msg.Flags, f)
+					}
+				}
+				dups++
+				continue
+			}
+			uids[folder]++
+			msg := &Message{Folder: folder, UID: uids[folder], UIDValidity: uidValidity,
+				Flags: slices.Clone(e.Flags), Body: body, InternalDate: e.InternalDate, Size: e.RFC822Size, ThreadID: e.ThreadID,
+				MessageID: MessageID(plain)}
+			seen[key] = msg
+			name := path.Join(folder, fmt.Sprintf("%d.%d.eml", msg.UIDValidity, msg.UID))
+			if err := w.Add(name, msg); err != nil {
+				w.Close(false)
+				return err
+			}
+			// Keep the flags for duplicates, not the body.
+			msg.Body = nil
+			total++
+		}
+	}
+
+	// Flags merged from duplicates are only known once all messages
+	// have been read, the manifest is written last.
+	byUID := make(map[string]*Message)
+	for _, msg := range seen {
+		byUID[messageKey(msg.Folder, msg.UIDValidity, msg.UID)] = msg
+	}
+	for _, mm := range merged.Messages {
+		mm.Flags = byUID[messageKey(mm.Folder, mm.UIDValidity, mm.UID)].Flags
+	}
+	for folder := range uids {
+		w.Complete(&Message{Folder: folder, UIDValidity: uidValidity})
+	}
+	if err := w.Close(true); err != nil {
+		return err
+	}
+	archive, err := FinishArchive(*out)
+	if err != nil {
+		return err
+	}
+	log.Printf("merged %d messages into %s, %d duplicates skipped", total, archive, dups)
+	return nil
+}
+
+// MessageKey identifies a message across backups by its Message-ID, or
+// by the hash of its content if it has none, see normalize.go.
+func MessageKey(body []byte) string {
+	if id := MessageID(body); id != "" {
+		return id
+	}
+	return "sha256:" + BodyHash(body)
+}
+
+// MessageID returns the Message-ID header of a message, or "".
+func MessageID(body []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(m.Header.Get("Message-Id"))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Server and folder annotations (METADATA, RFC 5464), where providers and
+// clients keep folder colors, comments and settings. They are saved in
+// the manifest, the server's under the folder name "", and set again by
+// restore.
+
+// GetMetadata returns all /private and /shared entries of a mailbox, or
+// of the server if mbox is "".
+func GetMetadata(c *imap.Client, mbox string) map[string]string {
+	if !c.Caps["METADATA"] && !(mbox == "" && c.Caps["METADATA-SERVER"]) {
+		return nil
+	}
+	cmd, err := Result(c.Send("GETMETADATA", []imap.Field{"DEPTH", "infinity"},
+		c.Quote(imap.UTF7Encode(mbox)), []imap.Field{"/private", "/shared"}))
+	if err != nil {
+		log.Printf("could not get metadata of '%s': %s", mbox, err)
+		return nil
+	}
+	var entries map[string]string
+	for _, resp := range cmd.Data {
+		if !strings.EqualFold(resp.Label, "METADATA") || len(resp.Fields) < 3 {
+			continue
+		}
+		list := imap.AsList(resp.Fields[2])
+		for i := 0; i+1 < len(list); i += 2 {
+			if list[i+1] == nil {
+				continue
+			}
+			value := imap.AsString(list[i+1])
+			if value == "" {
+				value = string(imap.AsBytes(list[i+1]))
+			}
+			if entries == nil {
+				entries = make(map[string]string)
+			}
+			entries[imap.AsString(list[i])] = value
+		}
+	}
+	c.Data = nil
+	return entries
+}
+
+// SetMetadata restores the entries of a mailbox. Entries the server does
+// not let clients change are skipped with a message.
+func SetMetadata(c *imap.Client, mbox string, entries map[string]string) {
+	if !c.Caps["METADATA"] && !(mbox == "" && c.Caps["METADATA-SERVER"]) {
+		return
+	}
+	for entry, value := range entries {
+		_, err := Result(c.Send("SETMETADATA", c.Quote(imap.UTF7Encode(mbox)), []imap.Field{entry, c.Quote(value)}))
+		if err != nil {
+			log.Printf("could not set %s of '%s': %s", entry, mbox, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Prometheus metrics, mostly useful together with --watch.
+
+var metricsAddr = flag.String("metrics-listen", "", "Address to serve Prometheus metrics on, e.g. :9117")
+
+type accountMetrics struct {
+	Messages, Bytes, Errors int64
+	Runs, Failures          int64
+	ServerMessages          int64
+	ServerBytes             int64
+	LastSuccess             int64
+	LastDuration            float64
+}
+
+var (
+	metricsLock sync.Mutex
+	metrics     = map[string]*accountMetrics{}
+)
+
+// RecordMetrics adds the results of a run to the exported counters.
+func RecordMetrics(s *Summary) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	for _, a := range s.Accounts {
+		m := metrics[a.User]
+		if m == nil {
+			m = &accountMetrics{}
+			metrics[a.User] = m
+		}
+		m.Messages += a.Messages
+		m.Bytes += a.Bytes
+		m.Errors += a.Errors
+		m.Runs++
+		if a.ExpectedMessages > 0 {
+			m.ServerMessages, m.ServerBytes = a.ExpectedMessages, a.ExpectedBytes
+		}
+		m.LastDuration = s.End.Sub(s.Start).Seconds()
+		if a.Status == "success" {
+			m.LastSuccess = s.End.Unix()
+		} else {
+			m.Failures++
+		}
+	}
+}
+
+func ServeMetrics(addr string) {
+	http.HandleFunc("/metrics", metricsHandler)
+	log.Printf("serving metrics on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	users := make([]string, 0, len(metrics))
+	for user := range metrics {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, kind, help string, value func(m *accountMetrics) interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, user := range users {
+			fmt.Fprintf(w, "%s{account=%q} %v\n", name, user, value(metrics[user]))
+		}
+	}
+	metric("backupimap_messages_total", "counter", "Messages backed up.",
+		func(m *accountMetrics) interface{} { return m.Messages })
+	metric("backupimap_bytes_total", "counter", "Message bytes backed up.",
+		func(m *accountMetrics) interface{} { return m.Bytes })
+	metric("backupimap_fetch_errors_total", "counter", "Failed FETCH commands.",
+		func(m *accountMetrics) interface{} { return m.Errors })
+	metric("backupimap_account_messages", "gauge", "Messages in the backed up folders, from STATUS.",
+		func(m *accountMetrics) interface{} { return m.ServerMessages })
+	metric("backupimap_account_bytes", "gauge", "Size of the backed up folders if the server reports it.",
+		func(m *accountMetrics) interface{} { return m.ServerBytes })
+	metric("backupimap_runs_total", "counter", "Backup runs.",
+		func(m *accountMetrics) interface{} { return m.Runs })
+	metric("backupimap_failed_runs_total", "counter", "Backup runs that did not complete.",
+		func(m *accountMetrics) interface{} { return m.Failures })
+	metric("backupimap_last_success_timestamp_seconds", "gauge", "Time of the last successful backup.",
+		func(m *accountMetrics) interface{} { return m.LastSuccess })
+	metric("backupimap_last_run_duration_seconds", "gauge", "Duration of the last backup run.",
+		func(m *accountMetrics) interface{} { return m.LastDuration })
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Names of the stored messages and folders. Maildir names contain the
+// UID, so they cannot collide even if the counter starts again in a
+// later run. Folders whose names differ only by case would end up in the
+// same directory on case-insensitive filesystems, so all but the first
+// of them get a suffix; the manifest records their mailbox names for
+// restore.
+//
+// Folders can be renamed with --map 'Sent Items=Sent' rules or the map of
+// an account in the --config file, both when backing up and restoring,
+// to follow the conventions of the destination.
+//
+// With --filename=uid the entries of a ZIP archive depend only on the
+// messages, so they are byte-identical between runs and dedupe well in
+// restic or git-annex. Only the manifest changes, and with more than one
+// connection the order of the folders.
+//
+// With --windows-names, the default on Windows, the names are valid on
+// NTFS: folders are renamed as by export, and Maildir names separate the
+// flags with a semicolon, as isync does on Windows, instead of a colon.
+
+var (
+	filenames    = flag.String("filename", "maildir", "Names of the messages in ZIP archives: maildir or uid (<folder>/<uidvalidity>.<uid>.eml)")
+	windowsNames = flag.Bool("windows-names", runtime.GOOS == "windows", "Only use file and folder names valid on Windows")
+)
+
+// MessageName returns the name a new message is stored under.
+func (a *Account) MessageName(msg *Message) string {
+	if *filenames == "uid" {
+		return path.Join(msg.Folder, fmt.Sprintf("%d.%d.eml", msg.UIDValidity, msg.UID))
+	}
+	a.msgIdCounter++
+	escape, sep := maildirEscape, ":"
+	if *windowsNames {
+		escape, sep = windowsEscape, ";"
+	}
+	return path.Join(msg.Folder, "cur", fmt.Sprintf("%d.U%d-%d_%d.%s%s2,S",
+		time.Now().Unix(),
+		msg.UIDValidity,
+		msg.UID,
+		a.msgIdCounter,
+		escape.Replace(hostname),
+		sep))
+}
+
+// maildirEscape escapes the characters Maildir names cannot contain, as
+// in the Maildir specification. windowsEscape replaces them, and those
+// that are not valid on Windows, with underscores.
+var (
+	maildirEscape = strings.NewReplacer("/", `\057`, ":", `\072`)
+	windowsEscape = strings.NewReplacer("/", "_", ":", "_", `\`, "_", ";", "_")
+)
+
+// MapFolder applies the --map rules and the account's map to a folder
+// name. A rule for a folder applies to its subfolders as well.
+func (a *Account) MapFolder(name string) string {
+	rules := make(map[string]string)
+	for _, rule := range folderMap {
+		if from, to, ok := strings.Cut(rule, "="); ok && from != "" && to != "" {
+			rules[from] = to
+		}
+	}
+	for from, to := range a.Map {
+		rules[from] = to
+	}
+	if to, ok := rules[name]; ok {
+		return to
+	}
+	// The longest matching parent wins.
+	best := ""
+	for from := range rules {
+		if strings.HasPrefix(name, from+"/") && len(from) > len(best) {
+			best = from
+		}
+	}
+	if best != "" {
+		return rules[best] + strings.TrimPrefix(name, best)
+	}
+	return name
+}
+
+// FolderNames maps mailboxes to folder names, applying
+// --normalize-folders, the folder map and --windows-names, escaping names
+// that would leave the output and renaming folders that differ only by
+// case. The mailbox sorting first keeps its name, so the names stay the
+// same as long as the folders do.
+func (a *Account) FolderNames(mboxes []*imap.MailboxInfo) map[string]string {
+	sorted := slices.Clone(mboxes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	// Only the first mailbox of each use is renamed by
+	// --normalize-folders.
+	a.uses = make(map[string]string)
+	taken := make(map[string]bool)
+	for _, mbox := range sorted {
+		if use := SpecialUse(mbox); use != "" && !taken[use] {
+			a.uses[mbox.Name] = use
+			taken[use] = true
+		}
+	}
+	names := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, mbox := range sorted {
+		name := a.baseFolder(mbox.Name)
+		if *windowsNames {
+			name = WindowsFolder(name)
+		}
+		name = SafeFolder(name)
+		if key := strings.ToLower(name); seen[key] {
+			name = fmt.Sprintf("%s~%08x", name, crc32.ChecksumIEEE([]byte(mbox.Name)))
+		} else {
+			seen[key] = true
+		}
+		names[mbox.Name] = name
+	}
+	return names
+}
+
+// SafeFolder keeps a folder name from the server from leaving the output
+// directory: empty, "." and ".." parts get an underscore.
+func SafeFolder(folder string) string {
+	parts := strings.Split(folder, "/")
+	for i, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			parts[i] = "_" + p
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// LocalPath joins a name of the backup to the output directory. Names
+// that would end up outside of it are refused.
+func LocalPath(dir, name string) (string, error) {
+	rel := filepath.FromSlash(name)
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("refusing to write '%s' outside of %s", name, dir)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// Folder returns the folder name of a listed mailbox.
+func (a *Account) Folder(mbox string) string {
+	if name, ok := a.folders[mbox]; ok {
+		return name
+	}
+	return a.baseFolder(mbox)
+}
+
+// baseFolder returns the folder name of a mailbox before renaming for
+// case.
+func (a *Account) baseFolder(mbox string) string {
+	if name := specialUseNames[a.uses[mbox]]; *normalizeFolders && name != "" {
+		return a.MapFolder(name)
+	}
+	return a.MapFolder(FolderName(mbox))
+}
+
+// Renamed returns the mailboxes whose folder names had to be changed
+// because of their case or for Windows, by folder name.
+func (a *Account) Renamed() map[string]string {
+	var renamed map[string]string
+	for mbox, name := range a.folders {
+		if name != a.baseFolder(mbox) {
+			if renamed == nil {
+				renamed = make(map[string]string)
+			}
+			renamed[name] = mbox
+		}
+	}
+	return renamed
+}
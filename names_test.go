@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// listed returns the mailboxes as found by LIST.
+func listed(names ...string) []*imap.MailboxInfo {
+	var mboxes []*imap.MailboxInfo
+	for _, name := range names {
+		mboxes = append(mboxes, &imap.MailboxInfo{Name: name, Delim: "/"})
+	}
+	return mboxes
+}
+
+func TestFolderNamesCase(t *testing.T) {
+	mboxes := listed("INBOX", "INBOX/work", "INBOX/Work", "Archive/2024", "archive/2024")
+	a := &Account{}
+	names := a.FolderNames(mboxes)
+	want := map[string]string{
+		"INBOX":        "INBOX",
+		"INBOX/Work":   "Work",
+		"INBOX/work":   fmt.Sprintf("work~%08x", crc32.ChecksumIEEE([]byte("INBOX/work"))),
+		"Archive/2024": "Archive/2024",
+		"archive/2024": fmt.Sprintf("archive/2024~%08x", crc32.ChecksumIEEE([]byte("archive/2024"))),
+	}
+	for mbox, name := range want {
+		if names[mbox] != name {
+			t.Errorf("folder of %q = %q, want %q", mbox, names[mbox], name)
+		}
+	}
+
+	// The names do not depend on the order of the LIST responses.
+	reversed := make([]*imap.MailboxInfo, len(mboxes))
+	for i, mbox := range mboxes {
+		reversed[len(mboxes)-1-i] = mbox
+	}
+	for mbox, name := range a.FolderNames(reversed) {
+		if names[mbox] != name {
+			t.Errorf("folder of %q is %q in reverse order, %q before", mbox, name, names[mbox])
+		}
+	}
+}
+
+func TestFolderNamesMap(t *testing.T) {
+	a := &Account{Map: map[string]string{"Sent Items": "Sent", "Old": "Archive/Old"}}
+	names := a.FolderNames(listed("Sent Items", "Old/2019", "Sent", "Drafts"))
+	want := map[string]string{
+		"Old/2019": "Archive/Old/2019",
+		"Drafts":   "Drafts",
+		// Mapped onto an existing folder, the mailbox sorting last is
+		// renamed.
+		"Sent":       "Sent",
+		"Sent Items": fmt.Sprintf("Sent~%08x", crc32.ChecksumIEEE([]byte("Sent Items"))),
+	}
+	for mbox, name := range want {
+		if names[mbox] != name {
+			t.Errorf("folder of %q = %q, want %q", mbox, names[mbox], name)
+		}
+	}
+}
+
+func TestFolderNamesSpecialUse(t *testing.T) {
+	defer func(v bool) { *normalizeFolders = v }(*normalizeFolders)
+	*normalizeFolders = true
+	mboxes := listed("INBOX", "INBOX/Gesendet", "Papierkorb", "Sent")
+	mboxes[1].Attrs = imap.FlagSet{`\Sent`: true}
+	mboxes[2].Attrs = imap.FlagSet{`\Trash`: true}
+	names := (&Account{}).FolderNames(mboxes)
+	want := map[string]string{
+		"INBOX":          "INBOX",
+		"INBOX/Gesendet": "Sent",
+		"Papierkorb":     "Trash",
+		// The special-use folder sorts first and takes the name.
+		"Sent": fmt.Sprintf("Sent~%08x", crc32.ChecksumIEEE([]byte("Sent"))),
+	}
+	for mbox, name := range want {
+		if names[mbox] != name {
+			t.Errorf("folder of %q = %q, want %q", mbox, names[mbox], name)
+		}
+	}
+}
+
+func TestFolderNamesEscape(t *testing.T) {
+	defer func(v bool) { *windowsNames = v }(*windowsNames)
+	for windows, want := range map[bool]map[string]string{
+		false: {"../../etc": "_../_../etc", "/abs": "_/abs", "a//b": "a/_/b"},
+		true:  {"../../etc": "_/_/etc", "Notes: a?": "Notes_ a_", "CON": "_CON"},
+	} {
+		*windowsNames = windows
+		a := &Account{}
+		var mboxes []string
+		for mbox := range want {
+			mboxes = append(mboxes, mbox)
+		}
+		names := a.FolderNames(listed(mboxes...))
+		for mbox, name := range want {
+			if names[mbox] != name {
+				t.Errorf("folder of %q with windows names %v = %q, want %q", mbox, windows, names[mbox], name)
+			}
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	if _, err := LocalPath("out", "a/../b"); err != nil {
+		t.Errorf("LocalPath(a/../b): %v", err)
+	}
+	for _, name := range []string{"../x", "a/../../x", "/etc/passwd", ""} {
+		if path, err := LocalPath("out", name); err == nil {
+			t.Errorf("LocalPath(%q) = %q, want an error", name, path)
+		}
+	}
+}
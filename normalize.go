@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"strings"
+)
+
+// Normalized hashing: servers store the same message differently, with
+// LF or CRLF line endings, and some add headers of their own, such as the
+// X-UID and X-Keywords of Dovecot or the Status of mbox based servers.
+// With --normalize-hash, messages are hashed in a canonical form, CRLF
+// line endings and without these headers, so that a message fetched from
+// two providers is the same message to merge. The objects of a --repo are
+// still named after the bytes received from the server, which are what
+// is stored; snapshots record the normalized hash next to it. Encrypted
+// bodies are hashed as they are.
+
+var normalizeHash = flag.Bool("normalize-hash", false, "Hash messages with canonical line endings and without server-added headers, to deduplicate them across providers")
+
+// transientHeaders are added by servers and mail clients, they are not
+// part of the message as sent.
+var transientHeaders = map[string]bool{
+	"x-uid":             true,
+	"x-keywords":        true,
+	"x-status":          true,
+	"status":            true,
+	"x-imap":            true,
+	"x-imapbase":        true,
+	"x-mozilla-status":  true,
+	"x-mozilla-status2": true,
+	"x-mozilla-keys":    true,
+	"content-length":    true,
+	"lines":             true,
+}
+
+// BodyHash returns the hex SHA-256 of a message, normalized with
+// --normalize-hash.
+func BodyHash(body []byte) string {
+	if *normalizeHash && !IsEncrypted(body) {
+		body = NormalizeBody(body)
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeBody returns a message with CRLF line endings and without the
+// transient headers.
+func NormalizeBody(body []byte) []byte {
+	out := make([]byte, 0, len(body)+len(body)/32)
+	inHeader, skipping := true, false
+	for len(body) > 0 {
+		line := body
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line, body = body[:i], body[i+1:]
+		} else {
+			body = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if inHeader {
+			switch {
+			case len(line) == 0:
+				inHeader, skipping = false, false
+			case line[0] == ' ' || line[0] == '\t':
+				// A continuation of the previous field.
+				if skipping {
+					continue
+				}
+			default:
+				name, _, _ := bytes.Cut(line, []byte(":"))
+				if skipping = transientHeaders[strings.ToLower(string(bytes.TrimSpace(name)))]; skipping {
+					continue
+				}
+			}
+		}
+		out = append(out, line...)
+		out = append(out, '\r', '\n')
+	}
+	return out
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestNormalizeBody(t *testing.T) {
+	for body, want := range map[string]string{
+		"Subject: a\r\n\r\nbody\r\n": "Subject: a\r\n\r\nbody\r\n",
+		"Subject: a\n\nbody\n":       "Subject: a\r\n\r\nbody\r\n",
+		"Subject: a\n\nbody":         "Subject: a\r\n\r\nbody\r\n",
+		"X-UID: 12\nSubject: a\nX-Keywords: $Forwarded\n  Junk\nStatus: RO\n\nbody\n":                "Subject: a\r\n\r\nbody\r\n",
+		"X-Mozilla-Status: 0001\r\nX-Mozilla-Status2: 00000000\r\nFrom: a@example.com\r\n\r\nhi\r\n": "From: a@example.com\r\n\r\nhi\r\n",
+		"Subject: a\n b\nX-UID: 1\n\n": "Subject: a\r\n b\r\n\r\n",
+		// Only header fields are removed.
+		"Subject: a\n\nStatus: RO\nX-UID: 1\n": "Subject: a\r\n\r\nStatus: RO\r\nX-UID: 1\r\n",
+	} {
+		if got := string(NormalizeBody([]byte(body))); got != want {
+			t.Errorf("NormalizeBody(%q) = %q, want %q", body, got, want)
+		}
+	}
+}
+
+func TestBodyHash(t *testing.T) {
+	defer func(v bool) { *normalizeHash = v }(*normalizeHash)
+	a := []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	b := []byte("X-UID: 5\nFrom: a@example.com\nSubject: hi\nStatus: RO\n\nbody\n")
+
+	*normalizeHash = false
+	if BodyHash(a) == BodyHash(b) {
+		t.Error("raw hashes of different bodies are equal")
+	}
+	raw := BodyHash(a)
+
+	*normalizeHash = true
+	if BodyHash(a) != raw || BodyHash(b) != raw {
+		t.Errorf("normalized hashes %s, %s, want %s", BodyHash(a), BodyHash(b), raw)
+	}
+	// Encrypted bodies are hashed as they are, never normalized.
+	encrypted := []byte{0x85, 0x01, 0x0c, 0x03, '\n'}
+	*normalizeHash = false
+	want := BodyHash(encrypted)
+	*normalizeHash = true
+	if got := BodyHash(encrypted); got != want {
+		t.Errorf("BodyHash(encrypted) = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Run summaries, optionally posted to a webhook or mailed when done.
+
+var (
+	notifyURL   = flag.String("notify-url", "", "URL to POST the JSON run summary to when done")
+	notifyEmail = flag.String("notify-email", "", "Address to mail the run summary to when done")
+	sendmail    = flag.String("sendmail", "/usr/sbin/sendmail", "Sendmail binary used by --notify-email")
+	reportFile  = flag.String("report", "", "File to write the JSON run summary to when done")
+)
+
+type Summary struct {
+	Status   string           `json:"status"`
+	Host     string           `json:"host"`
+	Start    time.Time        `json:"start"`
+	End      time.Time        `json:"end"`
+	Accounts []AccountSummary `json:"accounts"`
+}
+
+type AccountSummary struct {
+	User   string `json:"user"`
+	Output string `json:"output"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Stats
+
+	// Incomplete are the folders that were not fully backed up.
+	Incomplete []string `json:"incomplete_folders,omitempty"`
+}
+
+// Notify sends the summary to the configured destinations. Failures are
+// only logged, they must not hide the outcome of the backup itself.
+func Notify(s *Summary) {
+	if *notifyURL == "" && *notifyEmail == "" && *reportFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Printf("notification failed: %s", err)
+		return
+	}
+	if *reportFile != "" {
+		if err := os.WriteFile(*reportFile, data, 0600); err != nil {
+			log.Printf("could not write report: %s", err)
+		}
+	}
+	if *notifyURL != "" {
+		if err := notifyWebhook(*notifyURL, data); err != nil {
+			log.Printf("notification to %s failed: %s", *notifyURL, err)
+		}
+	}
+	if *notifyEmail != "" {
+		if err := notifyMail(*notifyEmail, s, data); err != nil {
+			log.Printf("notification to %s failed: %s", *notifyEmail, err)
+		}
+	}
+}
+
+func notifyWebhook(url string, data []byte) error {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return nil
+}
+
+func notifyMail(to string, s *Summary, data []byte) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: backupimap on %s: %s\r\n", s.Host, s.Status)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, a := range s.Accounts {
+		fmt.Fprintf(&msg, "%s: %s, %d messages, %d bytes, %d errors, %d skipped\r\n", a.User, a.Status, a.Messages, a.Bytes, a.Errors, a.Skipped)
+		if a.Error != "" {
+			fmt.Fprintf(&msg, "  %s\r\n", a.Error)
+		}
+		if len(a.Incomplete) > 0 {
+			fmt.Fprintf(&msg, "  not fully backed up: %s\r\n", strings.Join(a.Incomplete, ", "))
+		}
+	}
+	fmt.Fprintf(&msg, "\r\n%s\r\n", data)
+
+	cmd := exec.Command(*sendmail, "-t", "-i")
+	cmd.Stdin = strings.NewReader(msg.String())
+	return cmd.Run()
+}
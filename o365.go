@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Office 365 authentication using the Azure AD device code flow. The
+// client IDs of other applications must not be reused, so users need to
+// register their own in the Azure portal, as a public client with the
+// IMAP.AccessAsUser.All permission of Office 365 Exchange Online, and
+// pass its application ID with --o365-client-id.
+
+var (
+	o365Tenant   = flag.String("o365-tenant", "common", "Azure AD tenant for --auth=o365-device")
+	o365ClientID = flag.String("o365-client-id", "", "Azure AD application ID for --auth=o365-device, of an application you registered")
+)
+
+var errNoO365Client = errors.New("you must specify --o365-client-id, the application ID of an app registered in Azure AD")
+
+const o365Scope = "https://outlook.office.com/IMAP.AccessAsUser.All offline_access"
+
+type deviceCodeResponse struct {
+	DeviceCode string `json:"device_code"`
+	Message    string `json:"message"`
+	ExpiresIn  int    `json:"expires_in"`
+	Interval   int    `json:"interval"`
+	tokenResponse
+}
+
+func o365Endpoint(name string) string {
+	return "https://login.microsoftonline.com/" + url.PathEscape(*o365Tenant) + "/oauth2/v2.0/" + name
+}
+
+// O365Token returns a valid access token for user, refreshing the cached
+// one or running the device code flow as needed.
+func O365Token(user string) (string, error) {
+	// Connections are established concurrently, make sure the user
+	// only has to go through the device flow once.
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+
+	path := TokenPath("o365", user)
+	t, err := LoadToken(path)
+	if err == nil && t.Valid() {
+		return t.AccessToken, nil
+	}
+	if *o365ClientID == "" {
+		return "", errNoO365Client
+	}
+	if err == nil && t.RefreshToken != "" {
+		form := url.Values{"client_id": {*o365ClientID}, "scope": {o365Scope}}
+		if t, err = RefreshToken(o365Endpoint("token"), form, t); err == nil {
+			CacheToken(path, t)
+			return t.AccessToken, nil
+		}
+		log.Printf("could not refresh Office 365 token: %s", err)
+	}
+
+	log.Printf("authorizing Office 365 access for %s", user)
+	t, err = O365DeviceFlow()
+	if err != nil {
+		return "", fmt.Errorf("Office 365 authentication failed: %s", err)
+	}
+	CacheToken(path, t)
+	return t.AccessToken, nil
+}
+
+// O365DeviceFlow asks the user to authorize the application on another
+// device and waits until they do.
+func O365DeviceFlow() (*Token, error) {
+	if *o365ClientID == "" {
+		return nil, errNoO365Client
+	}
+	var dc deviceCodeResponse
+	form := url.Values{"client_id": {*o365ClientID}, "scope": {o365Scope}}
+	if err := PostForm(o365Endpoint("devicecode"), form, &dc); err != nil {
+		return nil, err
+	}
+	if err := dc.Err(); err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr, dc.Message)
+
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second)
+	form = url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"client_id":   {*o365ClientID},
+		"device_code": {dc.DeviceCode},
+	}
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		var r tokenResponse
+		if err := PostForm(o365Endpoint("token"), form, &r); err != nil {
+			return nil, err
+		}
+		switch r.Error {
+		case "":
+			return r.Token(nil), nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, r.Err()
+		}
+	}
+	return nil, fmt.Errorf("device code expired")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// tokenLock serializes token refreshes: connections are established
+// concurrently, but the user should only be asked to log in once.
+var tokenLock sync.Mutex
+
+// Token is an OAuth2 access token as cached in the state directory.
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// Valid reports whether the token can still be used for a while.
+func (t *Token) Valid() bool {
+	return t.AccessToken != "" && time.Now().Add(5*time.Minute).Before(t.Expiry)
+}
+
+// tokenResponse is the JSON reply of an OAuth2 token endpoint.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (r *tokenResponse) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	if r.ErrorDescription != "" {
+		return fmt.Errorf("%s: %s", r.Error, r.ErrorDescription)
+	}
+	return errors.New(r.Error)
+}
+
+// Token converts the response into a Token. Servers do not always
+// rotate refresh tokens, so the old one is kept if none was returned.
+func (r *tokenResponse) Token(old *Token) *Token {
+	t := &Token{
+		AccessToken:  r.AccessToken,
+		RefreshToken: r.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(r.ExpiresIn) * time.Second),
+	}
+	if t.RefreshToken == "" && old != nil {
+		t.RefreshToken = old.RefreshToken
+	}
+	return t
+}
+
+// PostForm sends a form to an OAuth2 endpoint and decodes the JSON reply
+// into v. Error replies are decoded as well, callers must inspect them.
+func PostForm(endpoint string, form url.Values, v interface{}) error {
+	resp, err := http.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// RefreshToken obtains a new access token using the refresh token of t.
+func RefreshToken(endpoint string, form url.Values, t *Token) (*Token, error) {
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", t.RefreshToken)
+	var r tokenResponse
+	if err := PostForm(endpoint, form, &r); err != nil {
+		return nil, err
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return r.Token(t), nil
+}
+
+func defaultStateDir() string {
+	// Set by systemd for services with StateDirectory=.
+	if dir, _, _ := strings.Cut(os.Getenv("STATE_DIRECTORY"), ":"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".backupimap"
+	}
+	return filepath.Join(home, ".backupimap")
+}
+
+// StatePath returns the path of a file in the state directory, creating
+// the directory if necessary.
+func StatePath(name string) string {
+	if err := os.MkdirAll(*stateDir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	return filepath.Join(*stateDir, name)
+}
+
+// TokenPath returns the token cache file for the given provider and user.
+func TokenPath(provider, user string) string {
+	return StatePath(fmt.Sprintf("%s-%s.token", provider, strings.Replace(user, "/", "_", -1)))
+}
+
+func LoadToken(path string) (*Token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t Token
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func SaveToken(path string, t *Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// CacheToken saves t, logging rather than failing on errors since the
+// token is still usable for the current run.
+func CacheToken(path string, t *Token) {
+	if err := SaveToken(path, t); err != nil {
+		log.Printf("could not cache token: %s", err)
+	}
+}
+
+// xoauth2 implements the XOAUTH2 SASL mechanism used by Gmail and
+// Office 365.
+type xoauth2 struct {
+	user, token string
+}
+
+func XOAuth2(user, token string) imap.SASL {
+	return &xoauth2{user, token}
+}
+
+func (a *xoauth2) Start(s *imap.ServerInfo) (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.user + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2) Next(challenge []byte) ([]byte, error) {
+	// On failure the server sends a JSON error as a challenge and
+	// expects an empty response before completing the command with NO.
+	log.Printf("XOAUTH2 error: %s", challenge)
+	return []byte{}, nil
+}
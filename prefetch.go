@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Header prefetch: with --prefetch-headers the lister first fetches the
+// UID, size and Message-ID of every message of the folders to back up.
+// No bodies are transferred, so this is fast even for large accounts. The
+// index is kept in the account state, and later runs only fetch the
+// messages added since. Before any body is downloaded the run knows
+// exactly which messages and how many bytes it still has to download,
+// after an interrupted run or an incremental one as well, and folders are
+// scheduled by that.
+//
+// With --skip-duplicates, a message whose Message-ID was already found in
+// an earlier folder, INBOX first and then by name, is not downloaded
+// again. It is listed as skipped in the manifest. Messages without a
+// Message-ID are always downloaded.
+
+var (
+	prefetchHeaders = flag.Bool("prefetch-headers", false, "Fetch the size and Message-ID of all messages first, to plan the run")
+	skipDuplicates  = flag.Bool("skip-duplicates", false, "Skip messages whose Message-ID is found in an earlier folder, implies --prefetch-headers")
+)
+
+// FolderIndex lists the messages of a folder found by the prefetch.
+type FolderIndex struct {
+	UIDValidity uint32                 `json:"uidvalidity"`
+	Messages    map[uint32]*IndexEntry `json:"messages"`
+}
+
+type IndexEntry struct {
+	MessageID string `json:"message_id,omitempty"`
+	Size      uint32 `json:"size"`
+}
+
+// Prefetch indexes the folders of the queued jobs and plans the run. It
+// returns the jobs ordered by the bytes left to download.
+func (a *Account) Prefetch(c *imap.Client, queue []*Job) []*Job {
+	start := time.Now()
+	if a.state.Index == nil {
+		a.state.Index = make(map[string]*FolderIndex)
+	}
+	var folders []string
+	todo := make(map[string][]uint32)
+	for _, job := range queue {
+		mbox := job.Mailbox
+		if mbox.Attrs[`\Noselect`] || a.Excluded(mbox) {
+			continue
+		}
+		name := a.Folder(mbox.Name)
+		c.Select(mbox.Name, true)
+		if c.Mailbox == nil {
+			// The downloader reports the error.
+			continue
+		}
+		idx, err := a.IndexFolder(c, name)
+		if err != nil {
+			log.Printf("%s: could not index %s: %s", a.Username, name, err)
+			continue
+		}
+		folders = append(folders, name)
+		todo[name] = a.ToDownload(name, idx)
+	}
+	a.state.PruneIndex(folders)
+
+	// INBOX holds the copy that is kept, then folders by name.
+	sort.Slice(folders, func(i, j int) bool {
+		if (folders[i] == "INBOX") != (folders[j] == "INBOX") {
+			return folders[i] == "INBOX"
+		}
+		return folders[i] < folders[j]
+	})
+	a.duplicates = make(map[string]map[uint32]string)
+	seen := make(map[string]string)
+	size := make(map[string]uint64)
+	var messages, octets, dups uint64
+	for _, name := range folders {
+		idx := a.state.Index[name]
+		uids := make([]uint32, 0, len(idx.Messages))
+		for uid := range idx.Messages {
+			uids = append(uids, uid)
+		}
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		for _, uid := range uids {
+			id := idx.Messages[uid].MessageID
+			if id == "" {
+				continue
+			}
+			if first, ok := seen[id]; ok && *skipDuplicates {
+				if a.duplicates[name] == nil {
+					a.duplicates[name] = make(map[uint32]string)
+				}
+				a.duplicates[name][uid] = first
+			} else if !ok {
+				seen[id] = name
+			}
+		}
+		for _, uid := range todo[name] {
+			if _, dup := a.duplicates[name][uid]; dup {
+				dups++
+				continue
+			}
+			messages++
+			size[name] += uint64(idx.Messages[uid].Size)
+		}
+		octets += size[name]
+	}
+	atomic.StoreInt64(&a.Stats.PlannedMessages, int64(messages))
+	atomic.StoreInt64(&a.Stats.PlannedBytes, int64(octets))
+	log.Printf("%s: indexed %d folders in %s, %d messages (%d MB) to download, %d duplicates skipped",
+		a.Username, len(folders), time.Since(start).Round(time.Second), messages, octets>>20, dups)
+	if err := a.state.Save(a.Username); err != nil {
+		log.Printf("%s: could not save the index: %s", a.Username, err)
+	}
+
+	sort.SliceStable(queue, func(i, j int) bool {
+		return size[a.Folder(queue[i].Mailbox.Name)] > size[a.Folder(queue[j].Mailbox.Name)]
+	})
+	return queue
+}
+
+// IndexFolder brings the index of the selected mailbox up to date:
+// expunged messages are dropped and new ones fetched.
+func (a *Account) IndexFolder(c *imap.Client, name string) (*FolderIndex, error) {
+	idx := a.state.Index[name]
+	if idx == nil || idx.UIDValidity != c.Mailbox.UIDValidity {
+		idx = &FolderIndex{UIDValidity: c.Mailbox.UIDValidity, Messages: make(map[uint32]*IndexEntry)}
+	}
+	var uids []uint32
+	var err error
+	if c.Mailbox.Messages > 0 {
+		if uids, err = SearchUIDs(c, 1); err != nil {
+			return nil, err
+		}
+	}
+	present := make(map[uint32]bool)
+	var missing []uint32
+	for _, uid := range uids {
+		present[uid] = true
+		if idx.Messages[uid] == nil {
+			missing = append(missing, uid)
+		}
+	}
+	for uid := range idx.Messages {
+		if !present[uid] {
+			delete(idx.Messages, uid)
+		}
+	}
+	const header = "BODY[HEADER.FIELDS (MESSAGE-ID)]"
+	for len(missing) > 0 {
+		n := min(len(missing), *fetchBatch)
+		set, _ := imap.NewSeqSet("")
+		set.AddNum(missing[:n]...)
+		missing = missing[n:]
+		cmd, err := Result(c.UIDFetch(set, "RFC822.SIZE", "BODY.PEEK[HEADER.FIELDS (MESSAGE-ID)]"))
+		if err != nil {
+			return nil, err
+		}
+		for _, resp := range cmd.Data {
+			info := resp.MessageInfo()
+			idx.Messages[info.UID] = &IndexEntry{MessageID: MessageID(imap.AsBytes(info.Attrs[header])), Size: info.Size}
+		}
+	}
+	a.state.Index[name] = idx
+	return idx, nil
+}
+
+// ToDownload returns the indexed messages of a folder the run downloads,
+// leaving out those an incremental backup or the interrupted run being
+// resumed already has.
+func (a *Account) ToDownload(name string, idx *FolderIndex) []uint32 {
+	first := uint32(1)
+	if fs := a.state.Folders[name]; *incremental && fs != nil && fs.UIDValidity == idx.UIDValidity {
+		first = fs.LastUID + 1
+	}
+	var done map[uint32]bool
+	if prog := a.progress[name]; prog != nil && prog.UIDValidity == idx.UIDValidity {
+		if prog.Complete {
+			return nil
+		}
+		done = prog.UIDs
+	}
+	var uids []uint32
+	for uid := range idx.Messages {
+		if uid >= first && !done[uid] {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// SkipDuplicates reports the messages of a folder found in an earlier
+// folder as skipped and returns the others.
+func (a *Account) SkipDuplicates(c *imap.Client, name string, uidValidity uint32, uids []uint32) []uint32 {
+	dups := a.duplicates[name]
+	if len(dups) == 0 || a.state.Index[name] == nil || a.state.Index[name].UIDValidity != uidValidity {
+		return uids
+	}
+	rest := uids[:0]
+	skipped := make(map[string][]uint32)
+	for _, uid := range uids {
+		if first, ok := dups[uid]; ok {
+			skipped[first] = append(skipped[first], uid)
+		} else {
+			rest = append(rest, uid)
+		}
+	}
+	for first, list := range skipped {
+		a.Skip(c, name, uidValidity, list, "duplicate of a message in "+first, false)
+	}
+	return rest
+}
+
+// PruneIndex drops the index of folders no longer backed up.
+func (st *State) PruneIndex(folders []string) {
+	keep := make(map[string]bool)
+	for _, name := range folders {
+		keep[name] = true
+	}
+	for name := range st.Index {
+		if !keep[name] {
+			delete(st.Index, name)
+		}
+	}
+}
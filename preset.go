@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Provider presets, so that users of the big providers don't need to
+// research their IMAP settings and quirks.
+
+var preset = flag.String("preset", "", "Provider preset: "+strings.Join(presetNames(), ", "))
+
+type Preset struct {
+	Server string
+	TLS    string
+	Auth   string
+
+	// Exclude lists folders that only duplicate messages found
+	// elsewhere.
+	Exclude []string
+
+	// Connections is the number of concurrent connections the
+	// provider tolerates without throttling, FetchInterval the minimum
+	// time between FETCH commands on each of them.
+	Connections   int
+	FetchInterval time.Duration
+}
+
+var presets = map[string]*Preset{
+	"gmail": {
+		Server: "imap.gmail.com:993",
+		TLS:    "implicit",
+		Auth:   "gmail",
+		// Every message shows up in All Mail, and labels are
+		// exported as folders anyway. The roles also match the
+		// localized names of the folders.
+		Exclude:     []string{"role:all", "role:important", "role:flagged", "[Gmail]/All Mail", "[Gmail]/Important", "[Gmail]/Starred", "[Google Mail]/All Mail", "[Google Mail]/Important", "[Google Mail]/Starred"},
+		Connections: 4,
+	},
+	"office365": {
+		Server:        "outlook.office365.com:993",
+		TLS:           "implicit",
+		Auth:          "o365-device",
+		Connections:   2,
+		FetchInterval: 500 * time.Millisecond,
+	},
+	"fastmail": {
+		Server:      "imap.fastmail.com:993",
+		TLS:         "implicit",
+		Auth:        "login",
+		Connections: 3,
+	},
+	"icloud": {
+		Server:        "imap.mail.me.com:993",
+		TLS:           "implicit",
+		Auth:          "login",
+		Connections:   1,
+		FetchInterval: 2 * time.Second,
+	},
+}
+
+func presetNames() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyPreset fills in the account settings that are neither set in the
+// account itself nor on the command line from the named preset.
+func (a *Account) ApplyPreset(name string) error {
+	p := presets[name]
+	if p == nil {
+		return fmt.Errorf("unknown preset '%s'", name)
+	}
+	if a.Server == "" && *server == "" {
+		a.Server = p.Server
+	}
+	if a.TLS == "" && !IsFlagSet("tls") && !*notls {
+		a.TLS = p.TLS
+	}
+	if a.Auth == "" && !IsFlagSet("auth") {
+		a.Auth = p.Auth
+	}
+	a.Exclude = append(a.Exclude, p.Exclude...)
+	if a.Connections == 0 {
+		a.Connections = p.Connections
+	}
+	a.fetchInterval = max(a.fetchInterval, p.FetchInterval)
+	return nil
+}
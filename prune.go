@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// PruneCommand implements 'prune <backup.zip> [--before date] [--folder
+// pattern]...', which rewrites a ZIP archive without the messages matching
+// all the given conditions. Folder patterns use path.Match syntax, the
+// date is compared with the Date header.
+func PruneCommand(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	before := fs.String("before", "", "Drop messages dated before this day (YYYY-MM-DD)")
+	var folders stringsFlag
+	fs.Var(&folders, "folder", "Drop messages of folders matching this pattern, may be repeated")
+	files, err := ParseCommandFlags(fs, args)
+	if err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(files) != 1 || (*before == "" && len(folders) == 0) {
+		return errors.New("usage: prune <backup.zip> [--before YYYY-MM-DD] [--folder pattern]...")
+	}
+	var cutoff time.Time
+	if *before != "" {
+		if cutoff, err = time.ParseInLocation("2006-01-02", *before, time.Local); err != nil {
+			return fmt.Errorf("--before: expected YYYY-MM-DD")
+		}
+	}
+	for _, pattern := range folders {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("--folder %s: %s", pattern, err)
+		}
+	}
+	return Prune(files[0], cutoff, folders)
+}
+
+// Prune drops the matching messages from a ZIP archive. The archive is
+// replaced only once the new one is complete.
+func Prune(archive string, before time.Time, folders []string) error {
+	if fi, err := os.Stat(archive); err == nil && (fi.IsDir() || path.Ext(archive) == ".json" || path.Ext(archive) == ".zst") {
+		return fmt.Errorf("%s: only ZIP archives can be pruned", archive)
+	}
+	src, err := OpenSource(archive, time.Time{})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	m := src.Manifests[0]
+
+	matches := func(mm *ManifestMessage) (bool, error) {
+		if len(folders) > 0 {
+			found := false
+			for _, pattern := range folders {
+				if ok, _ := path.Match(pattern, mm.Folder); ok {
+					found = true
+				}
+			}
+			if !found {
+				return false, nil
+			}
+		}
+		if before.IsZero() {
+			return true, nil
+		}
+		body, err := src.Read(mm)
+		if err != nil {
+			return false, err
+		}
+		date := MessageDate(body)
+		return date != nil && date.Before(before), nil
+	}
+	drop := make(map[string]bool)
+	kept := m.Messages[:0]
+	for _, mm := range m.Messages {
+		ok, err := matches(mm)
+		if err != nil {
+			return err
+		}
+		if ok {
+			drop[mm.Name] = true
+		} else {
+			kept = append(kept, mm)
+		}
+	}
+	m.Messages = kept
+	if len(drop) == 0 {
+		log.Printf("%s: no messages to prune", archive)
+		return nil
+	}
+
+	src.Close()
+	if err := RewriteZip(archive, m, drop, nil); err != nil {
+		return err
+	}
+	log.Printf("%s: pruned %d messages, %d left", archive, len(drop), len(m.Messages))
+	return nil
+}
+
+// RewriteZip replaces the manifest of a ZIP archive and drops the named
+// entries. The compressed data of the other entries is copied as it is,
+// unless edit is set, which then returns the new content of every entry.
+// The archive is replaced only once the new one is complete, and signed
+// again, see Resign.
+func RewriteZip(archive string, m *Manifest, drop map[string]bool, edit func(name string, data []byte) ([]byte, error)) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tmp := archive + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	zw := zip.NewWriter(f)
+	for _, zf := range zr.File {
+		if drop[zf.Name] || zf.Name == manifestName {
+			continue
+		}
+		if edit != nil {
+			err = editEntry(zw, zf, edit)
+		} else {
+			err = zw.Copy(zf)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	data, err := m.Marshal()
+	if err == nil {
+		var w io.Writer
+		if w, err = zw.Create(manifestName); err == nil {
+			_, err = w.Write(data)
+		}
+	}
+	if err == nil {
+		err = zw.SetComment(archiveMarker())
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	zr.Close()
+	if err := os.Rename(tmp, archive); err != nil {
+		return err
+	}
+	return Resign(archive)
+}
+
+func editEntry(zw *zip.Writer, zf *zip.File, edit func(name string, data []byte) ([]byte, error)) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if data, err = edit(zf.Name, data); err != nil {
+		return err
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: zf.Name, Method: zf.Method, Modified: zf.Modified})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
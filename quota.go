@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Disk space preflight: before a full backup, the storage used by the
+// account according to its quota (RFC 2087) is compared with the free
+// space at the output location.
+
+var force = flag.Bool("force", false, "Start the backup even if the output location seems too small")
+
+// QuotaUsage returns the storage used by the account in bytes, or 0 if
+// the server does not report it.
+func QuotaUsage(c *imap.Client) uint64 {
+	if !c.Caps["QUOTA"] {
+		return 0
+	}
+	cmd, err := Result(c.GetQuotaRoot("INBOX"))
+	if err != nil {
+		return 0
+	}
+	var usage uint64
+	for _, resp := range cmd.Data {
+		if resp.Label != "QUOTA" {
+			continue
+		}
+		_, quota := resp.Quota()
+		for _, q := range quota {
+			if strings.EqualFold(q.Resource, "STORAGE") {
+				// STORAGE is counted in units of 1024 octets.
+				usage += uint64(q.Usage) * 1024
+			}
+		}
+	}
+	return usage
+}
+
+// Preflight checks that the account fits into the output location.
+// Incremental backups of an account backed up before are not checked,
+// they only download the new messages, nor are backups streamed to
+// stdout or stored elsewhere, which have no local output.
+func (a *Account) Preflight(c *imap.Client) error {
+	if *incremental && len(a.state.Folders) > 0 {
+		return nil
+	}
+	if a.Output == "-" || IsS3(a.Output) || *storeCmd != "" {
+		return nil
+	}
+	usage := QuotaUsage(c)
+	if usage == 0 {
+		return nil
+	}
+	dir := existingDir(a.Output)
+	free, err := FreeSpace(dir)
+	if err != nil {
+		log.Printf("%s: could not check free space in %s: %s", a.Username, dir, err)
+		return nil
+	}
+	if usage <= free {
+		return nil
+	}
+	err = fmt.Errorf("the account uses %d MB but only %d MB are free in %s", usage>>20, free>>20, dir)
+	if *force {
+		log.Printf("%s: %s, continuing anyway", a.Username, err)
+		return nil
+	}
+	return fmt.Errorf("%s, use --force to start anyway", err)
+}
+
+// existingDir returns the closest existing directory containing path.
+func existingDir(path string) string {
+	dir := filepath.Dir(path)
+	for {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
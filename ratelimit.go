@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Pacing of FETCH commands, for providers that throttle or lock accounts
+// sending too many of them. A FETCH refused because of throttling is
+// retried after a pause that doubles each time.
+
+var (
+	fetchBatch          = flag.Int("fetch-batch", 500, "Number of messages requested by each FETCH")
+	fetchDelay          = flag.Duration("fetch-delay", 0, "Pause between FETCH commands on a connection")
+	maxFetchesPerMinute = flag.Int("max-fetches-per-minute", 0, "Limit of FETCH commands per minute on a connection")
+	throttleWait        = flag.Duration("throttle-wait", 30*time.Second, "First pause after the server reports throttling")
+	throttleRetries     = flag.Int("throttle-retries", 5, "Retries of a throttled FETCH before giving up")
+)
+
+// throttleCodes are the response codes of servers that are throttling
+// the account.
+var throttleCodes = map[string]bool{
+	"LIMIT":       true, // RFC 5530
+	"UNAVAILABLE": true, // RFC 5530, Gmail's "Temporary System Problem"
+	"THROTTLED":   true,
+}
+
+// throttleHints are found in the text of the responses of servers that
+// send no response code, in lower case.
+var throttleHints = []string{
+	"temporary system problem",
+	"throttl",
+	"try again later",
+	"too many",
+}
+
+// IsThrottled reports whether a command failed because the server is
+// throttling the account.
+func IsThrottled(resp *imap.Response) bool {
+	if resp == nil {
+		return false
+	}
+	if throttleCodes[strings.ToUpper(resp.Label)] {
+		return true
+	}
+	info := strings.ToLower(resp.Info)
+	for _, hint := range throttleHints {
+		if strings.Contains(info, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchInterval is the minimum time between FETCH commands required by
+// the command line flags.
+func FetchInterval() time.Duration {
+	interval := *fetchDelay
+	if *maxFetchesPerMinute > 0 {
+		interval = max(interval, time.Minute/time.Duration(*maxFetchesPerMinute))
+	}
+	return interval
+}
+
+// Pacer enforces a minimum interval between commands on a connection.
+type Pacer struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func NewPacer(interval time.Duration) *Pacer {
+	return &Pacer{interval: interval}
+}
+
+// Wait blocks until the next command may be sent.
+func (p *Pacer) Wait() {
+	if p.interval <= 0 {
+		return
+	}
+	if d := p.interval - time.Since(p.last); d > 0 {
+		time.Sleep(d)
+	}
+	p.last = time.Now()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RekeyCommand implements 'rekey <backup>...', which re-encrypts the
+// messages of backups made with --gpg-recipient to the keys now given
+// with --gpg-recipient, for instance after adding a key or retiring a
+// compromised one. The secret key of the old recipients must be in the
+// gpg keyring. Nothing is downloaded again: ZIP archives, directory
+// outputs and the snapshot directory of an account in a --repo are
+// rewritten in place. ZIP archives are signed again, see Resign; the
+// seals of directories and snapshots are not updated.
+func RekeyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: rekey <backup>...")
+	}
+	if len(gpgRecipients) == 0 {
+		return errors.New("rekey needs the new keys as --gpg-recipient")
+	}
+	for _, path := range args {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir() && isSnapshotDir(path):
+			err = rekeySnapshots(path)
+		case fi.IsDir():
+			err = rekeyDir(path)
+		case strings.HasSuffix(path, ".json"):
+			err = fmt.Errorf("%s: rekey the directory of the account's snapshots, whose objects it shares", path)
+		case strings.HasSuffix(path, ".zst"):
+			err = fmt.Errorf("%s: decompress the archive with zstd -d to rekey it", path)
+		default:
+			err = rekeyZip(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rekey decrypts a message body and encrypts it to the --gpg-recipient
+// keys.
+func Rekey(body []byte) ([]byte, error) {
+	plain, err := Decrypt(body)
+	if err != nil {
+		return nil, err
+	}
+	return Encrypt(plain)
+}
+
+func rekeyZip(archive string) error {
+	src, err := openZip(archive)
+	if err != nil {
+		return err
+	}
+	m := src.Manifests[0]
+	src.Close()
+	if len(m.EncryptedTo) == 0 {
+		log.Printf("%s: not encrypted", archive)
+		return nil
+	}
+	n := 0
+	m.EncryptedTo = gpgRecipients
+	err = RewriteZip(archive, m, nil, func(name string, data []byte) ([]byte, error) {
+		if !IsEncrypted(data) {
+			return data, nil
+		}
+		n++
+		data, err := Rekey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: re-encrypted %d messages", archive, n)
+	return nil
+}
+
+// rekeyDir re-encrypts every encrypted message file of a directory
+// output, whatever its name after flag changes, and the archives of a
+// --per-folder-output directory.
+func rekeyDir(dir string) error {
+	n := 0
+	var manifests []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".json":
+			if strings.HasPrefix(d.Name(), "manifest-") {
+				manifests = append(manifests, path)
+			}
+			return nil
+		case ".zip":
+			return rekeyZip(path)
+		case ".zst":
+			return fmt.Errorf("%s: decompress the archive with zstd -d to rekey it", path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		body := data
+		dbox := strings.Contains(filepath.ToSlash(path), "/dbox-Mails/")
+		if dbox {
+			if body, err = DboxBody(data); err != nil {
+				return nil
+			}
+		}
+		if !IsEncrypted(body) {
+			return nil
+		}
+		if body, err = Rekey(body); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if dbox {
+			if body, err = DboxReplaceBody(data, body); err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+		}
+		n++
+		return replaceFile(path, body)
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range manifests {
+		if err := rekeyManifest(file); err != nil {
+			return err
+		}
+	}
+	log.Printf("%s: re-encrypted %d messages", dir, n)
+	return nil
+}
+
+// replaceFile writes a file through a temporary file, keeping its
+// modification time, which Maildir and EML outputs set to the date of
+// the message.
+func replaceFile(path string, data []byte) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	os.Chtimes(path+".tmp", fi.ModTime(), fi.ModTime())
+	return os.Rename(path+".tmp", path)
+}
+
+// rekeyManifest records the new keys in the manifest of an encrypted
+// run.
+func rekeyManifest(file string) error {
+	m, err := LoadSnapshot(file)
+	if err != nil {
+		return err
+	}
+	if len(m.EncryptedTo) == 0 {
+		return nil
+	}
+	m.EncryptedTo = gpgRecipients
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	return replaceFile(file, data)
+}
+
+// rekeySnapshots re-encrypts the objects of all snapshots of an account.
+// The new objects have new hashes, so every snapshot is rewritten. Old
+// objects are removed once no snapshot of any account in the repository
+// refers to them.
+func rekeySnapshots(dir string) error {
+	repoDir := filepath.Dir(filepath.Dir(dir))
+	snapshots, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	store := &RepoWriter{dir: repoDir}
+	rekeyed := make(map[string]string)
+	for _, file := range snapshots {
+		m, err := LoadSnapshot(file)
+		if err != nil {
+			return err
+		}
+		for _, list := range [][]*ManifestMessage{m.Messages, m.FlagUpdates, m.Tombstones} {
+			for _, mm := range list {
+				if mm.Hash == "" {
+					continue
+				}
+				if hash, ok := rekeyed[mm.Hash]; ok {
+					mm.Hash = hash
+					continue
+				}
+				body, err := ReadObject(repoDir, mm.Hash)
+				if err != nil {
+					return err
+				}
+				hash := mm.Hash
+				if IsEncrypted(body) {
+					if body, err = Rekey(body); err != nil {
+						return fmt.Errorf("%s: %s", ObjectPath(repoDir, mm.Hash), err)
+					}
+					sum := sha256.Sum256(body)
+					hash = hex.EncodeToString(sum[:])
+					if err := store.writeObject(hash, body); err != nil {
+						return err
+					}
+				}
+				rekeyed[mm.Hash] = hash
+				mm.Hash = hash
+			}
+		}
+		if len(m.EncryptedTo) > 0 {
+			m.EncryptedTo = gpgRecipients
+		}
+		data, err := m.Marshal()
+		if err != nil {
+			return err
+		}
+		if err := replaceFile(file, data); err != nil {
+			return err
+		}
+	}
+
+	used, err := repoObjects(repoDir)
+	if err != nil {
+		return err
+	}
+	n, removed := 0, 0
+	for old, hash := range rekeyed {
+		if old == hash {
+			continue
+		}
+		n++
+		if !used[old] && os.Remove(ObjectPath(repoDir, old)) == nil {
+			removed++
+		}
+	}
+	log.Printf("%s: re-encrypted %d messages, removed %d old objects", dir, n, removed)
+	return nil
+}
+
+// repoObjects returns the hashes referred to by the snapshots of all
+// accounts in a repository.
+func repoObjects(dir string) (map[string]bool, error) {
+	snapshots, err := filepath.Glob(filepath.Join(dir, "snapshots", "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, file := range snapshots {
+		m, err := LoadSnapshot(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, list := range [][]*ManifestMessage{m.Messages, m.FlagUpdates, m.Tombstones} {
+			for _, mm := range list {
+				used[mm.Hash] = true
+			}
+		}
+	}
+	return used, nil
+}
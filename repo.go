@@ -0,0 +1,253 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Content-addressed repository: message bodies are stored once under their
+// SHA-256 hash in objects/, and each run only writes a snapshot listing the
+// messages of the account with the hashes of their bodies. Unchanged mail
+// therefore costs no space in later backups.
+//
+// Layout:
+//
+//	objects/ab/ab12...   gzip compressed message bodies
+//	snapshots/<user>/<timestamp>.json
+//
+// With --incremental, a snapshot starts from the previous one, so that it
+// still lists all messages of the account.
+
+var repo = flag.String("repo", "", "Store messages in a content-addressed repository instead of per-run archives")
+
+// snapshotTime is the format of the snapshot file names.
+const snapshotTime = "20060102T150405Z"
+
+type RepoWriter struct {
+	Manifest *Manifest
+
+	dir      string
+	snapshot string
+	messages map[string]*ManifestMessage
+}
+
+// SnapshotDir returns the directory holding the snapshots of an account.
+func SnapshotDir(dir, user string) string {
+	return filepath.Join(dir, "snapshots", strings.Replace(user, "/", "_", -1))
+}
+
+// ObjectPath returns the file storing the body with the given hash.
+func ObjectPath(dir, hash string) string {
+	return filepath.Join(dir, "objects", hash[:2], hash)
+}
+
+// ReadObject returns the body with the given hash.
+func ReadObject(dir, hash string) ([]byte, error) {
+	f, err := os.Open(ObjectPath(dir, hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+func messageKey(folder string, uidValidity, uid uint32) string {
+	return fmt.Sprintf("%s\x00%d\x00%d", folder, uidValidity, uid)
+}
+
+func NewRepoWriter(dir, snapshot string, m *Manifest) (*RepoWriter, error) {
+	if err := os.MkdirAll(snapshot, 0700); err != nil {
+		return nil, err
+	}
+	w := &RepoWriter{Manifest: m, dir: dir, snapshot: snapshot, messages: make(map[string]*ManifestMessage)}
+	if !*incremental {
+		return w, nil
+	}
+	last, err := LatestSnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		for _, mm := range last.Messages {
+			w.messages[messageKey(mm.Folder, mm.UIDValidity, mm.UID)] = mm
+		}
+	}
+	return w, nil
+}
+
+// LatestSnapshot reads the most recent snapshot in dir, or returns nil
+// if there is none.
+func LatestSnapshot(dir string) (*Manifest, error) {
+	path, err := SnapshotAsOf(dir, time.Time{})
+	if err != nil || path == "" {
+		return nil, err
+	}
+	return LoadSnapshot(path)
+}
+
+// SnapshotAsOf returns the last snapshot in dir taken no later than t,
+// or the most recent one if t is zero. It returns "" if there is none.
+func SnapshotAsOf(dir string, t time.Time) (string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+	for i := len(names) - 1; i >= 0; i-- {
+		taken, err := time.Parse(snapshotTime, strings.TrimSuffix(filepath.Base(names[i]), ".json"))
+		if err != nil {
+			continue
+		}
+		if t.IsZero() || !taken.After(t) {
+			return names[i], nil
+		}
+	}
+	return "", nil
+}
+
+func LoadSnapshot(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(path, data)
+}
+
+// Add stores the body unless the repository already has it.
+func (w *RepoWriter) Add(name string, msg *Message) error {
+	sum := sha256.Sum256(msg.Body)
+	hash := hex.EncodeToString(sum[:])
+	if err := w.writeObject(hash, msg.Body); err != nil {
+		return err
+	}
+	mm := &ManifestMessage{
+		Name:        name,
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Flags:       msg.Flags,
+		Hash:        hash,
+
+		InternalDate: msg.InternalDate,
+		RFC822Size:   msg.Size,
+		ThreadID:     msg.ThreadID,
+		MessageID:    msg.MessageID,
+	}
+	if *normalizeHash {
+		mm.NormalizedHash = BodyHash(msg.Body)
+	}
+	w.messages[messageKey(msg.Folder, msg.UIDValidity, msg.UID)] = mm
+	return nil
+}
+
+func (w *RepoWriter) writeObject(hash string, body []byte) error {
+	path := ObjectPath(w.dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Several accounts may store the same object at once, each writes
+	// its own temporary file.
+	f, err := os.CreateTemp(filepath.Dir(path), "tmp-")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	_, err = zw.Write(body)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (w *RepoWriter) UpdateFlags(msg *Message) error {
+	if mm := w.messages[messageKey(msg.Folder, msg.UIDValidity, msg.UID)]; mm != nil {
+		updated := *mm
+		updated.Flags = msg.Flags
+		w.messages[messageKey(msg.Folder, msg.UIDValidity, msg.UID)] = &updated
+	}
+	w.Manifest.Add(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Flags:       msg.Flags,
+		FlagUpdate:  true,
+	})
+	return nil
+}
+
+func (w *RepoWriter) Expunge(msg *Message) error {
+	delete(w.messages, messageKey(msg.Folder, msg.UIDValidity, msg.UID))
+	w.Manifest.Add(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Expunged:    true,
+	})
+	return nil
+}
+
+// Complete drops messages of the folder carried over from the previous
+// snapshot under an old UIDVALIDITY, the folder was downloaded again.
+func (w *RepoWriter) Complete(msg *Message) error {
+	w.Manifest.Add(&CheckpointRecord{Folder: msg.Folder, Complete: true, Metadata: msg.Metadata})
+	for key, mm := range w.messages {
+		if mm.Folder == msg.Folder && mm.UIDValidity != msg.UIDValidity {
+			delete(w.messages, key)
+		}
+	}
+	return nil
+}
+
+// Close writes the snapshot. Incomplete runs get a snapshot as well, the
+// objects it refers to have been stored.
+func (w *RepoWriter) Close(complete bool) error {
+	w.Manifest.Messages = w.Manifest.Messages[:0]
+	for _, mm := range w.messages {
+		w.Manifest.Messages = append(w.Manifest.Messages, mm)
+	}
+	sort.Slice(w.Manifest.Messages, func(i, j int) bool {
+		a, b := w.Manifest.Messages[i], w.Manifest.Messages[j]
+		if a.Folder != b.Folder {
+			return a.Folder < b.Folder
+		}
+		if a.UIDValidity != b.UIDValidity {
+			return a.UIDValidity < b.UIDValidity
+		}
+		return a.UID < b.UID
+	})
+	data, err := w.Manifest.Marshal()
+	if err != nil {
+		return err
+	}
+	name := w.Manifest.Created.UTC().Format(snapshotTime) + ".json"
+	path := filepath.Join(w.snapshot, name)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ReportCommand implements 'report <backup>...', which replays the run
+// manifests of the backups, in the order given, to show how the mailbox
+// changed over time: the messages and bytes of each folder after each
+// run, the messages added and removed, the growth per month and the
+// senders of most of the new mail. Messages the server had but a run did
+// not back up are counted as well. A full run replaces what the earlier
+// ones stored, incremental runs add to it; the directory of an account's
+// snapshots in a --repo is read snapshot by snapshot.
+//
+// With --html the report is also written as an HTML page, with the
+// folders of every run.
+func ReportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	htmlFile := fs.String("html", "", "Also write the report as an HTML page to this file")
+	top := fs.Int("senders", 20, "Number of senders to list")
+	files, err := ParseCommandFlags(fs, args)
+	if err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("usage: report [--html <file>] <backup>...")
+	}
+	var sources []*Source
+	for _, path := range files {
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() && isSnapshotDir(path) {
+			snapshots, _ := filepath.Glob(filepath.Join(path, "*.json"))
+			sort.Strings(snapshots)
+			for _, name := range snapshots {
+				src, err := openSnapshot(name)
+				if err != nil {
+					return err
+				}
+				sources = append(sources, src)
+			}
+			continue
+		}
+		src, err := OpenSource(path, time.Time{})
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		sources = append(sources, src)
+	}
+	r, err := BuildReport(sources, *top)
+	if err != nil {
+		return err
+	}
+	if len(r.Runs) == 0 {
+		return errors.New("no runs found")
+	}
+	r.Print()
+	if *htmlFile != "" {
+		var b bytes.Buffer
+		if err := reportTemplate.Execute(&b, r); err != nil {
+			return err
+		}
+		return os.WriteFile(*htmlFile, b.Bytes(), 0600)
+	}
+	return nil
+}
+
+// Report is the history of an account's backups.
+type Report struct {
+	Account string
+	Runs    []*ReportRun
+	// Folders are the folders of any run, Senders those of the mail
+	// added after the first run, or by it if there is only one.
+	Folders []string
+	Senders []*SenderUsage
+}
+
+// ReportRun is the backup after a run.
+type ReportRun struct {
+	Created         time.Time
+	Full            bool
+	Messages, Bytes int64
+	Added, Removed  int
+	// NotBackedUp counts the messages on the server the run skipped.
+	NotBackedUp int
+	Folders     map[string]*FolderUsage
+}
+
+type FolderUsage struct {
+	Messages, Bytes int64
+}
+
+type SenderUsage struct {
+	Address  string
+	Messages int
+	Bytes    int64
+}
+
+// BuildReport replays the manifests of the sources.
+func BuildReport(sources []*Source, top int) (*Report, error) {
+	r := &Report{}
+	sizes := make(map[string]int64)
+	folders := make(map[string]string)
+	senders := make(map[string]*SenderUsage)
+	total := 0
+	for _, src := range sources {
+		total += len(src.Manifests)
+	}
+	var runs int
+	for _, src := range sources {
+		for _, m := range src.Manifests {
+			runs++
+			if r.Account == "" {
+				r.Account = m.Account
+			}
+			// Snapshots of a --repo and non-incremental runs
+			// hold the whole backup.
+			full := !m.Incremental || isSnapshot(m)
+			countSenders := runs > 1 || total == 1
+			before := len(sizes)
+			removed := 0
+			var present map[string]bool
+			if full {
+				present = make(map[string]bool)
+			}
+			for _, mm := range m.Messages {
+				key := messageKey(mm.Folder, mm.UIDValidity, mm.UID)
+				if present != nil {
+					present[key] = true
+				}
+				if _, ok := sizes[key]; ok {
+					continue
+				}
+				size := int64(mm.RFC822Size)
+				if size == 0 || countSenders {
+					body, err := src.Raw(mm)
+					if err != nil {
+						return nil, err
+					}
+					if size == 0 {
+						size = int64(len(body))
+					}
+					if countSenders {
+						CountSender(senders, body, size)
+					}
+				}
+				sizes[key], folders[key] = size, mm.Folder
+			}
+			added := len(sizes) - before
+			for key := range sizes {
+				if present != nil && !present[key] {
+					delete(sizes, key)
+					removed++
+				}
+			}
+			for _, mm := range m.Tombstones {
+				key := messageKey(mm.Folder, mm.UIDValidity, mm.UID)
+				if _, ok := sizes[key]; ok {
+					delete(sizes, key)
+					removed++
+				}
+			}
+			run := &ReportRun{Created: m.Created, Full: full, Added: added, Removed: removed, Folders: make(map[string]*FolderUsage)}
+			for _, s := range m.Skipped {
+				if s.UID != 0 {
+					run.NotBackedUp++
+				}
+			}
+			for key, size := range sizes {
+				fu := run.Folders[folders[key]]
+				if fu == nil {
+					fu = &FolderUsage{}
+					run.Folders[folders[key]] = fu
+				}
+				fu.Messages++
+				fu.Bytes += size
+				run.Messages++
+				run.Bytes += size
+			}
+			r.Runs = append(r.Runs, run)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, run := range r.Runs {
+		for folder := range run.Folders {
+			if !seen[folder] {
+				seen[folder] = true
+				r.Folders = append(r.Folders, folder)
+			}
+		}
+	}
+	sort.Strings(r.Folders)
+	for _, s := range senders {
+		r.Senders = append(r.Senders, s)
+	}
+	sort.Slice(r.Senders, func(i, j int) bool {
+		if r.Senders[i].Bytes != r.Senders[j].Bytes {
+			return r.Senders[i].Bytes > r.Senders[j].Bytes
+		}
+		return r.Senders[i].Address < r.Senders[j].Address
+	})
+	r.Senders = r.Senders[:min(len(r.Senders), top)]
+	return r, nil
+}
+
+// isSnapshot reports whether a manifest is a --repo snapshot, whose
+// messages have object hashes.
+func isSnapshot(m *Manifest) bool {
+	return len(m.Messages) > 0 && m.Messages[0].Hash != ""
+}
+
+// CountSender counts a new message for its sender. Encrypted messages
+// have no readable sender.
+func CountSender(senders map[string]*SenderUsage, body []byte, size int64) {
+	m, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return
+	}
+	addr := strings.ToLower(from.Address)
+	s := senders[addr]
+	if s == nil {
+		s = &SenderUsage{Address: addr}
+		senders[addr] = s
+	}
+	s.Messages++
+	s.Bytes += size
+}
+
+// Growth returns the change of the backup's size per 30 days between
+// two runs.
+func Growth(from, to *ReportRun) int64 {
+	days := to.Created.Sub(from.Created).Hours() / 24
+	if days <= 0 {
+		return 0
+	}
+	return int64(float64(to.Bytes-from.Bytes) / days * 30)
+}
+
+// Print writes the report as text to stdout.
+func (r *Report) Print() {
+	first, last := r.Runs[0], r.Runs[len(r.Runs)-1]
+	if r.Account != "" {
+		fmt.Printf("%s: ", r.Account)
+	}
+	fmt.Printf("%d runs from %s to %s\n\n", len(r.Runs),
+		first.Created.Local().Format("2006-01-02"), last.Created.Local().Format("2006-01-02"))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Run\tMessages\tSize\tAdded\tRemoved\tNot backed up\tGrowth/month\t\n")
+	for i, run := range r.Runs {
+		growth := "-"
+		if i > 0 {
+			growth = FormatSize(Growth(r.Runs[i-1], run))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%d\t%s\t\n", run.Created.Local().Format("2006-01-02 15:04"),
+			run.Messages, FormatSize(run.Bytes), run.Added, run.Removed, run.NotBackedUp, growth)
+	}
+	w.Flush()
+
+	fmt.Printf("\nFolders:\n")
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Folder\tMessages\tSize\tChange\tGrowth/month\t\n")
+	for _, folder := range r.Folders {
+		now, then := last.Folders[folder], first.Folders[folder]
+		if now == nil {
+			now = &FolderUsage{}
+		}
+		if then == nil {
+			then = &FolderUsage{}
+		}
+		growth := Growth(&ReportRun{Created: first.Created, Bytes: then.Bytes}, &ReportRun{Created: last.Created, Bytes: now.Bytes})
+		fmt.Fprintf(w, "%s\t%d\t%s\t%+d\t%s\t\n", folder, now.Messages, FormatSize(now.Bytes), now.Messages-then.Messages, FormatSize(growth))
+	}
+	w.Flush()
+
+	fmt.Printf("\nLargest senders of new mail:\n")
+	for _, s := range r.Senders {
+		fmt.Printf("%10s %6d  %s\n", FormatSize(s.Bytes), s.Messages, s.Address)
+	}
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"size": FormatSize,
+	"date": func(t time.Time) string { return t.Local().Format("2006-01-02 15:04") },
+	"folder": func(run *ReportRun, folder string) *FolderUsage {
+		if fu := run.Folders[folder]; fu != nil {
+			return fu
+		}
+		return &FolderUsage{}
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>backupimap report{{with .Account}} for {{.}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style></head><body>
+<h1>Backups{{with .Account}} of {{.}}{{end}}</h1>
+<h2>Runs</h2>
+<table>
+<tr><th>Run</th><th>Messages</th><th>Size</th><th>Added</th><th>Removed</th><th>Not backed up</th></tr>
+{{range .Runs}}<tr><td>{{date .Created}}{{if .Full}} (full){{end}}</td><td>{{.Messages}}</td><td>{{size .Bytes}}</td><td>{{.Added}}</td><td>{{.Removed}}</td><td>{{.NotBackedUp}}</td></tr>
+{{end}}</table>
+<h2>Folders</h2>
+<table>
+<tr><th>Folder</th>{{range .Runs}}<th>{{date .Created}}</th>{{end}}</tr>
+{{$runs := .Runs}}{{range $folder := .Folders}}<tr><td>{{$folder}}</td>{{range $runs}}{{with folder . $folder}}<td>{{.Messages}}<br>{{size .Bytes}}</td>{{end}}{{end}}</tr>
+{{end}}</table>
+<h2>Largest senders of new mail</h2>
+<table>
+<tr><th>Sender</th><th>Messages</th><th>Size</th></tr>
+{{range .Senders}}<tr><td>{{.Address}}</td><td>{{.Messages}}</td><td>{{size .Bytes}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
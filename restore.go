@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Restore appends the messages of one or more backups to the --user
+// account, keeping their flags and dates, and sets the saved folder and
+// server annotations. Backups of an incremental chain
+// must be given in order. The UIDs the server assigns are recorded in the
+// account state, so the next incremental backup of the restored account
+// does not download the messages again, and in a mapping file.
+//
+// With --as-of, runs made after the given time are ignored, so the
+// account is restored as it was then. For a --repo, pass the account's
+// snapshot directory to pick the snapshot automatically.
+
+var (
+	uidMap      = flag.String("uid-map", "", "CSV file mapping backed up to restored UIDs (default: in --statedir)")
+	appendBatch = flag.Int("append-batch", 50, "Messages appended by each command when restoring to a server with MULTIAPPEND")
+	asOf        = flag.String("as-of", "", "Restore the account as it was at this date (YYYY-MM-DD) or time (RFC 3339)")
+)
+
+// appendBatchSize limits the size of the messages in a MULTIAPPEND.
+const appendBatchSize = 16 << 20
+
+type restoreEntry struct {
+	*ManifestMessage
+	src *Source
+}
+
+// CollectMessages returns the messages present at the end of the given
+// backups, with the flags they had last.
+func CollectMessages(sources []*Source) []restoreEntry {
+	entries := make(map[string]restoreEntry)
+	for _, src := range sources {
+		for _, m := range src.Manifests {
+			for _, mm := range m.Messages {
+				entries[messageKey(mm.Folder, mm.UIDValidity, mm.UID)] = restoreEntry{mm, src}
+			}
+			for _, mm := range m.FlagUpdates {
+				key := messageKey(mm.Folder, mm.UIDValidity, mm.UID)
+				if e, ok := entries[key]; ok {
+					updated := *e.ManifestMessage
+					updated.Flags = mm.Flags
+					entries[key] = restoreEntry{&updated, e.src}
+				}
+			}
+			for _, mm := range m.Tombstones {
+				delete(entries, messageKey(mm.Folder, mm.UIDValidity, mm.UID))
+			}
+		}
+	}
+	list := make([]restoreEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Folder != b.Folder {
+			return a.Folder < b.Folder
+		}
+		if a.UIDValidity != b.UIDValidity {
+			return a.UIDValidity < b.UIDValidity
+		}
+		return a.UID < b.UID
+	})
+	return list
+}
+
+// RestoreCommand implements 'restore <backup>...'.
+func RestoreCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: restore <backup>...")
+	}
+	if *strictReadonly {
+		return errors.New("restore changes the server, it cannot be used with --strict-readonly")
+	}
+	t, err := ParseAsOf(*asOf)
+	if err != nil {
+		return err
+	}
+	var sources []*Source
+	for _, path := range args {
+		src, err := OpenSource(path, t)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		sources = append(sources, src)
+	}
+	entries := CollectMessages(sources)
+	if !t.IsZero() {
+		log.Printf("restoring the backups as of %s", t.Format(time.RFC3339))
+	}
+	total := len(entries)
+
+	a := &Account{Username: *username, Output: args[0]}
+	if err := a.Setup(""); err != nil {
+		return err
+	}
+	state, err := LoadState(a.Username)
+	if err != nil {
+		return err
+	}
+	mapFile := *uidMap
+	if mapFile == "" {
+		mapFile = StatePath(strings.Replace(a.Username, "/", "_", -1) + ".uidmap.csv")
+	}
+	f, err := os.Create(mapFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mapping := csv.NewWriter(f)
+	mapping.Write([]string{"folder", "uidvalidity", "uid", "new_uidvalidity", "new_uid"})
+
+	log.Printf("restoring %d messages to %s on %s", len(entries), a.Username, a.Server)
+	c, err := a.Connect()
+	if err != nil {
+		return err
+	}
+	defer Close(c)
+
+	var special map[string]string
+	if *normalizeFolders {
+		special = SpecialUseMailboxes(c)
+	}
+	changes := make(Changes)
+	created := make(map[string]bool)
+	failed := 0
+	mailboxes := make(map[string]string)
+	for _, src := range sources {
+		for _, m := range src.Manifests {
+			for folder, mbox := range m.Mailboxes {
+				mailboxes[folder] = mbox
+			}
+		}
+	}
+	for len(entries) > 0 {
+		batch := NextBatch(c, entries)
+		folder := batch[0].Folder
+		mbox, ok := mailboxes[folder]
+		if !ok {
+			mbox = a.MapFolder(folder)
+		}
+		if use := StandardUse(folder); special[use] != "" {
+			mbox = special[use]
+		}
+		var msgs []*AppendMsg
+		size := 0
+		for _, e := range batch {
+			body, err := e.src.Read(e.ManifestMessage)
+			if err != nil {
+				return err
+			}
+			date := MessageDate(body)
+			if !e.InternalDate.IsZero() {
+				date = &e.InternalDate
+			}
+			msgs = append(msgs, &AppendMsg{Flags: e.Flags, Date: date, Body: body})
+			if size += len(body); size >= appendBatchSize {
+				break
+			}
+		}
+		batch = batch[:len(msgs)]
+		entries = entries[len(batch):]
+		if !created[mbox] {
+			// The folder usually exists already, INBOX always does.
+			c.Create(mbox)
+			created[mbox] = true
+		}
+		uidValidity, uids, err := AppendMessages(c, mbox, msgs)
+		if err != nil {
+			log.Printf("%s: could not restore UIDs %d-%d: %s", folder, batch[0].UID, batch[len(batch)-1].UID, err)
+			failed += len(batch)
+			continue
+		}
+		if len(uids) != len(batch) {
+			// The server does not support UIDPLUS.
+			continue
+		}
+		ch := changes.Folder(folder, uidValidity)
+		for i, e := range batch {
+			mapping.Write([]string{folder, fmt.Sprint(e.UIDValidity), fmt.Sprint(e.UID), fmt.Sprint(uidValidity), fmt.Sprint(uids[i])})
+			ch.Added = append(ch.Added, uids[i])
+		}
+	}
+	metadata := make(map[string]map[string]string)
+	for _, src := range sources {
+		for _, m := range src.Manifests {
+			for folder, entries := range m.Metadata {
+				metadata[folder] = entries
+			}
+		}
+	}
+	for folder, entries := range metadata {
+		mbox, ok := mailboxes[folder]
+		if !ok && folder != "" {
+			mbox = a.MapFolder(folder)
+		}
+		SetMetadata(c, mbox, entries)
+	}
+
+	mapping.Flush()
+	if err := mapping.Error(); err != nil {
+		return err
+	}
+	state.Update(changes, true)
+	if err := state.Save(a.Username); err != nil {
+		return err
+	}
+	log.Printf("restored %d messages, UID mapping written to %s", total-failed, mapFile)
+	if failed > 0 {
+		return fmt.Errorf("%d messages could not be restored", failed)
+	}
+	return nil
+}
+
+// RestoreMessageCommand implements 'restore-message <backup>...
+// --message-id <id> [--to-folder INBOX]', which appends a single message
+// of the backups to the --user account, typically one deleted by
+// mistake. Messages deleted on the server after they were backed up are
+// found as well. If the backups hold several copies, such as in more
+// than one folder, the most recent is restored.
+func RestoreMessageCommand(args []string) error {
+	fs := flag.NewFlagSet("restore-message", flag.ContinueOnError)
+	id := fs.String("message-id", "", "Message-ID of the message to restore, with or without the angle brackets")
+	folder := fs.String("to-folder", "INBOX", "Folder to append the message to")
+	files, err := ParseCommandFlags(fs, args)
+	if err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(files) == 0 || *id == "" {
+		return errors.New("usage: restore-message <backup>... --message-id <id> [--to-folder INBOX]")
+	}
+	if *strictReadonly {
+		return errors.New("restore-message changes the server, it cannot be used with --strict-readonly")
+	}
+	t, err := ParseAsOf(*asOf)
+	if err != nil {
+		return err
+	}
+	var found *ManifestMessage
+	var body []byte
+	for i := len(files) - 1; i >= 0 && found == nil; i-- {
+		path := files[i]
+		src, err := OpenSource(path, t)
+		if err != nil {
+			return err
+		}
+		found, body, err = FindMessage(src, *id)
+		src.Close()
+		if err != nil {
+			return err
+		}
+		if found != nil {
+			log.Printf("found %s in %s of %s", *id, found.Folder, path)
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("no message with Message-ID %s in the backups", *id)
+	}
+
+	a := &Account{Username: *username, Output: files[0]}
+	if err := a.Setup(""); err != nil {
+		return err
+	}
+	c, err := a.Connect()
+	if err != nil {
+		return err
+	}
+	defer Close(c)
+	date := MessageDate(body)
+	if !found.InternalDate.IsZero() {
+		date = &found.InternalDate
+	}
+	flags := slices.DeleteFunc(slices.Clone(found.Flags), func(f string) bool { return f == `\Deleted` })
+	_, uids, err := AppendMessages(c, *folder, []*AppendMsg{{Flags: flags, Date: date, Body: body}})
+	if err != nil {
+		return fmt.Errorf("%s: %s", *folder, err)
+	}
+	if len(uids) == 1 {
+		log.Printf("restored %s to %s as UID %d", *id, *folder, uids[0])
+	} else {
+		log.Printf("restored %s to %s", *id, *folder)
+	}
+	return nil
+}
+
+// FindMessage returns the most recent copy of the message with the given
+// Message-ID in a backup, and its body. The Message-ID is looked up in
+// the manifests, only the bodies of messages without one, from backups
+// made before it was recorded, are read. Bodies encrypted with
+// --gpg-recipient are decrypted.
+func FindMessage(src *Source, id string) (*ManifestMessage, []byte, error) {
+	id = strings.Trim(strings.TrimSpace(id), "<>")
+	for i := len(src.Manifests) - 1; i >= 0; i-- {
+		msgs := src.Manifests[i].Messages
+		for j := len(msgs) - 1; j >= 0; j-- {
+			mm := msgs[j]
+			if mm.MessageID != "" && strings.Trim(mm.MessageID, "<>") != id {
+				continue
+			}
+			body, err := src.Read(mm)
+			if err != nil {
+				return nil, nil, err
+			}
+			if strings.Trim(MessageID(body), "<>") == id {
+				return mm, body, nil
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+// AppendMsg is a message to append.
+type AppendMsg struct {
+	Flags []string
+	Date  *time.Time
+	Body  []byte
+}
+
+// NextBatch returns the messages at the start of entries to append with
+// one command: up to --append-batch messages of the same folder if the
+// server supports MULTIAPPEND (RFC 3502), a single one otherwise. The
+// caller further limits the batch to appendBatchSize bytes.
+func NextBatch(c *imap.Client, entries []restoreEntry) []restoreEntry {
+	n := 1
+	if c.Caps["MULTIAPPEND"] {
+		for n < len(entries) && n < *appendBatch && entries[n].Folder == entries[0].Folder {
+			n++
+		}
+	}
+	return entries[:n]
+}
+
+// AppendMessages appends messages with their flags and internal dates,
+// using MULTIAPPEND for more than one. It returns the new UIDs from the
+// APPENDUID response code, or none if the server does not send it.
+// The client library sends the messages as non-synchronizing literals
+// if the server supports LITERAL+, saving a round-trip for each.
+func AppendMessages(c *imap.Client, mbox string, msgs []*AppendMsg) (uint32, []uint32, error) {
+	var cmd *imap.Command
+	var err error
+	if len(msgs) == 1 {
+		cmd, err = Result(c.Append(mbox, appendFlags(msgs[0].Flags), msgs[0].Date, imap.NewLiteral(msgs[0].Body)))
+	} else {
+		fields := []imap.Field{c.Quote(imap.UTF7Encode(mbox))}
+		for _, m := range msgs {
+			var flags []imap.Field
+			for f := range appendFlags(m.Flags) {
+				flags = append(flags, f)
+			}
+			fields = append(fields, flags)
+			if m.Date != nil {
+				fields = append(fields, c.Quote(m.Date.Format("02-Jan-2006 15:04:05 -0700")))
+			}
+			fields = append(fields, imap.NewLiteral(m.Body))
+		}
+		cmd, err = Result(c.Send("APPEND", fields...))
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	rsp, _ := cmd.Result(imap.OK)
+	if rsp == nil || !strings.EqualFold(rsp.Label, "APPENDUID") || len(rsp.Fields) < 3 {
+		return 0, nil, nil
+	}
+	// A MULTIAPPEND returns the UIDs as a set such as 1000:1049.
+	return imap.AsNumber(rsp.Fields[1]), ParseUIDs(fmt.Sprint(rsp.Fields[2])), nil
+}
+
+func appendFlags(flags []string) imap.FlagSet {
+	fs := make(imap.FlagSet)
+	for _, f := range flags {
+		// \Recent can only be set by the server.
+		if f != `\Recent` {
+			fs[f] = true
+		}
+	}
+	return fs
+}
+
+// ParseAsOf parses the --as-of time. A date means the end of that day,
+// in local time.
+func ParseAsOf(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("--as-of: expected YYYY-MM-DD or an RFC 3339 time")
+	}
+	return t, nil
+}
+
+// MessageDate returns the date of a message from its Date header.
+func MessageDate(body []byte) *time.Time {
+	m, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	date, err := m.Header.Date()
+	if err != nil {
+		return nil
+	}
+	return &date
+}
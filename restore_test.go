@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// FindMessage takes the Message-ID from the manifest, the bodies of other
+// messages are not read.
+func TestFindMessage(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "user.zip")
+	w, err := NewZipWriter(output, &Manifest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for uid, id := range []string{"<a@example.com>", "<b@example.com>"} {
+		body := []byte("Message-ID: " + id + "\r\n\r\nbody\r\n")
+		msg := &Message{Folder: "INBOX", UID: uint32(uid + 1), UIDValidity: 1, Body: body, MessageID: MessageID(body)}
+		if err := w.Add(fmt.Sprintf("INBOX/%d.eml", msg.UID), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(true); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenSource(output, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	m := src.Manifests[len(src.Manifests)-1]
+	// Reading this one would fail.
+	m.Messages = append(m.Messages, &ManifestMessage{Name: "INBOX/missing.eml", Folder: "INBOX", UID: 3, MessageID: "<c@example.com>"})
+	for _, id := range []string{"a@example.com", "<b@example.com>"} {
+		mm, body, err := FindMessage(src, id)
+		if err != nil {
+			t.Fatalf("FindMessage(%s): %s", id, err)
+		}
+		if mm == nil || MessageID(body) != mm.MessageID {
+			t.Errorf("FindMessage(%s) = %+v", id, mm)
+		}
+	}
+	if mm, _, err := FindMessage(src, "d@example.com"); mm != nil || err != nil {
+		t.Errorf("FindMessage of an unknown Message-ID = %+v, %v", mm, err)
+	}
+}
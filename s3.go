@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// S3 outputs: an --outfile or --outdir of the form s3://bucket/prefix
+// stores each file of the backup as an object under the prefix, see
+// store.go, whatever the --format. The credentials and region come from
+// the usual AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN
+// and AWS_REGION variables. AWS_ENDPOINT_URL selects another S3 compatible
+// service, such as MinIO, with path-style addressing.
+
+// IsS3 reports whether an output is an S3 location.
+func IsS3(output string) bool {
+	return strings.HasPrefix(output, "s3://")
+}
+
+type S3Store struct {
+	bucket, prefix string
+	endpoint       *url.URL
+	region         string
+	key, secret    string
+	token          string
+}
+
+func NewS3Store(output string) (*S3Store, error) {
+	u, err := url.Parse(output)
+	if err != nil {
+		return nil, err
+	}
+	s := &S3Store{
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		region: os.Getenv("AWS_REGION"),
+		key:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.bucket == "" || s.key == "" || s.secret == "" {
+		return nil, errors.New("s3: needs a bucket, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s.bucket, s.region)
+	} else {
+		endpoint = strings.TrimRight(endpoint, "/") + "/" + s.bucket
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *S3Store) Create(folder, name string, meta *Message) (io.WriteCloser, error) {
+	return &storeFile{store: func(data []byte) error {
+		return s.Put(path.Join(s.prefix, name), data)
+	}}, nil
+}
+
+// Finalize has nothing to do, every object is complete once stored.
+func (s *S3Store) Finalize() error {
+	return nil
+}
+
+// Put stores an object.
+func (s *S3Store) Put(key string, data []byte) error {
+	u := *s.endpoint
+	u.Path = path.Join(u.Path, key)
+	// The path must be sent as it is signed.
+	u.RawPath = s3Escape(u.Path)
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	s.sign(req, data, time.Now().UTC())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3: PUT %s: %s: %s", key, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 to a request.
+func (s *S3Store) sign(req *http.Request, payload []byte, now time.Time) {
+	sum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", amzDate)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := []string{req.URL.Host, payloadHash, amzDate}
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+		headers = append(headers, "x-amz-security-token")
+		values = append(values, s.token)
+	}
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n\n", req.Method, req.URL.EscapedPath())
+	for i, h := range headers {
+		fmt.Fprintf(&canonical, "%s:%s\n", h, values[i])
+	}
+	signed := strings.Join(headers, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payloadHash)
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	crsum := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crsum[:])
+	key := []byte("AWS4" + s.secret)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.key, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape encodes a path as in the canonical request: every byte but
+// the unreserved characters and slashes.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
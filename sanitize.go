@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Message sanitization for tools that choke on malformed originals.
+
+var (
+	sanitize        = flag.Bool("sanitize", false, "Convert bare LF line endings to CRLF and drop NUL bytes")
+	sanitizeHeaders = flag.Bool("sanitize-headers", false, "Add X-Imapbackup-* headers recording the folder, UID and flags of each message")
+)
+
+// Sanitize returns the body of msg as it should be written.
+func Sanitize(msg *Message) []byte {
+	body := msg.Body
+	if *sanitize {
+		body = bytes.ReplaceAll(body, []byte{0}, nil)
+		body = normalizeCRLF(body)
+	}
+	if *sanitizeHeaders {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "X-Imapbackup-Folder: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Folder))
+		fmt.Fprintf(&b, "X-Imapbackup-UID: %d/%d\r\n", msg.UIDValidity, msg.UID)
+		fmt.Fprintf(&b, "X-Imapbackup-Flags: %s\r\n", strings.Join(msg.Flags, " "))
+		b.Write(body)
+		body = b.Bytes()
+	}
+	return body
+}
+
+// normalizeCRLF turns lone LF and CR characters into CRLF.
+func normalizeCRLF(body []byte) []byte {
+	out := make([]byte, 0, len(body)+len(body)/32)
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\r' && i+1 < len(body) && body[i+1] == '\n':
+			out = append(out, '\r', '\n')
+			i++
+		case c == '\r' || c == '\n':
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
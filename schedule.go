@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Daemon mode with cron-style schedules. Accounts are backed up when
+// their schedule (from the config file, or --schedule) is due, delayed by
+// up to --jitter so that several instances do not hit a server at once.
+
+var (
+	scheduleSpec = flag.String("schedule", "", "Cron schedule (minute hour day month weekday) for accounts without their own, keeps running")
+	jitter       = flag.Duration("jitter", 0, "Delay scheduled backups by a random time up to this")
+)
+
+// Schedule is a parsed cron expression, each field a bit set of the
+// values it matches.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// A restricted day of month or weekday matches if either does, as
+	// in cron.
+	domStar, dowStar bool
+}
+
+var cronFields = []struct{ min, max int }{
+	{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7},
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func ParseSchedule(spec string) (*Schedule, error) {
+	if alias, ok := cronAliases[spec]; ok {
+		spec = alias
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("schedule '%s': expected 5 fields", spec)
+	}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule '%s': %s", spec, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is 0 or 7.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &Schedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domStar: fields[2] == "*", dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a list of values, ranges and steps such as
+// "1-5", "*/15" or "0,30".
+func parseCronField(f string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step, hasStep := strings.Cut(part, "/")
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", a)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid value '%s'", b)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		n := 1
+		if hasStep {
+			var err error
+			if n, err = strconv.Atoi(step); err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step '%s'", step)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += n {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// Next returns the first matching minute after t.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every schedule matches within a few years, at the latest on the
+	// next 29th of February.
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// SetupSchedules parses the schedules of the accounts. It reports whether
+// any account is scheduled.
+func SetupSchedules(accts []*Account) (bool, error) {
+	scheduled := false
+	for _, a := range accts {
+		spec := a.Schedule
+		if spec == "" {
+			spec = *scheduleSpec
+		}
+		if spec == "" {
+			continue
+		}
+		s, err := ParseSchedule(spec)
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", a.Username, err)
+		}
+		a.schedule = s
+		scheduled = true
+	}
+	return scheduled, nil
+}
+
+// nextRun returns when the account is backed up next: by its schedule,
+// every --watch interval, or never again if it has neither.
+func (a *Account) nextRun(now time.Time) time.Time {
+	var next time.Time
+	switch {
+	case a.schedule != nil:
+		next = a.schedule.Next(now)
+	case *watch > 0:
+		next = now.Add(*watch)
+	default:
+		return time.Time{}
+	}
+	if *jitter > 0 && !next.IsZero() {
+		next = next.Add(time.Duration(rand.Int63n(int64(*jitter))))
+	}
+	return next
+}
+
+// Daemon runs the backups of the accounts as they become due. Accounts
+// without a schedule are backed up at once, then every --watch interval.
+func Daemon(accts []*Account, dir string) error {
+	next := make(map[*Account]time.Time)
+	now := time.Now()
+	for _, a := range accts {
+		if a.schedule != nil {
+			next[a] = a.nextRun(now)
+		} else {
+			next[a] = now
+		}
+	}
+	for {
+		var first time.Time
+		for _, t := range next {
+			if !t.IsZero() && (first.IsZero() || t.Before(first)) {
+				first = t
+			}
+		}
+		if first.IsZero() {
+			return errors.New("no backups left to schedule")
+		}
+		if d := time.Until(first); d > 0 {
+			log.Printf("next backup at %s", first.Format("2006-01-02 15:04"))
+			time.Sleep(d)
+		}
+
+		var due []*Account
+		now := time.Now()
+		for _, a := range accts {
+			if t := next[a]; !t.IsZero() && !t.After(now) {
+				due = append(due, a)
+			}
+		}
+		Run(due, dir)
+		now = time.Now()
+		for _, a := range due {
+			next[a] = a.nextRun(now)
+		}
+	}
+}
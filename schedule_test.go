@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// A Wednesday morning.
+	now := time.Date(2024, 3, 13, 10, 7, 30, 0, time.UTC)
+	for spec, want := range map[string]string{
+		"* * * * *":    "2024-03-13 10:08",
+		"*/15 * * * *": "2024-03-13 10:15",
+		"@hourly":      "2024-03-13 11:00",
+		"@daily":       "2024-03-14 00:00",
+		"30 2 * * 1-5": "2024-03-14 02:30",
+		"0 0 * * 7":    "2024-03-17 00:00",
+		"@monthly":     "2024-04-01 00:00",
+		// The day of month or the weekday, as in cron.
+		"0 12 1 * 5": "2024-03-15 12:00",
+		"0 0 29 2 *": "2028-02-29 00:00",
+	} {
+		s, err := ParseSchedule(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+			continue
+		}
+		if got := s.Next(now).Format("2006-01-02 15:04"); got != want {
+			t.Errorf("%s: next run at %s, want %s", spec, got, want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"5 4 * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "@yearly",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("%q was accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Signed backups with --sign-key: once a run is complete, a detached
+// signature is written next to the archive, so that later changes to it
+// are detectable. Directory outputs get a list of the SHA-256 sums of
+// the manifest and the files written by the run, seal-<time>.sha256,
+// which is signed instead. Snapshots of a --repo hold the hashes of the
+// messages already, so the snapshot itself is signed.
+//
+// The key is one of
+//
+//	minisign:<secret key file>   verify with minisign -V -m <file>
+//	ssh:<private key file>       verify with ssh-keygen -Y verify -n backupimap
+//	gpg:<key id>, or <key id>    verify with gpg --verify <file>.sig
+//
+// The key must be usable without a passphrase prompt, e.g. through
+// ssh-agent or gpg-agent, for unattended runs.
+
+var signKey = flag.String("sign-key", "", "Sign the backup with this key: minisign:<file>, ssh:<file> or a GnuPG key id")
+
+// sshNamespace is the namespace of ssh-keygen signatures.
+const sshNamespace = "backupimap"
+
+// SealFile returns the file to sign for the output of a writer, after
+// it was closed, writing the list of sums for directory outputs.
+func SealFile(w Writer, m *Manifest, output string) (string, error) {
+	stamp := m.Created.UTC().Format(snapshotTime)
+	var dir string
+	var files []string
+	switch w := w.(type) {
+	case *ZipWriter:
+		return output, nil
+	case *RepoWriter:
+		return filepath.Join(w.snapshot, stamp+".json"), nil
+	case *StoreWriter:
+		if _, ok := w.store.(*TarStore); !ok {
+			return "", errors.New("only local outputs can be signed")
+		}
+		return output, nil
+	case *FolderZipWriter:
+		dir = w.dir
+		files = slices.Clone(w.finished)
+		for folder := range w.open {
+			files = append(files, FolderArchive(w.dir, folder))
+		}
+		slices.Sort(files)
+		files = slices.Compact(files)
+	default:
+		dir = output
+		files = append(files, filepath.Join(dir, "manifest-"+stamp+".json"))
+		for _, mm := range m.Messages {
+			files = append(files, filepath.Join(dir, filepath.FromSlash(mm.Name)))
+		}
+	}
+	var sums bytes.Buffer
+	for _, file := range files {
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", sum, filepath.ToSlash(rel))
+	}
+	file := filepath.Join(dir, "seal-"+stamp+".sha256")
+	return file, os.WriteFile(file, sums.Bytes(), 0600)
+}
+
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ParseSignKey splits the --sign-key into the key type and the key.
+func ParseSignKey(s string) (kind, key string, err error) {
+	kind, key, ok := strings.Cut(s, ":")
+	if !ok {
+		kind, key = "gpg", s
+	}
+	switch kind {
+	case "minisign", "ssh", "gpg":
+	default:
+		return "", "", fmt.Errorf("unknown key type '%s'", kind)
+	}
+	if key == "" {
+		return "", "", fmt.Errorf("missing key")
+	}
+	return kind, key, nil
+}
+
+// Sign writes a detached signature of file with the --sign-key and
+// returns the name of the signature file.
+func Sign(file string) (string, error) {
+	kind, key, err := ParseSignKey(*signKey)
+	if err != nil {
+		return "", err
+	}
+	var cmd *exec.Cmd
+	sig := file + ".sig"
+	switch kind {
+	case "minisign":
+		sig = file + ".minisig"
+		cmd = exec.Command("minisign", "-S", "-s", key, "-m", file, "-x", sig)
+	case "ssh":
+		// ssh-keygen writes the signature to <file>.sig and refuses
+		// to overwrite it.
+		os.Remove(sig)
+		cmd = exec.Command("ssh-keygen", "-Y", "sign", "-f", key, "-n", sshNamespace, file)
+	case "gpg":
+		cmd = exec.Command(*gpgBinary, "--batch", "--yes", "--local-user", key, "--detach-sign", "--output", sig, file)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %s: %s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return sig, nil
+}
+
+// Resign signs a file again after it was rewritten, with the --sign-key if
+// there is one. Signatures that no longer match are removed.
+func Resign(file string) error {
+	var sig string
+	if *signKey != "" {
+		var err error
+		if sig, err = Sign(file); err != nil {
+			return fmt.Errorf("could not sign %s again: %s", file, err)
+		}
+		log.Printf("signed %s again: %s", file, sig)
+	}
+	for _, stale := range []string{file + ".sig", file + ".minisig"} {
+		if stale == sig {
+			continue
+		}
+		if err := os.Remove(stale); err == nil {
+			log.Printf("removed %s, which no longer matches %s", stale, file)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Seal signs the output of a complete run and returns the signature
+// file.
+func Seal(w Writer, m *Manifest, output string) (string, error) {
+	file, err := SealFile(w, m, output)
+	if err != nil {
+		return "", err
+	}
+	return Sign(file)
+}
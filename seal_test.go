@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSignKey(t *testing.T) {
+	for s, want := range map[string][2]string{
+		"0xDEADBEEF":                  {"gpg", "0xDEADBEEF"},
+		"gpg:backup@example.com":      {"gpg", "backup@example.com"},
+		"minisign:/etc/minisign.key":  {"minisign", "/etc/minisign.key"},
+		"ssh:/home/u/.ssh/id_ed25519": {"ssh", "/home/u/.ssh/id_ed25519"},
+	} {
+		kind, key, err := ParseSignKey(s)
+		if err != nil || kind != want[0] || key != want[1] {
+			t.Errorf("ParseSignKey(%q) = %q, %q, %v", s, kind, key, err)
+		}
+	}
+	for _, s := range []string{"", "ssh:", "pgp:key"} {
+		if _, _, err := ParseSignKey(s); err == nil {
+			t.Errorf("ParseSignKey(%q) succeeded", s)
+		}
+	}
+}
+
+// A rewritten archive is signed again with the --sign-key, and loses
+// the signatures it no longer matches.
+func TestResign(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("no ssh-keygen")
+	}
+	defer func(key string) { *signKey = key }(*signKey)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "user.zip")
+	os.WriteFile(archive, []byte("rewritten"), 0600)
+	os.WriteFile(archive+".sig", []byte("stale"), 0600)
+	os.WriteFile(archive+".minisig", []byte("stale"), 0600)
+
+	*signKey = ""
+	if err := Resign(archive); err != nil {
+		t.Fatal(err)
+	}
+	for _, sig := range []string{archive + ".sig", archive + ".minisig"} {
+		if _, err := os.Stat(sig); !os.IsNotExist(err) {
+			t.Errorf("%s was kept", sig)
+		}
+	}
+
+	key := filepath.Join(dir, "id_ed25519")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %s: %s", err, out)
+	}
+	os.WriteFile(archive+".sig", []byte("stale"), 0600)
+	*signKey = "ssh:" + key
+	if err := Resign(archive); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := os.ReadFile(archive + ".sig")
+	if err != nil || string(sig) == "stale" {
+		t.Errorf("not signed again: %q, %v", sig, err)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --selftest backs up synthetic folders from a small IMAP server running
+// in the process and checks that the archive contains every message with
+// its flags. It also fails if the backup sends a command that would
+// change the mailbox. The output and state go to a temporary directory.
+
+var selftest = flag.Bool("selftest", false, "Back up a built-in test server and verify the archive")
+
+type fakeMessage struct {
+	UID   uint32
+	Flags []string
+	Date  time.Time
+	Body  []byte
+}
+
+type fakeFolder struct {
+	Name        string
+	Attrs       string
+	UIDValidity uint32
+	Messages    []*fakeMessage
+}
+
+// selftestFolders generates the test mailboxes. Archive only has
+// subfolders, as on many servers.
+func selftestFolders() []*fakeFolder {
+	folders := []*fakeFolder{
+		{Name: "INBOX", UIDValidity: 1},
+		{Name: "Archive", Attrs: `\Noselect \HasChildren`},
+		{Name: "Archive/2020", UIDValidity: 7},
+		{Name: "Sent", UIDValidity: 3},
+		{Name: "Empty", UIDValidity: 4},
+	}
+	counts := map[string]int{"INBOX": 25, "Archive/2020": 7, "Sent": 3}
+	date := time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)
+	for _, f := range folders {
+		for i := 0; i < counts[f.Name]; i++ {
+			// Leave gaps in the UIDs, as after deletions.
+			uid := uint32(i*2 + 1)
+			when := date.Add(time.Duration(i) * time.Hour)
+			// Sorted, as in the manifest.
+			var flags []string
+			if i%5 == 0 {
+				flags = append(flags, `\Flagged`)
+			}
+			if i%2 == 0 {
+				flags = append(flags, `\Seen`)
+			}
+			body := fmt.Sprintf("From: Sender %d <sender%d@example.org>\r\n"+
+				"To: selftest@example.org\r\n"+
+				"Subject: =?UTF-8?Q?Test_m=C3=A9ssage?= %d in %s\r\n"+
+				"Date: %s\r\n"+
+				"Message-ID: <%d.%s@selftest>\r\n\r\n"+
+				"Line one of message %d\r\n.\r\nFrom the end\r\n",
+				i%3, i%3, i, f.Name, when.Format(time.RFC1123Z), uid, f.Name, i)
+			f.Messages = append(f.Messages, &fakeMessage{UID: uid, Flags: flags, Date: when, Body: []byte(body)})
+		}
+	}
+	return folders
+}
+
+// SelfTest runs the test and returns an error describing the first
+// problem found.
+func SelfTest() error {
+	tmp, err := os.MkdirTemp("", "backupimap-selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	folders := selftestFolders()
+	srv := &fakeServer{user: "selftest", password: "selftest", folders: folders}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	*stateDir = filepath.Join(tmp, "state")
+	*format, *repo, *perFolder = "zip", "", false
+	*incremental, *resume, *headersOnly = false, false, false
+	a := &Account{Username: srv.user, Password: srv.password, Server: l.Addr().String(), TLS: "none",
+		Auth: "login", Output: filepath.Join(tmp, "selftest.zip")}
+	if summary := Run([]*Account{a}, ""); summary.Status != "success" {
+		return fmt.Errorf("the backup failed: %v", a.Err())
+	}
+	if len(srv.mutations) > 0 {
+		return fmt.Errorf("the backup sent commands changing the mailbox: %s", strings.Join(srv.mutations, ", "))
+	}
+
+	src, err := OpenSource(a.Output, time.Time{})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	got := make(map[string]restoreEntry)
+	for _, e := range CollectMessages([]*Source{src}) {
+		got[messageKey(e.Folder, e.UIDValidity, e.UID)] = e
+	}
+	want := 0
+	for _, f := range folders {
+		for _, m := range f.Messages {
+			want++
+			e, ok := got[messageKey(FolderName(f.Name), f.UIDValidity, m.UID)]
+			if !ok {
+				return fmt.Errorf("%s UID %d is missing from the archive", f.Name, m.UID)
+			}
+			body, err := src.Read(e.ManifestMessage)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(body, m.Body) {
+				return fmt.Errorf("%s UID %d differs from the message on the server", f.Name, m.UID)
+			}
+			if !slices.Equal(e.Flags, m.Flags) {
+				return fmt.Errorf("%s UID %d has flags %v instead of %v", f.Name, m.UID, e.Flags, m.Flags)
+			}
+			if !e.InternalDate.Equal(m.Date) || e.RFC822Size != uint32(len(m.Body)) {
+				return fmt.Errorf("%s UID %d has the wrong INTERNALDATE or RFC822.SIZE", f.Name, m.UID)
+			}
+		}
+	}
+	if len(got) != want {
+		return fmt.Errorf("the archive has %d messages instead of %d", len(got), want)
+	}
+	log.Printf("selftest passed: %d messages in %d folders backed up and verified", want, len(folders))
+	return nil
+}
+
+// fakeServer implements enough of IMAP4rev1 for a read-only backup.
+type fakeServer struct {
+	user, password string
+	folders        []*fakeFolder
+
+	mu        sync.Mutex
+	mutations []string
+}
+
+func (s *fakeServer) Serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *fakeServer) folder(name string) *fakeFolder {
+	for _, f := range s.folders {
+		if f.Name == name && f.UIDValidity != 0 {
+			return f
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+	fmt.Fprintf(w, "* OK [CAPABILITY IMAP4rev1] backupimap selftest ready\r\n")
+	w.Flush()
+
+	loggedIn := false
+	var selected *fakeFolder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		name, args, _ := strings.Cut(rest, " ")
+		name = strings.ToUpper(name)
+		if name == "UID" {
+			sub, subArgs, _ := strings.Cut(args, " ")
+			name, args = "UID "+strings.ToUpper(sub), subArgs
+		}
+		fields := fakeFields(args)
+		if name == "UID SEARCH" && len(fields) > 2 && strings.EqualFold(fields[0], "CHARSET") {
+			// Only UIDs are searched for, the charset does not matter.
+			fields = fields[2:]
+		}
+
+		switch {
+		case name == "CAPABILITY":
+			fmt.Fprintf(w, "* CAPABILITY IMAP4rev1\r\n%s OK CAPABILITY completed\r\n", tag)
+		case name == "NOOP":
+			fmt.Fprintf(w, "%s OK NOOP completed\r\n", tag)
+		case name == "LOGOUT":
+			fmt.Fprintf(w, "* BYE logging out\r\n%s OK LOGOUT completed\r\n", tag)
+			return
+		case name == "LOGIN":
+			if len(fields) != 2 || fields[0] != s.user || fields[1] != s.password {
+				fmt.Fprintf(w, "%s NO [AUTHENTICATIONFAILED] invalid credentials\r\n", tag)
+				break
+			}
+			loggedIn = true
+			fmt.Fprintf(w, "%s OK [CAPABILITY IMAP4rev1] LOGIN completed\r\n", tag)
+		case !loggedIn:
+			fmt.Fprintf(w, "%s BAD not logged in\r\n", tag)
+		case name == "LIST":
+			for _, f := range s.folders {
+				attrs := f.Attrs
+				if attrs == "" {
+					attrs = `\HasNoChildren`
+				}
+				fmt.Fprintf(w, "* LIST (%s) \"/\" %s\r\n", attrs, strconv.Quote(f.Name))
+			}
+			fmt.Fprintf(w, "%s OK LIST completed\r\n", tag)
+		case name == "STATUS" && len(fields) > 0:
+			f := s.folder(fields[0])
+			if f == nil {
+				fmt.Fprintf(w, "%s NO no such mailbox\r\n", tag)
+				break
+			}
+			fmt.Fprintf(w, "* STATUS %s (MESSAGES %d UIDVALIDITY %d)\r\n%s OK STATUS completed\r\n",
+				strconv.Quote(f.Name), len(f.Messages), f.UIDValidity, tag)
+		case name == "EXAMINE" && len(fields) > 0:
+			if selected = s.folder(fields[0]); selected == nil {
+				fmt.Fprintf(w, "%s NO no such mailbox\r\n", tag)
+				break
+			}
+			next := uint32(1)
+			if n := len(selected.Messages); n > 0 {
+				next = selected.Messages[n-1].UID + 1
+			}
+			fmt.Fprintf(w, "* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)\r\n"+
+				"* %d EXISTS\r\n* 0 RECENT\r\n"+
+				"* OK [UIDVALIDITY %d] UIDs valid\r\n* OK [UIDNEXT %d] predicted next UID\r\n"+
+				"%s OK [READ-ONLY] EXAMINE completed\r\n",
+				len(selected.Messages), selected.UIDValidity, next, tag)
+		case selected == nil && strings.HasPrefix(name, "UID "):
+			fmt.Fprintf(w, "%s BAD no mailbox selected\r\n", tag)
+		case name == "UID SEARCH" && len(fields) >= 2 && strings.EqualFold(fields[0], "UID"):
+			var uids []string
+			for _, m := range selected.Messages {
+				if fakeInSet(fields[1], m.UID, selected) {
+					uids = append(uids, fmt.Sprint(m.UID))
+				}
+			}
+			fmt.Fprintf(w, "* SEARCH %s\r\n%s OK SEARCH completed\r\n", strings.Join(uids, " "), tag)
+		case name == "UID FETCH" && len(fields) >= 2:
+			items := strings.ToUpper(strings.Join(fields[1:], " "))
+			for i, m := range selected.Messages {
+				if !fakeInSet(fields[0], m.UID, selected) {
+					continue
+				}
+				fmt.Fprintf(w, "* %d FETCH (UID %d FLAGS (%s)", i+1, m.UID, strings.Join(m.Flags, " "))
+				if strings.Contains(items, "INTERNALDATE") {
+					fmt.Fprintf(w, " INTERNALDATE \"%s\"", m.Date.Format("02-Jan-2006 15:04:05 -0700"))
+				}
+				if strings.Contains(items, "RFC822.SIZE") {
+					fmt.Fprintf(w, " RFC822.SIZE %d", len(m.Body))
+				}
+				switch {
+				case strings.Contains(items, "BODY.PEEK[HEADER]"):
+					hdr, _, _ := bytes.Cut(m.Body, []byte("\r\n\r\n"))
+					hdr = append(hdr, "\r\n\r\n"...)
+					fmt.Fprintf(w, " BODY[HEADER] {%d}\r\n%s", len(hdr), hdr)
+				case strings.Contains(items, "BODY[]"), strings.Contains(items, "BODY.PEEK[]"):
+					fmt.Fprintf(w, " BODY[] {%d}\r\n%s", len(m.Body), m.Body)
+				}
+				fmt.Fprintf(w, ")\r\n")
+			}
+			fmt.Fprintf(w, "%s OK FETCH completed\r\n", tag)
+		default:
+			switch strings.TrimPrefix(name, "UID ") {
+			case "SELECT", "STORE", "COPY", "MOVE", "APPEND", "CREATE", "DELETE", "RENAME", "EXPUNGE", "SETMETADATA":
+				s.mu.Lock()
+				s.mutations = append(s.mutations, name)
+				s.mu.Unlock()
+			}
+			fmt.Fprintf(w, "%s BAD %s is not supported by the selftest server\r\n", tag, name)
+		}
+		w.Flush()
+	}
+}
+
+// fakeFields splits command arguments, unquoting strings and flattening
+// parenthesized lists.
+func fakeFields(args string) []string {
+	var fields []string
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		if args[0] == '"' {
+			end := 1
+			for end < len(args) && args[end] != '"' {
+				if args[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			s, err := strconv.Unquote(args[:min(end+1, len(args))])
+			if err != nil {
+				s = strings.Trim(args[:min(end+1, len(args))], `"`)
+			}
+			fields = append(fields, s)
+			args = args[min(end+1, len(args)):]
+			continue
+		}
+		end := strings.IndexByte(args, ' ')
+		if end < 0 {
+			end = len(args)
+		}
+		fields = append(fields, strings.Trim(args[:end], "()"))
+		args = args[end:]
+	}
+	return fields
+}
+
+// fakeInSet reports whether a UID is in a sequence set such as 1:5,9:*.
+func fakeInSet(set string, uid uint32, f *fakeFolder) bool {
+	last := uint32(0)
+	if n := len(f.Messages); n > 0 {
+		last = f.Messages[n-1].UID
+	}
+	num := func(s string) uint32 {
+		if s == "*" {
+			return last
+		}
+		n, _ := strconv.ParseUint(s, 10, 32)
+		return uint32(n)
+	}
+	for _, r := range strings.Split(set, ",") {
+		lo, hi, found := strings.Cut(r, ":")
+		first, end := num(lo), num(lo)
+		if found {
+			end = num(hi)
+		}
+		if first > end {
+			first, end = end, first
+		}
+		if uid >= first && uid <= end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+package main
+
+import "testing"
+
+func TestSelfTest(t *testing.T) {
+	defer func(dir, f string) { *stateDir, *format = dir, f }(*stateDir, *format)
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
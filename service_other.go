@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// SetupService does nothing, services are only supported on Windows.
+func SetupService() {}
+
+func ServiceCommand(args []string) error {
+	return errors.New("service: only supported on Windows, use systemd or cron elsewhere")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Windows service: '[options] service install' registers a service
+// started at boot which runs backupimap with the options, and 'service
+// uninstall' removes it. The options must keep it running, with
+// --schedule, --watch or a --config with schedules, and their paths
+// should be absolute, services start in the system directory. Passwords
+// in the keyring are only found if the service runs as the user who
+// stored them, which is set in the properties of the service.
+//
+// The service logs to the Application event log. When it is stopped,
+// the process exits; an interrupted backup is continued with --resume.
+
+const serviceName = "backupimap"
+
+var runService = flag.Bool("service", false, "Run as a Windows service, set by 'service install'")
+
+var (
+	procOpenSCManagerW                = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW                = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW                  = advapi32.NewProc("OpenServiceW")
+	procDeleteService                 = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle            = advapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW          = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                  = advapi32.NewProc("ReportEventW")
+)
+
+const (
+	scManagerAllAccess     = 0xf003f
+	serviceAllAccess       = 0xf01ff
+	deleteAccess           = 0x10000
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	serviceAcceptStop     = 1
+	serviceAcceptShutdown = 4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorCallNotImplemented = 120
+	eventlogInformationType = 4
+)
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// ServiceCommand implements 'service install|uninstall'.
+func ServiceCommand(args []string) error {
+	if len(args) != 1 || args[0] != "install" && args[0] != "uninstall" {
+		return errors.New("usage: [options] service install|uninstall")
+	}
+	if args[0] == "install" && *scheduleSpec == "" && *watch == 0 && *configFile == "" {
+		return errors.New("the service needs --schedule, --watch or a --config with schedules")
+	}
+	scm, _, err := procOpenSCManagerW.Call(0, 0, scManagerAllAccess)
+	if scm == 0 {
+		return fmt.Errorf("could not open the service manager: %s", err)
+	}
+	defer procCloseServiceHandle.Call(scm)
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+
+	if args[0] == "uninstall" {
+		s, _, err := procOpenServiceW.Call(scm, uintptr(unsafe.Pointer(name)), deleteAccess)
+		if s == 0 {
+			return fmt.Errorf("could not open the %s service: %s", serviceName, err)
+		}
+		defer procCloseServiceHandle.Call(s)
+		if r, _, err := procDeleteService.Call(s); r == 0 {
+			return fmt.Errorf("could not remove the %s service: %s", serviceName, err)
+		}
+		log.Printf("removed the %s service", serviceName)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// The options are those given before the command.
+	cmdline := []string{syscall.EscapeArg(exe), "--service"}
+	for _, arg := range os.Args[1 : len(os.Args)-flag.NArg()] {
+		cmdline = append(cmdline, syscall.EscapeArg(arg))
+	}
+	bin, err := syscall.UTF16PtrFromString(strings.Join(cmdline, " "))
+	if err != nil {
+		return err
+	}
+	s, _, err := procCreateServiceW.Call(scm, uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(name)),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(bin)), 0, 0, 0, 0, 0)
+	if s == 0 {
+		return fmt.Errorf("could not create the %s service: %s", serviceName, err)
+	}
+	procCloseServiceHandle.Call(s)
+	log.Printf("installed the %s service: %s", serviceName, strings.Join(cmdline, " "))
+	return nil
+}
+
+// service is the status handle of the running service.
+var service uintptr
+
+// SetupService reports to the service manager that the service is
+// running, when started by it, and logs to the event log.
+func SetupService() {
+	if !*runService {
+		return
+	}
+	if source, _, _ := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(serviceName)))); source != 0 {
+		log.SetOutput(&eventLogWriter{source})
+	}
+	started := make(chan error, 1)
+	go func() {
+		// The dispatcher keeps the thread until the service stops.
+		runtime.LockOSThread()
+		table := []serviceTableEntry{
+			{syscall.StringToUTF16Ptr(serviceName), syscall.NewCallback(serviceMain(started))},
+			{},
+		}
+		if r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+			started <- err
+		}
+	}()
+	if err := <-started; err != nil {
+		log.Fatalf("could not start the service: %s", err)
+	}
+}
+
+// serviceMain returns the ServiceMain function of the service, which
+// registers the control handler.
+func serviceMain(started chan<- error) func(argc, argv uintptr) uintptr {
+	return func(argc, argv uintptr) uintptr {
+		name := syscall.StringToUTF16Ptr(serviceName)
+		h, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(serviceHandler), 0)
+		if h == 0 {
+			started <- err
+			return 0
+		}
+		service = h
+		setServiceStatus(serviceRunning)
+		started <- nil
+		return 0
+	}
+}
+
+// serviceHandler handles the controls sent by the service manager.
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceStatus(serviceStopPending)
+		log.Printf("service stopped")
+		setServiceStatus(serviceStopped)
+		os.Exit(0)
+	case serviceControlInterrogate:
+		setServiceStatus(serviceRunning)
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+func setServiceStatus(state uint32) {
+	status := serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: state}
+	if state == serviceRunning {
+		status.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	procSetServiceStatus.Call(service, uintptr(unsafe.Pointer(&status)))
+}
+
+// eventLogWriter sends each log line to the event log.
+type eventLogWriter struct {
+	source uintptr
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg, err := syscall.UTF16PtrFromString(strings.TrimSuffix(string(p), "\n"))
+	if err != nil {
+		return os.Stderr.Write(p)
+	}
+	procReportEventW.Call(w.source, eventlogInformationType, 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&msg)), 0)
+	return len(p), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"mime"
+	"net/mail"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Messages that are not backed up, because their folder is excluded,
+// they are older than --trash-max-age, could not be fetched or a size
+// limit was reached, are listed in the manifest with the reason, so that
+// they can be retrieved by hand. Nothing is left out silently.
+
+type SkippedMessage struct {
+	Folder      string `json:"folder"`
+	UIDValidity uint32 `json:"uidvalidity,omitempty"`
+	UID         uint32 `json:"uid,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	Reason      string `json:"reason"`
+}
+
+// SkipFolder reports that a folder, or the rest of it, is not backed up.
+func (a *Account) SkipFolder(name, reason string) {
+	a.msgCh <- &Message{Folder: name, Skipped: reason}
+}
+
+// Skip reports messages of the selected mailbox that are not backed up.
+// If subjects is set, their subjects are fetched, so that they are easier
+// to find.
+func (a *Account) Skip(c *imap.Client, name string, uidValidity uint32, uids []uint32, reason string, subjects bool) {
+	if len(uids) == 0 {
+		return
+	}
+	log.Printf("%s: %s - skipping %d messages: %s", a.Username, name, len(uids), reason)
+	var subject map[uint32]string
+	if subjects && !Dropped(c) {
+		subject = FetchSubjects(c, uids)
+	}
+	for _, uid := range uids {
+		a.msgCh <- &Message{Folder: name, UID: uid, UIDValidity: uidValidity, Skipped: reason, Subject: subject[uid]}
+	}
+}
+
+// Postpone reports messages of the selected mailbox that could not be
+// backed up in this run, because they failed or a limit was reached. The
+// state of an incremental backup does not move past them.
+func (a *Account) Postpone(name string, uidValidity uint32, uids []uint32, reason string) {
+	if len(uids) == 0 {
+		return
+	}
+	log.Printf("%s: %s - skipping %d messages: %s", a.Username, name, len(uids), reason)
+	for _, uid := range uids {
+		a.msgCh <- &Message{Folder: name, UID: uid, UIDValidity: uidValidity, Skipped: reason, Postponed: true}
+	}
+}
+
+// FetchSubjects returns the subjects of messages of the selected mailbox.
+func FetchSubjects(c *imap.Client, uids []uint32) map[uint32]string {
+	subjects := make(map[uint32]string)
+	dec := new(mime.WordDecoder)
+	for len(uids) > 0 {
+		n := min(len(uids), *fetchBatch)
+		set, _ := imap.NewSeqSet("")
+		set.AddNum(uids[:n]...)
+		uids = uids[n:]
+		cmd, err := Result(c.UIDFetch(set, "BODY.PEEK[HEADER.FIELDS (SUBJECT)]"))
+		if err != nil {
+			break
+		}
+		for _, resp := range cmd.Data {
+			info := resp.MessageInfo()
+			m, err := mail.ReadMessage(bytes.NewReader(imap.AsBytes(info.Attrs["BODY[HEADER.FIELDS (SUBJECT)]"])))
+			if err != nil {
+				continue
+			}
+			s := m.Header.Get("Subject")
+			if decoded, err := dec.DecodeHeader(s); err == nil {
+				s = decoded
+			}
+			subjects[info.UID] = s
+		}
+	}
+	return subjects
+}
+
+// NotReceived returns the UIDs the job did not receive.
+func (j *Job) NotReceived(uids []uint32) []uint32 {
+	var rest []uint32
+	for _, uid := range uids {
+		if !j.received[uid] {
+			rest = append(rest, uid)
+		}
+	}
+	return rest
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reading backups back, for restore. A source is a ZIP archive, a
+// Maildir, sdbox or EML directory, or a --repo snapshot or the snapshot
+// directory of an account.
+
+type Source struct {
+	Manifests []*Manifest
+
+	read  func(mm *ManifestMessage) ([]byte, error)
+	close func() error
+}
+
+// OpenSource opens the backup at path. If asOf is set, only the runs
+// made until then are used: the directory of an account's snapshots in
+// a --repo opens the last snapshot taken by that time, and later run
+// manifests are skipped.
+func OpenSource(path string, asOf time.Time) (*Source, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var s *Source
+	switch {
+	case fi.IsDir() && isSnapshotDir(path):
+		snapshot, err := SnapshotAsOf(path, asOf)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot == "" {
+			return nil, fmt.Errorf("%s: no snapshot as of %s", path, asOf.Format(time.RFC3339))
+		}
+		s, err = openSnapshot(snapshot)
+	case fi.IsDir():
+		s, err = openDir(path)
+	case strings.HasSuffix(path, ".json"):
+		s, err = openSnapshot(path)
+	case strings.HasSuffix(path, ".zst"):
+		s, err = openZstd(path)
+	default:
+		s, err = openZip(path)
+	}
+	if err != nil || asOf.IsZero() {
+		return s, err
+	}
+	var kept []*Manifest
+	for _, m := range s.Manifests {
+		if !m.Created.After(asOf) {
+			kept = append(kept, m)
+		}
+	}
+	s.Manifests = kept
+	return s, nil
+}
+
+// isSnapshotDir reports whether dir holds the snapshots of a --repo
+// account rather than a directory output.
+func isSnapshotDir(dir string) bool {
+	manifests, _ := filepath.Glob(filepath.Join(dir, "manifest-*.json"))
+	snapshots, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	return len(manifests) == 0 && len(snapshots) > 0
+}
+
+// Read returns the body of a message, decrypted if it was encrypted with
+// --gpg-recipient.
+func (s *Source) Read(mm *ManifestMessage) ([]byte, error) {
+	body, err := s.read(mm)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = Plaintext(body); err != nil {
+		return nil, fmt.Errorf("%s: %s", mm.Name, err)
+	}
+	return body, nil
+}
+
+// Raw returns the body of a message as it is stored.
+func (s *Source) Raw(mm *ManifestMessage) ([]byte, error) {
+	return s.read(mm)
+}
+
+func (s *Source) Close() error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close()
+}
+
+func openZip(path string) (*Source, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	s := &Source{close: zr.Close}
+	s.read = func(mm *ManifestMessage) ([]byte, error) {
+		f := files[mm.Name]
+		if f == nil {
+			return nil, fmt.Errorf("%s: missing %s", path, mm.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	f := files[manifestName]
+	if f == nil {
+		zr.Close()
+		return nil, fmt.Errorf("%s: no manifest, the archive is incomplete", path)
+	}
+	r, err := f.Open()
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	m, err := ParseManifest(path, data)
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	s.Manifests = []*Manifest{m}
+	return s, nil
+}
+
+// openZstd opens a --compression=zstd archive from a decompressed copy.
+func openZstd(path string) (*Source, error) {
+	tmp, err := ZstdTemp(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := openZip(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	zclose := s.close
+	s.close = func() error {
+		err := zclose()
+		os.Remove(tmp)
+		return err
+	}
+	return s, nil
+}
+
+// openDir reads all run manifests of a directory output in order.
+func openDir(dir string) (*Source, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "manifest-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s: no manifests found", dir)
+	}
+	sort.Strings(names)
+	s := &Source{}
+	for _, name := range names {
+		m, err := LoadSnapshot(name)
+		if err != nil {
+			return nil, err
+		}
+		s.Manifests = append(s.Manifests, m)
+	}
+	s.read = func(mm *ManifestMessage) ([]byte, error) {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(mm.Name)))
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(mm.Name, "mailboxes/") && strings.Contains(mm.Name, "/dbox-Mails/") {
+			return DboxBody(data)
+		}
+		return data, nil
+	}
+	return s, nil
+}
+
+// openSnapshot reads a snapshot of the repository containing it.
+func openSnapshot(path string) (*Source, error) {
+	m, err := LoadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filepath.Dir(filepath.Dir(path)))
+	s := &Source{Manifests: []*Manifest{m}}
+	s.read = func(mm *ManifestMessage) ([]byte, error) {
+		return ReadObject(dir, mm.Hash)
+	}
+	return s, nil
+}
+
+// DboxBody extracts the message from a single-message dbox file.
+func DboxBody(data []byte) ([]byte, error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 || len(data) < i+1+dboxMsgHdrSize || !bytes.HasPrefix(data[i+1:], []byte(dboxMagicPre)) {
+		return nil, errors.New("not a dbox file")
+	}
+	hdr := data[i+1 : i+1+dboxMsgHdrSize]
+	size, err := strconv.ParseUint(string(hdr[dboxMsgHdrSize-17:dboxMsgHdrSize-1]), 16, 64)
+	body := data[i+1+dboxMsgHdrSize:]
+	if err != nil || size > uint64(len(body)) {
+		return nil, errors.New("corrupt dbox file")
+	}
+	return body[:size], nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Special-use folders (RFC 6154). Servers mark their Sent, Drafts, Junk,
+// Trash and Archive folders with attributes, whatever their localized
+// names, such as Papierkorb or Corbeille. The attributes decide which
+// folders are skipped by default. Servers without SPECIAL-USE are matched
+// by the English names of Trash and Spam folders.
+//
+// With --normalize-folders the special-use folders are stored under the
+// standard names below, so that backups of different providers look the
+// same. Restoring with the option appends them to the folders with the
+// same attribute on the destination server.
+//
+// Folder exclusions match the decoded name of a mailbox, such as
+// "Entwürfe", its name on the wire in modified UTF-7, "Entw&APw-rfe", and
+// its role: role:junk or \Junk match the Junk folder in any language.
+
+var normalizeFolders = flag.Bool("normalize-folders", false, "Store special-use folders under the names Sent, Drafts, Junk, Trash and Archive")
+
+// specialUses are the known special-use attributes, including Gmail's
+// \Important.
+var specialUses = []string{`\All`, `\Archive`, `\Drafts`, `\Flagged`, `\Junk`, `\Sent`, `\Trash`, `\Important`}
+
+// specialUseNames are the standard folder names of the special uses.
+var specialUseNames = map[string]string{
+	`\Sent`:    "Sent",
+	`\Drafts`:  "Drafts",
+	`\Junk`:    "Junk",
+	`\Trash`:   "Trash",
+	`\Archive`: "Archive",
+}
+
+// ListAll lists all mailboxes, asking for their special-use attributes
+// with LIST-EXTENDED (RFC 5258) if the server supports it.
+func ListAll(c *imap.Client) (*imap.Command, error) {
+	if c.Caps["LIST-EXTENDED"] && c.Caps["SPECIAL-USE"] {
+		return Result(c.Send("LIST", c.Quote(""), c.Quote("*"), "RETURN", []imap.Field{"SPECIAL-USE"}))
+	}
+	return Result(c.List("", "*"))
+}
+
+// SpecialUse returns the special-use attribute of a mailbox, or "".
+func SpecialUse(mbox *imap.MailboxInfo) string {
+	for _, use := range specialUses {
+		for attr := range mbox.Attrs {
+			if strings.EqualFold(attr, use) {
+				return use
+			}
+		}
+	}
+	switch FolderName(mbox.Name) {
+	case "Trash":
+		return `\Trash`
+	case "Spam", "Junk":
+		return `\Junk`
+	}
+	return ""
+}
+
+// MatchFolder reports whether a folder exclusion matches a mailbox.
+func MatchFolder(pattern string, mbox *imap.MailboxInfo) bool {
+	if role, ok := strings.CutPrefix(pattern, "role:"); ok {
+		pattern = `\` + role
+	}
+	if strings.HasPrefix(pattern, `\`) {
+		for attr := range mbox.Attrs {
+			if strings.EqualFold(attr, pattern) {
+				return true
+			}
+		}
+		return strings.EqualFold(SpecialUse(mbox), pattern)
+	}
+	raw := imap.UTF7Encode(mbox.Name)
+	for _, name := range []string{mbox.Name, FolderName(mbox.Name), raw, FolderName(raw)} {
+		if pattern == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SpecialUseMailboxes returns the special-use mailboxes of the server by
+// attribute.
+func SpecialUseMailboxes(c *imap.Client) map[string]string {
+	mboxes := make(map[string]string)
+	cmd, err := ListAll(c)
+	if err != nil {
+		return mboxes
+	}
+	for _, resp := range cmd.Data {
+		mbox := resp.MailboxInfo()
+		if use := SpecialUse(mbox); use != "" && mboxes[use] == "" {
+			mboxes[use] = mbox.Name
+		}
+	}
+	return mboxes
+}
+
+// StandardUse returns the special use of a folder named by
+// --normalize-folders, or "".
+func StandardUse(folder string) string {
+	for use, name := range specialUseNames {
+		if folder == name {
+			return use
+		}
+	}
+	return ""
+}
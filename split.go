@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync/atomic"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Large folders are split into chunks of --fetch-batch messages queued as
+// separate jobs, so that idle connections help with them. The folder is
+// only marked complete once every chunk has been downloaded.
+
+var splitFolders = flag.Int("split-folders", 10000, "Download folders with more messages than this over several connections (0 disables)")
+
+// Chunk is a part of a split folder.
+type Chunk struct {
+	folder *splitFolder
+	UIDs   []uint32
+}
+
+type splitFolder struct {
+	complete  *Message
+	remaining int32
+	failed    int32
+}
+
+// SplitMailbox queues the download of uids in chunks.
+func (a *Account) SplitMailbox(mbox *imap.MailboxInfo, complete *Message, uids []uint32) {
+	var chunks []*Chunk
+	f := &splitFolder{complete: complete}
+	for len(uids) > 0 {
+		n := min(len(uids), *fetchBatch)
+		chunks = append(chunks, &Chunk{folder: f, UIDs: uids[:n]})
+		uids = uids[n:]
+	}
+	f.remaining = int32(len(chunks))
+	log.Printf("%s: %s - splitting into %d chunks", a.Username, complete.Folder, len(chunks))
+
+	var jobs []*Job
+	for _, ch := range chunks {
+		jobs = append(jobs, &Job{Account: a, Mailbox: mbox, Chunk: ch})
+	}
+	a.Queue(jobs...)
+}
+
+// DownloadChunk fetches the messages of a chunk, and marks the folder
+// complete if it was the last one.
+func (a *Account) DownloadChunk(c *imap.Client, p *Pacer, job *Job) {
+	f := job.Chunk.folder
+	name := f.complete.Folder
+	ok := false
+	var reason string
+	limit := a.Limit(name)
+	if c.Mailbox == nil || c.Mailbox.Name != job.Mailbox.Name {
+		c.Select(job.Mailbox.Name, true)
+	}
+	switch {
+	case c.Mailbox == nil && job.Retry(c):
+	case c.Mailbox == nil:
+		atomic.AddInt64(&a.Stats.Errors, 1)
+		log.Printf("Error selecting mailbox '%s'", job.Mailbox.Name)
+		reason = "could not be selected"
+	case limit != "":
+		reason = limit
+	case c.Mailbox.UIDValidity != f.complete.UIDValidity:
+		atomic.AddInt64(&a.Stats.Errors, 1)
+		log.Printf("%s: %s has changed during the backup", a.Username, name)
+		reason = "folder changed during the backup"
+	default:
+		p.Wait()
+		uids := job.NotReceived(job.Chunk.UIDs)
+		ok = len(uids) == 0 || a.FetchMessages(c, job, name, uids)
+		reason = "could not be fetched"
+	}
+	if !ok && job.Retry(c) {
+		// The chunk is queued again.
+		return
+	}
+	if !ok {
+		atomic.StoreInt32(&f.failed, 1)
+		a.Postpone(name, f.complete.UIDValidity, job.NotReceived(job.Chunk.UIDs), reason)
+	}
+	if atomic.AddInt32(&f.remaining, -1) == 0 && atomic.LoadInt32(&f.failed) == 0 {
+		a.msgCh <- f.complete
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Per-account state kept between runs in the state directory, used by
+// incremental backups to download only new messages.
+
+var incremental = flag.Bool("incremental", false, "Only download messages added since the previous backup")
+
+type State struct {
+	Folders map[string]*FolderState `json:"folders"`
+	// Index holds the messages found by --prefetch-headers by folder.
+	Index map[string]*FolderIndex `json:"index,omitempty"`
+}
+
+type FolderState struct {
+	UIDValidity   uint32 `json:"uidvalidity"`
+	LastUID       uint32 `json:"lastuid"`
+	HighestModSeq uint64 `json:"highestmodseq,omitempty"`
+
+	// UIDs of the backed up messages as an IMAP sequence set, to detect
+	// deletions. For Maildir output, Files maps them to file names.
+	UIDs  string            `json:"uids,omitempty"`
+	Files map[uint32]string `json:"files,omitempty"`
+}
+
+// FolderChanges are the changes to a folder written by a run.
+type FolderChanges struct {
+	UIDValidity   uint32
+	HighestModSeq uint64
+	Added         []uint32
+	Expunged      []uint32
+	Postponed     []uint32
+	Files         map[uint32]string
+	Complete      bool
+}
+
+type Changes map[string]*FolderChanges
+
+// Folder returns the changes of a folder. A new UIDVALIDITY makes
+// earlier changes meaningless.
+func (c Changes) Folder(name string, uidValidity uint32) *FolderChanges {
+	ch := c[name]
+	if ch == nil || ch.UIDValidity != uidValidity {
+		ch = &FolderChanges{UIDValidity: uidValidity, Files: make(map[uint32]string)}
+		c[name] = ch
+	}
+	return ch
+}
+
+func StateFile(user string) string {
+	return StatePath(strings.Replace(user, "/", "_", -1) + ".state")
+}
+
+// LoadState returns the saved state of an account, or an empty state if
+// it was never backed up.
+func LoadState(user string) (*State, error) {
+	st := &State{Folders: make(map[string]*FolderState)}
+	data, err := os.ReadFile(StateFile(user))
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	if st.Folders == nil {
+		st.Folders = make(map[string]*FolderState)
+	}
+	return st, nil
+}
+
+func (st *State) Save(user string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := StateFile(user)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Update merges the changes written by a run into the state. A folder
+// whose UIDVALIDITY changed starts over, its old UIDs are meaningless, and
+// so does a folder completely written by a full backup. LastUID stays
+// below the postponed messages, so the next incremental run fetches them,
+// and moves past the messages after them once they are.
+func (st *State) Update(changes Changes, incremental bool) {
+	for name, ch := range changes {
+		fs := st.Folders[name]
+		if fs == nil || fs.UIDValidity != ch.UIDValidity || (!incremental && ch.Complete) {
+			fs = &FolderState{UIDValidity: ch.UIDValidity}
+			st.Folders[name] = fs
+		}
+		if fs.Files == nil && len(ch.Files) > 0 {
+			fs.Files = make(map[uint32]string)
+		}
+
+		uids := make(map[uint32]bool)
+		for _, uid := range ParseUIDs(fs.UIDs) {
+			uids[uid] = true
+		}
+		for _, uid := range ch.Added {
+			uids[uid] = true
+		}
+		for uid, file := range ch.Files {
+			fs.Files[uid] = file
+		}
+		for _, uid := range ch.Expunged {
+			delete(uids, uid)
+			delete(fs.Files, uid)
+		}
+		list := make([]uint32, 0, len(uids))
+		for uid := range uids {
+			list = append(list, uid)
+			fs.LastUID = max(fs.LastUID, uid)
+		}
+		for _, uid := range ch.Postponed {
+			fs.LastUID = min(fs.LastUID, uid-1)
+		}
+		fs.UIDs = FormatUIDs(list)
+
+		if ch.HighestModSeq != 0 {
+			fs.HighestModSeq = ch.HighestModSeq
+		}
+	}
+}
+
+// FormatUIDs returns the UIDs as a compact IMAP sequence set.
+func FormatUIDs(uids []uint32) string {
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	var b strings.Builder
+	for i := 0; i < len(uids); {
+		j := i
+		for j+1 < len(uids) && uids[j+1] == uids[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		if i == j {
+			fmt.Fprintf(&b, "%d", uids[i])
+		} else {
+			fmt.Fprintf(&b, "%d:%d", uids[i], uids[j])
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// ParseUIDs expands a sequence set created by FormatUIDs.
+func ParseUIDs(set string) []uint32 {
+	var uids []uint32
+	for _, r := range strings.Split(set, ",") {
+		lo, hi, _ := strings.Cut(r, ":")
+		first, err := strconv.ParseUint(lo, 10, 32)
+		if err != nil {
+			continue
+		}
+		last := first
+		if hi != "" {
+			if last, err = strconv.ParseUint(hi, 10, 32); err != nil {
+				continue
+			}
+		}
+		for uid := first; uid <= last; uid++ {
+			uids = append(uids, uint32(uid))
+		}
+	}
+	return uids
+}
+
+// Since returns the backed up UIDs from first on. There are some only if
+// messages before them were postponed, see Update.
+func (fs *FolderState) Since(first uint32) map[uint32]bool {
+	uids := make(map[uint32]bool)
+	for _, uid := range ParseUIDs(fs.UIDs) {
+		if uid >= first {
+			uids[uid] = true
+		}
+	}
+	return uids
+}
+
+// FirstUID returns the first UID to download from a folder in an
+// incremental backup.
+func (st *State) FirstUID(user, name string, uidValidity uint32) uint32 {
+	fs := st.Folders[name]
+	if fs == nil {
+		return 1
+	}
+	if fs.UIDValidity != uidValidity {
+		log.Printf("%s: UIDVALIDITY of %s changed from %d to %d, downloading the whole folder again",
+			user, name, fs.UIDValidity, uidValidity)
+		return 1
+	}
+	return fs.LastUID + 1
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUIDSets(t *testing.T) {
+	for set, uids := range map[string][]uint32{
+		"":                      nil,
+		"7":                     {7},
+		"1:3":                   {1, 2, 3},
+		"1,3,5:7,10":            {1, 3, 5, 6, 7, 10},
+		"4294967294:4294967295": {4294967294, 4294967295},
+	} {
+		if got := ParseUIDs(set); !slices.Equal(got, uids) {
+			t.Errorf("ParseUIDs(%q) = %v, want %v", set, got, uids)
+		}
+		if got := FormatUIDs(slices.Clone(uids)); got != set {
+			t.Errorf("FormatUIDs(%v) = %q, want %q", uids, got, set)
+		}
+	}
+	// The UIDs need not be sorted.
+	if got := FormatUIDs([]uint32{5, 1, 3, 2}); got != "1:3,5" {
+		t.Errorf("FormatUIDs of unsorted UIDs = %q", got)
+	}
+	// Ranges that do not parse are skipped.
+	if got := ParseUIDs("x,2,3:y,4"); !slices.Equal(got, []uint32{2, 4}) {
+		t.Errorf("ParseUIDs of a broken set = %v", got)
+	}
+}
+
+func TestStateUpdate(t *testing.T) {
+	defer func(dir string) { *stateDir = dir }(*stateDir)
+	*stateDir = t.TempDir()
+	st, err := LoadState("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(Changes)
+	inbox := ch.Folder("INBOX", 100)
+	inbox.Added = []uint32{1, 2, 3, 5}
+	inbox.Files[5] = "INBOX/cur/5"
+	inbox.HighestModSeq = 42
+	inbox.Complete = true
+	st.Update(ch, false)
+
+	// The next incremental run finds a message expunged and a new one.
+	ch = make(Changes)
+	inbox = ch.Folder("INBOX", 100)
+	inbox.Added = []uint32{6}
+	inbox.Expunged = []uint32{2, 5}
+	st.Update(ch, true)
+	if err := st.Save("user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = LoadState("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := st.Folders["INBOX"]
+	if fs == nil {
+		t.Fatal("INBOX is missing from the saved state")
+	}
+	if fs.UIDs != "1,3,6" || fs.LastUID != 6 || fs.HighestModSeq != 42 || len(fs.Files) != 0 {
+		t.Errorf("INBOX state = %+v", fs)
+	}
+	if first := st.FirstUID("user@example.com", "INBOX", 100); first != 7 {
+		t.Errorf("next run starts at UID %d, want 7", first)
+	}
+	if first := st.FirstUID("user@example.com", "INBOX", 101); first != 1 {
+		t.Errorf("next run after a UIDVALIDITY change starts at UID %d, want 1", first)
+	}
+
+	// A full backup starts the folder over.
+	ch = make(Changes)
+	inbox = ch.Folder("INBOX", 100)
+	inbox.Added = []uint32{3}
+	inbox.Complete = true
+	st.Update(ch, false)
+	if fs := st.Folders["INBOX"]; fs.UIDs != "3" || fs.LastUID != 3 {
+		t.Errorf("INBOX after a full backup = %+v", fs)
+	}
+}
+
+func TestStatePostponed(t *testing.T) {
+	st := &State{Folders: map[string]*FolderState{"INBOX": {UIDValidity: 100, LastUID: 2, UIDs: "1:2"}}}
+
+	// A chunk of a split folder failed, the ones after it arrived.
+	ch := make(Changes)
+	inbox := ch.Folder("INBOX", 100)
+	inbox.Added = []uint32{3, 4, 8, 9}
+	inbox.Postponed = []uint32{6, 5, 7}
+	st.Update(ch, true)
+	fs := st.Folders["INBOX"]
+	if fs.UIDs != "1:4,8:9" || fs.LastUID != 4 {
+		t.Errorf("INBOX state = %+v", fs)
+	}
+	first := st.FirstUID("user@example.com", "INBOX", 100)
+	if first != 5 {
+		t.Errorf("next run starts at UID %d, want 5", first)
+	}
+	if got := fs.Since(first); len(got) != 2 || !got[8] || !got[9] {
+		t.Errorf("UIDs backed up from %d = %v, want 8 and 9", first, got)
+	}
+
+	// The next run fetches the postponed messages.
+	ch = make(Changes)
+	ch.Folder("INBOX", 100).Added = []uint32{5, 6, 7}
+	st.Update(ch, true)
+	if fs.UIDs != "1:9" || fs.LastUID != 9 {
+		t.Errorf("INBOX state = %+v", fs)
+	}
+}
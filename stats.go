@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// StatsCommand implements 'stats <backup>...', which summarizes the
+// messages present at the end of the given backups by folder, sender and
+// year. The headers of encrypted messages cannot be read, they are only
+// counted by folder.
+func StatsCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: stats <backup>...")
+	}
+	var sources []*Source
+	for _, path := range args {
+		src, err := OpenSource(path, time.Time{})
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		sources = append(sources, src)
+	}
+
+	type folderStats struct {
+		messages, bytes int64
+	}
+	folders := make(map[string]*folderStats)
+	senders := make(map[string]int)
+	years := make(map[int]int)
+	var total folderStats
+	for _, e := range CollectMessages(sources) {
+		body, err := e.src.Raw(e.ManifestMessage)
+		if err != nil {
+			return err
+		}
+		fs := folders[e.Folder]
+		if fs == nil {
+			fs = &folderStats{}
+			folders[e.Folder] = fs
+		}
+		fs.messages++
+		fs.bytes += int64(len(body))
+		total.messages++
+		total.bytes += int64(len(body))
+
+		m, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		if from, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+			senders[strings.ToLower(from.Address)]++
+		}
+		if date, err := m.Header.Date(); err == nil {
+			years[date.Year()]++
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	average := func(fs *folderStats) int64 {
+		if fs.messages == 0 {
+			return 0
+		}
+		return fs.bytes / fs.messages
+	}
+	names := make([]string, 0, len(folders))
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "Folder\tMessages\tSize\tAverage\t\n")
+	for _, name := range names {
+		fs := folders[name]
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t\n", name, fs.messages, FormatSize(fs.bytes), FormatSize(average(fs)))
+	}
+	fmt.Fprintf(w, "Total\t%d\t%s\t%s\t\n", total.messages, FormatSize(total.bytes), FormatSize(average(&total)))
+	w.Flush()
+
+	fmt.Printf("\nTop senders:\n")
+	addrs := make([]string, 0, len(senders))
+	for addr := range senders {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if senders[addrs[i]] != senders[addrs[j]] {
+			return senders[addrs[i]] > senders[addrs[j]]
+		}
+		return addrs[i] < addrs[j]
+	})
+	for _, addr := range addrs[:min(len(addrs), 20)] {
+		fmt.Printf("%8d  %s\n", senders[addr], addr)
+	}
+
+	fmt.Printf("\nMessages per year:\n")
+	list := make([]int, 0, len(years))
+	for year := range years {
+		list = append(list, year)
+	}
+	sort.Ints(list)
+	for _, year := range list {
+		fmt.Printf("%8d  %d\n", years[year], year)
+	}
+	return nil
+}
+
+// FormatSize formats a size in bytes for humans.
+func FormatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// Storage backends. A Storer only stores the files of a backup, one per
+// message plus the manifest. Every output but --repo, sdbox, EML and
+// --per-folder is a Storer:
+//
+//	--format=zip          a ZIP archive per run, see archive.go
+//	--format=maildir      a directory tree, see maildir.go
+//	--format=tar          a tar archive per run
+//	s3://bucket/prefix    an object per file, see s3.go
+//	--store-cmd <command> a program reading the files on its stdin
+//
+// The ZIP and Maildir storers also implement Writer, since they keep
+// records of their own, the checkpoints for --resume and the names of
+// the files when flags change, and store the messages under those names.
+// The others are given the messages by StoreWriter, which keeps the
+// manifest for them. Messages are named <folder>/<uidvalidity>.<uid>.eml
+// and the manifest manifest-<time>.json, as in directory outputs, so an
+// extracted tar archive or a downloaded S3 prefix can be given to
+// restore.
+//
+// The program of --store-cmd is started once per run with the output as
+// its last argument. Each file is sent as a JSON line with its folder,
+// name, size and the message's UID, flags and dates, followed by the
+// size bytes of the file. The manifest comes last, with an empty
+// folder. Stdin is then closed, and the backup is complete once the
+// program exits successfully.
+
+var storeCmd = flag.String("store-cmd", "", "Store backups through this program reading them on its stdin")
+
+type Storer interface {
+	// Create starts a file of the backup, it is stored when closed.
+	// meta is the message it holds, nil for the manifest.
+	Create(folder, name string, meta *Message) (io.WriteCloser, error)
+	// Finalize makes the backup complete once all files were stored.
+	Finalize() error
+}
+
+// StoreWriter writes a backup to a Storer.
+type StoreWriter struct {
+	Manifest *Manifest
+
+	store Storer
+}
+
+func NewStoreWriter(s Storer, m *Manifest) *StoreWriter {
+	return &StoreWriter{Manifest: m, store: s}
+}
+
+func (w *StoreWriter) Add(name string, msg *Message) error {
+	name = path.Join(msg.Folder, fmt.Sprintf("%d.%d.eml", msg.UIDValidity, msg.UID))
+	if err := Store(w.store, msg.Folder, name, msg, msg.Body); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	w.Manifest.Add(&CheckpointRecord{
+		Name:         name,
+		Folder:       msg.Folder,
+		UID:          msg.UID,
+		UIDValidity:  msg.UIDValidity,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		RFC822Size:   msg.Size,
+		ThreadID:     msg.ThreadID,
+		MessageID:    msg.MessageID,
+	})
+	return nil
+}
+
+func (w *StoreWriter) UpdateFlags(msg *Message) error {
+	w.Manifest.Add(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Flags:       msg.Flags,
+		FlagUpdate:  true,
+	})
+	return nil
+}
+
+func (w *StoreWriter) Expunge(msg *Message) error {
+	w.Manifest.Add(&CheckpointRecord{
+		Folder:      msg.Folder,
+		UID:         msg.UID,
+		UIDValidity: msg.UIDValidity,
+		Expunged:    true,
+	})
+	return nil
+}
+
+func (w *StoreWriter) Complete(msg *Message) error {
+	w.Manifest.Add(&CheckpointRecord{Folder: msg.Folder, Complete: true, Metadata: msg.Metadata})
+	return nil
+}
+
+// Close stores the manifest and finalizes the backup. Incomplete runs
+// get a manifest as well.
+func (w *StoreWriter) Close(complete bool) error {
+	data, err := w.Manifest.Marshal()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("manifest-%s.json", w.Manifest.Created.UTC().Format(snapshotTime))
+	if err := Store(w.store, "", name, nil, data); err != nil {
+		return err
+	}
+	return w.store.Finalize()
+}
+
+// Store writes a whole file to a Storer.
+func Store(s Storer, folder, name string, meta *Message, data []byte) error {
+	f, err := s.Create(folder, name, meta)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// storeFile buffers a file until it is closed, when store is called
+// with its content.
+type storeFile struct {
+	bytes.Buffer
+	store func(data []byte) error
+}
+
+func (f *storeFile) Close() error {
+	return f.store(f.Bytes())
+}
+
+// TarStore writes a tar archive, under a temporary name until it is
+// finalized.
+type TarStore struct {
+	output string
+	file   *os.File
+	tw     *tar.Writer
+}
+
+func NewTarStore(output string) (*TarStore, error) {
+	file, err := os.Create(output + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &TarStore{output: output, file: file, tw: tar.NewWriter(file)}, nil
+}
+
+func (s *TarStore) Create(folder, name string, meta *Message) (io.WriteCloser, error) {
+	modified := time.Now()
+	if meta != nil && !meta.InternalDate.IsZero() {
+		modified = meta.InternalDate
+	}
+	return &storeFile{store: func(data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: modified, Format: tar.FormatPAX}
+		if err := s.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := s.tw.Write(data)
+		return err
+	}}, nil
+}
+
+func (s *TarStore) Finalize() error {
+	err := s.tw.Close()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(s.file.Name(), s.output)
+}
+
+// ExecStore sends the files to the --store-cmd program.
+type ExecStore struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// execHeader precedes each file sent to the program.
+type execHeader struct {
+	Folder       string    `json:"folder"`
+	Name         string    `json:"name"`
+	Size         int       `json:"size"`
+	UID          uint32    `json:"uid,omitempty"`
+	UIDValidity  uint32    `json:"uidvalidity,omitempty"`
+	Flags        []string  `json:"flags,omitempty"`
+	InternalDate time.Time `json:"internaldate,omitzero"`
+}
+
+func NewExecStore(command, output string) (*ExecStore, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("--store-cmd: missing command")
+	}
+	cmd := exec.Command(args[0], append(args[1:], output)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("--store-cmd: %s", err)
+	}
+	return &ExecStore{cmd: cmd, stdin: stdin}, nil
+}
+
+func (s *ExecStore) Create(folder, name string, meta *Message) (io.WriteCloser, error) {
+	return &storeFile{store: func(data []byte) error {
+		hdr := execHeader{Folder: folder, Name: name, Size: len(data)}
+		if meta != nil {
+			hdr.UID, hdr.UIDValidity, hdr.Flags, hdr.InternalDate = meta.UID, meta.UIDValidity, meta.Flags, meta.InternalDate
+		}
+		line, _ := json.Marshal(hdr)
+		if _, err := s.stdin.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		_, err := s.stdin.Write(data)
+		return err
+	}}, nil
+}
+
+func (s *ExecStore) Finalize() error {
+	s.stdin.Close()
+	if err := s.cmd.Wait(); err != nil {
+		return fmt.Errorf("--store-cmd: %s", err)
+	}
+	return nil
+}
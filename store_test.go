@@ -0,0 +1,79 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The ZIP and Maildir writers store files given to them as a Storer like
+// the messages they write themselves.
+func TestStorers(t *testing.T) {
+	dir := t.TempDir()
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	msg := &Message{Folder: "INBOX", UID: 7, UIDValidity: 10, InternalDate: date, Body: []byte("Subject: a\r\n\r\nbody\r\n")}
+
+	zw, err := NewZipWriter(filepath.Join(dir, "user.zip"), &Manifest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := NewMaildirWriter(filepath.Join(dir, "maildir"), &Manifest{Created: date}, &State{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Storer{zw, md} {
+		if err := Store(s, "INBOX", "INBOX/cur/7.eml", msg, msg.Body); err != nil {
+			t.Fatal(err)
+		}
+		if err := Store(s, "", "notes.txt", nil, []byte("notes\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Finalize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(zw.Manifest.Messages) != 1 {
+		t.Errorf("ZIP manifest has %d messages, want the message only", len(zw.Manifest.Messages))
+	}
+	if _, err := os.Stat(CheckpointPath(filepath.Join(dir, "user.zip"))); !os.IsNotExist(err) {
+		t.Errorf("checkpoint of the finalized archive: %v", err)
+	}
+	r, err := zip.OpenReader(filepath.Join(dir, "user.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	entries := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		entries[f.Name] = string(data)
+	}
+	if entries["INBOX/cur/7.eml"] != string(msg.Body) || entries["notes.txt"] != "notes\n" || entries[manifestName] == "" {
+		t.Errorf("ZIP entries = %q", entries)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "maildir", "INBOX", "cur", "7.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(date) {
+		t.Errorf("message mtime = %s, want the internal date %s", fi.ModTime(), date)
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "maildir", "INBOX", "tmp")); len(tmp) != 0 {
+		t.Errorf("files left in tmp: %v", tmp)
+	}
+	for _, name := range []string{"notes.txt", "manifest-20240301T120000Z.json"} {
+		if _, err := os.Stat(filepath.Join(dir, "maildir", name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
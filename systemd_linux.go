@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// systemd integration: log to the journal with structured fields when
+// stderr is connected to it, and report readiness, status and watchdog
+// keep-alives through $NOTIFY_SOCKET.
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalWriter sends each log line as a journal entry.
+type journalWriter struct {
+	conn net.Conn
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", msg)
+	journalField(&b, "PRIORITY", "6")
+	journalField(&b, "SYSLOG_IDENTIFIER", "backupimap")
+	// Messages about an account start with its name.
+	if user, _, ok := strings.Cut(msg, ": "); ok && !strings.Contains(user, " ") {
+		journalField(&b, "BACKUPIMAP_ACCOUNT", user)
+	}
+	if _, err := w.conn.Write(b.Bytes()); err != nil {
+		// Fall back to stderr, which goes to the journal as well.
+		return os.Stderr.Write(p)
+	}
+	return len(p), nil
+}
+
+// journalField appends a field in the journal's native protocol. Values
+// containing newlines need the length-prefixed binary form.
+func journalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// onJournal reports whether stderr is the journal stream systemd set up.
+func onJournal() bool {
+	dev, ino, ok := strings.Cut(os.Getenv("JOURNAL_STREAM"), ":")
+	if !ok {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return strconv.FormatUint(uint64(st.Dev), 10) == dev && strconv.FormatUint(st.Ino, 10) == ino
+}
+
+// SetupSystemd switches logging to the journal and starts the watchdog
+// keep-alives when running as a systemd service.
+func SetupSystemd() {
+	if onJournal() {
+		if conn, err := net.Dial("unixgram", journalSocket); err == nil {
+			log.SetOutput(&journalWriter{conn})
+			// The journal records the time itself.
+			log.SetFlags(0)
+		}
+	}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		go func() {
+			for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+				SdNotify("WATCHDOG=1")
+			}
+		}()
+	}
+}
+
+// SdNotify sends a state change to the service manager, if any.
+func SdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
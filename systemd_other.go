@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func SetupSystemd() {}
+
+func SdNotify(state string) {}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// notmuch tag dumps for Maildir output. Each run writes the tags of the
+// messages it added or whose flags changed in "notmuch dump" batch
+// format, so an index built on the Maildir can be given the original
+// organization with "notmuch restore". Files from successive incremental
+// runs must be restored in order.
+
+// systemTags maps IMAP system flags and Gmail system labels to the tags
+// notmuch itself uses for them.
+var systemTags = map[string]string{
+	`\Answered`:  "replied",
+	`\Flagged`:   "flagged",
+	`\Draft`:     "draft",
+	`\Deleted`:   "deleted",
+	`\Inbox`:     "inbox",
+	`\Sent`:      "sent",
+	`\Important`: "important",
+	`\Starred`:   "flagged",
+	"$Junk":      "spam",
+	"$Forwarded": "passed",
+}
+
+// GmailLabels returns the X-GM-LABELS of a fetched message.
+func GmailLabels(info *imap.MessageInfo) []string {
+	var labels []string
+	for _, f := range imap.AsList(info.Attrs["X-GM-LABELS"]) {
+		label := imap.AsString(f)
+		if decoded, err := imap.UTF7Decode(label); err == nil {
+			label = decoded
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// GmailThreadID returns the X-GM-THRID of a fetched message in hex, or ""
+// if the server did not send it.
+func GmailThreadID(info *imap.MessageInfo) string {
+	v, ok := info.Attrs["X-GM-THRID"]
+	if !ok {
+		return ""
+	}
+	// The 64-bit ID does not always fit the numbers of the parser.
+	id, err := strconv.ParseUint(fmt.Sprint(v), 10, 64)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatUint(id, 16)
+}
+
+// NotmuchTags derives the tags of a message from its flags and labels.
+func NotmuchTags(flags, labels []string) []string {
+	set := map[string]bool{"unread": true}
+	for _, f := range flags {
+		if f == `\Seen` {
+			delete(set, "unread")
+		} else if t, ok := systemTags[f]; ok {
+			set[t] = true
+		} else if !strings.HasPrefix(f, `\`) {
+			set[strings.ToLower(f)] = true
+		}
+	}
+	for _, l := range labels {
+		if t, ok := systemTags[l]; ok {
+			set[t] = true
+		} else if !strings.HasPrefix(l, `\`) {
+			set[l] = true
+		}
+	}
+	tags := make([]string, 0, len(set))
+	for t := range set {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// NotmuchID returns the id notmuch uses for a message: its Message-ID, or
+// a hash of the file if it has none.
+func NotmuchID(body []byte) string {
+	if m, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+		id := strings.TrimSpace(m.Header.Get("Message-Id"))
+		id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+		if id != "" {
+			return id
+		}
+	}
+	return fmt.Sprintf("notmuch-sha1-%x", sha1.Sum(body))
+}
+
+// NotmuchLine formats the tags of a message as a line of a dump.
+func NotmuchLine(id string, tags []string) string {
+	var b strings.Builder
+	for _, t := range tags {
+		b.WriteString("+" + notmuchEncode(t) + " ")
+	}
+	b.WriteString("-- id:" + notmuchEncode(id) + "\n")
+	return b.String()
+}
+
+// notmuchEncode hex-encodes the characters the dump format does not allow.
+func notmuchEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("+-_@=.,", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02x", c)
+		}
+	}
+	return b.String()
+}
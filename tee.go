@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// Several copies of a backup from one download with --tee: every outdir
+// or upload URL given gets its own output, named like the main one and
+// written at the same time, with its own manifest. All copies share the
+// account state, so an incremental run adds the same messages to each of
+// them. Each is compressed, signed and uploaded on its own at the end.
+
+var teeOutputs stringsFlag
+
+// Copy is an additional output of an account.
+type Copy struct {
+	Output   string
+	Upload   string
+	Writer   Writer
+	Manifest *Manifest
+}
+
+// CopyOutputs returns where the --tee copies of the account's backup go,
+// with the local file an upload is staged in.
+func (a *Account) CopyOutputs() (outputs, uploads []string) {
+	dest := a.Output
+	if a.upload != "" {
+		dest = a.upload
+	}
+	name := path.Base(filepath.ToSlash(dest))
+	for _, dir := range teeOutputs {
+		if IsRemote(dir) {
+			remote := RemoteJoin(dir, name)
+			outputs, uploads = append(outputs, StagingPath(remote)), append(uploads, remote)
+		} else {
+			outputs, uploads = append(outputs, filepath.Join(dir, name)), append(uploads, "")
+		}
+	}
+	return outputs, uploads
+}
+
+// TeeWriter writes the messages to the main output and the copies
+// concurrently.
+type TeeWriter struct {
+	Manifest *Manifest
+
+	main   Writer
+	copies []*Copy
+}
+
+func (t *TeeWriter) each(f func(w Writer) error) error {
+	errs := make([]error, len(t.copies)+1)
+	var wg sync.WaitGroup
+	for i, c := range t.copies {
+		wg.Add(1)
+		go func() {
+			errs[i+1] = f(c.Writer)
+			wg.Done()
+		}()
+	}
+	errs[0] = f(t.main)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TeeWriter) Add(name string, msg *Message) error {
+	return t.each(func(w Writer) error { return w.Add(name, msg) })
+}
+
+func (t *TeeWriter) UpdateFlags(msg *Message) error {
+	return t.each(func(w Writer) error { return w.UpdateFlags(msg) })
+}
+
+func (t *TeeWriter) Expunge(msg *Message) error {
+	return t.each(func(w Writer) error { return w.Expunge(msg) })
+}
+
+func (t *TeeWriter) Complete(msg *Message) error {
+	return t.each(func(w Writer) error { return w.Complete(msg) })
+}
+
+// Close gives the copies what was added to the main manifest at the end
+// of the run, and closes all outputs.
+func (t *TeeWriter) Close(complete bool) error {
+	for _, c := range t.copies {
+		if server, ok := t.Manifest.Metadata[""]; ok {
+			c.Manifest.SetMetadata("", server)
+		}
+		c.Manifest.Mailboxes = t.Manifest.Mailboxes
+		c.Manifest.Skipped = t.Manifest.Skipped
+	}
+	return t.each(func(w Writer) error { return w.Close(complete) })
+}
+
+// NewTeeWriter opens the --tee copies of an output.
+func (a *Account) NewTeeWriter(main Writer, m *Manifest) (*TeeWriter, error) {
+	t := &TeeWriter{Manifest: m, main: main}
+	outputs, uploads := a.CopyOutputs()
+	for i, output := range outputs {
+		cm := &Manifest{Account: m.Account, Created: m.Created, Incremental: m.Incremental, HeadersOnly: m.HeadersOnly,
+			EncryptedTo: m.EncryptedTo}
+		w, err := a.NewWriter(output, cm)
+		if err != nil {
+			main.Close(false)
+			for _, c := range t.copies {
+				c.Writer.Close(false)
+			}
+			return nil, err
+		}
+		t.copies = append(t.copies, &Copy{Output: output, Upload: uploads[i], Writer: w, Manifest: cm})
+	}
+	return t, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts and error limits, so that a pathological folder or a flaky
+// server ends the run with a partial backup instead of hanging or failing
+// it. They are checked with the size limits of limits.go, before each
+// FETCH:
+//
+//	--folder-timeout   a folder stops once downloading it took this long,
+//	                   counted from its first batch, across reconnections
+//	--message-timeout  a FETCH receiving nothing for this long is aborted
+//	                   by closing the connection, and the job queued again
+//	--max-errors       an account stops after this many errors
+//	--max-error-rate   an account stops once more than this fraction of
+//	                   its messages failed, after the first 100
+//
+// The folders left are reported incomplete and, unlike with a failure,
+// the backup of the account is finished.
+
+var (
+	folderTimeout  = flag.Duration("folder-timeout", 0, "Stop downloading a folder after this long (0 for no limit)")
+	messageTimeout = flag.Duration("message-timeout", 0, "Reconnect when a FETCH receives no data for this long (0 to wait forever)")
+	maxErrors      = flag.Int("max-errors", 0, "Stop backing up an account after this many errors (0 for no limit)")
+	maxErrorRate   = flag.Float64("max-error-rate", 0, "Stop backing up an account once this fraction of its messages failed, e.g. 0.05 (0 for no limit)")
+)
+
+// minErrorSample is the number of messages before --max-error-rate is
+// checked, so that a single early error does not stop the account.
+const minErrorSample = 100
+
+// RecvTimeout is the timeout of Recv while fetching messages.
+func RecvTimeout() time.Duration {
+	if *messageTimeout > 0 {
+		return *messageTimeout
+	}
+	return -1
+}
+
+// StartFolder records when the download of a folder started, for
+// --folder-timeout. Jobs queued again keep the first time.
+func (a *Account) StartFolder(folder string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.folderStart[folder]; !ok {
+		a.folderStart[folder] = time.Now()
+	}
+}
+
+// abortLimit returns the timeout or error limit reached, if any. It is
+// called by Limit with a.mu held.
+func (a *Account) abortLimit(folder string) string {
+	errors := atomic.LoadInt64(&a.Stats.Errors)
+	total := atomic.LoadInt64(&a.Stats.Messages) + errors
+	switch {
+	case *maxErrors > 0 && errors >= int64(*maxErrors):
+		return fmt.Sprintf("--max-errors of %d reached", *maxErrors)
+	case *maxErrorRate > 0 && total >= minErrorSample && float64(errors) > *maxErrorRate*float64(total):
+		return fmt.Sprintf("--max-error-rate of %g exceeded, %d errors", *maxErrorRate, errors)
+	}
+	if start, ok := a.folderStart[folder]; ok && *folderTimeout > 0 && time.Since(start) >= *folderTimeout {
+		return fmt.Sprintf("--folder-timeout of %s reached in %s", *folderTimeout, folder)
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UpgradeCommand implements 'upgrade <backup>...', which rewrites the
+// manifests of backups written by older versions in the current version.
+// ZIP archives are rewritten without recompressing the messages; for
+// directory outputs and --repo snapshots only the manifests change.
+func UpgradeCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: upgrade <backup>...")
+	}
+	for _, path := range args {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		var files []string
+		switch {
+		case fi.IsDir():
+			// Directory outputs and the snapshots of an account.
+			files, _ = filepath.Glob(filepath.Join(path, "*.json"))
+		case strings.HasSuffix(path, ".json"):
+			files = []string{path}
+		case strings.HasSuffix(path, ".zst"):
+			return fmt.Errorf("%s: decompress the archive with zstd -d to upgrade it", path)
+		default:
+			if err := upgradeZip(path); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, file := range files {
+			if err := upgradeManifest(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// manifestFileVersion returns the version a manifest was written in.
+func manifestFileVersion(data []byte) int {
+	var v struct {
+		Version int `json:"version"`
+	}
+	json.Unmarshal(data, &v)
+	return max(v.Version, 1)
+}
+
+func upgradeZip(archive string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, f := range zr.File {
+		if f.Name != manifestName {
+			continue
+		}
+		r, err := f.Open()
+		if err == nil {
+			data, err = io.ReadAll(r)
+			r.Close()
+		}
+		if err != nil {
+			zr.Close()
+			return err
+		}
+	}
+	comment := zr.Comment
+	zr.Close()
+	if data == nil {
+		return errors.New(archive + ": no manifest, the archive is incomplete")
+	}
+	version := manifestFileVersion(data)
+	if version == manifestVersion && comment == archiveMarker() {
+		log.Printf("%s: already version %d", archive, manifestVersion)
+		return nil
+	}
+	m, err := ParseManifest(archive, data)
+	if err != nil {
+		return err
+	}
+	if err := RewriteZip(archive, m, nil, nil); err != nil {
+		return err
+	}
+	log.Printf("%s: upgraded from version %d to %d", archive, version, manifestVersion)
+	return nil
+}
+
+func upgradeManifest(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	version := manifestFileVersion(data)
+	if version == manifestVersion {
+		return nil
+	}
+	m, err := ParseManifest(file, data)
+	if err != nil {
+		return err
+	}
+	if data, err = m.Marshal(); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	log.Printf("%s: upgraded from version %d to %d", file, version, manifestVersion)
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Remote outputs: an --outfile or --outdir of the form sftp://host/path,
+// dav://host/path or davs://host/path. The archive is written to a local
+// staging file in the state directory, which is kept for --resume, and
+// uploaded once the backup is complete. Interrupted uploads continue
+// where they stopped when the server allows it.
+//
+// SFTP uses the OpenSSH sftp client, so keys and ~/.ssh/config apply.
+// WebDAV credentials come from the URL or from the keyring entry
+// user@host.
+
+// IsRemote reports whether an output is an upload URL.
+func IsRemote(output string) bool {
+	return strings.HasPrefix(output, "sftp://") || strings.HasPrefix(output, "dav://") || strings.HasPrefix(output, "davs://")
+}
+
+// StagingPath returns the local file an upload to remote is staged in,
+// in systemd's cache directory for the service if there is one.
+func StagingPath(remote string) string {
+	name := "upload-" + strings.NewReplacer("://", "_", "/", "_", ":", "_", "@", "_").Replace(remote)
+	if dir, _, _ := strings.Cut(os.Getenv("CACHE_DIRECTORY"), ":"); dir != "" {
+		return filepath.Join(dir, name)
+	}
+	return StatePath(name)
+}
+
+// Upload copies the local file to the remote URL.
+func Upload(local, remote string) error {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "sftp":
+		return uploadSFTP(local, u)
+	case "dav", "davs":
+		return uploadDAV(local, u)
+	}
+	return fmt.Errorf("unsupported upload URL '%s'", remote)
+}
+
+func uploadSFTP(local string, u *url.URL) error {
+	args := []string{"-b", "-"}
+	if port := u.Port(); port != "" {
+		args = append(args, "-P", port)
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	args = append(args, host)
+	// sftp://host/~/file is relative to the home directory.
+	remote := strings.TrimPrefix(u.Path, "/~/")
+	partial := remote + ".partial"
+	id, size, err := UploadID(local)
+	if err != nil {
+		return err
+	}
+
+	// reput continues an interrupted upload of the same file, it fails
+	// if nothing was uploaded yet.
+	err = errors.New("no partial upload")
+	if tmp, terr := os.CreateTemp("", "marker-"); terr == nil {
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		if _, gerr := runSFTP(args, fmt.Sprintf("get %q %q\n", partial+".marker", tmp.Name())); gerr == nil {
+			if data, _ := os.ReadFile(tmp.Name()); string(data) == id {
+				_, err = runSFTP(args, fmt.Sprintf("reput %q %q\n", local, partial))
+			}
+		}
+	}
+	if err != nil {
+		marker, merr := os.CreateTemp("", "marker-")
+		if merr != nil {
+			return merr
+		}
+		defer os.Remove(marker.Name())
+		marker.WriteString(id)
+		marker.Close()
+		_, err = runSFTP(args, fmt.Sprintf("-rm %q\nput %q %q\nput %q %q\n", partial, marker.Name(), partial+".marker", local, partial))
+	}
+	if err != nil {
+		return err
+	}
+	out, err := runSFTP(args, fmt.Sprintf("rename %q %q\n-rm %q\nls -ln %q\n", partial, remote, partial+".marker", remote))
+	if err != nil {
+		return err
+	}
+	// The last line lists the file, its size is the fifth field.
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if fields := strings.Fields(lines[len(lines)-1]); len(fields) < 5 || fields[4] != strconv.FormatInt(size, 10) {
+		return fmt.Errorf("sftp: %s does not have the size of %s after the upload", remote, local)
+	}
+	return nil
+}
+
+// UploadID identifies the content of a file being uploaded, by its size
+// and SHA-256. It is stored next to a partial upload, which is only
+// continued by an upload of the same file.
+func UploadID(local string) (string, int64, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%d %x\n", n, h.Sum(nil)), n, nil
+}
+
+func runSFTP(args []string, batch string) (string, error) {
+	cmd := exec.Command("sftp", args...)
+	cmd.Stdin = strings.NewReader(batch)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("sftp: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// uploadDAV uploads to a .partial file and moves it into place. If a
+// partial upload of the same file exists, the rest is appended with the
+// PATCH method of SabreDAV based servers, other servers get the whole
+// file again.
+func uploadDAV(local string, u *url.URL) error {
+	target := *u
+	target.Scheme = "https"
+	if u.Scheme == "dav" {
+		target.Scheme = "http"
+	}
+	target.User = nil
+	user, pass := "", ""
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+		if pass == "" {
+			var err error
+			if pass, err = ResolvePassword("keyring:" + user + "@" + u.Host); err != nil {
+				return err
+			}
+		}
+	}
+	// read is set to keep the response body.
+	var read []byte
+	do := func(method, url string, body io.Reader, length int64, header map[string]string) (*http.Response, error) {
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			return nil, err
+		}
+		// Some servers refuse chunked uploads.
+		req.ContentLength = length
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if read != nil {
+			read, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return resp, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+		}
+		return resp, nil
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	final := target.String()
+	partial := final + ".partial"
+	id, _, err := UploadID(local)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	read = []byte{}
+	_, merr := do("GET", partial+".marker", nil, 0, nil)
+	same := merr == nil && string(read) == id
+	read = nil
+	if resp, err := do("HEAD", partial, nil, 0, nil); same && err == nil && resp.ContentLength > 0 && resp.ContentLength < fi.Size() {
+		offset = resp.ContentLength
+	}
+	uploaded := false
+	if offset > 0 {
+		log.Printf("resuming upload of %s at %d bytes", final, offset)
+		_, err := do("PATCH", partial, io.NewSectionReader(f, offset, fi.Size()-offset), fi.Size()-offset, map[string]string{
+			"Content-Type":   "application/x-sabredav-partialupdate",
+			"X-Update-Range": "append",
+		})
+		uploaded = err == nil
+	}
+	if !uploaded {
+		if _, err := do("PUT", partial+".marker", strings.NewReader(id), int64(len(id)), nil); err != nil {
+			return err
+		}
+		if _, err := do("PUT", partial, io.NewSectionReader(f, 0, fi.Size()), fi.Size(), nil); err != nil {
+			return err
+		}
+	}
+	if _, err := do("MOVE", partial, nil, 0, map[string]string{
+		"Destination": final,
+		"Overwrite":   "T",
+	}); err != nil {
+		return err
+	}
+	do("DELETE", partial+".marker", nil, 0, nil)
+	resp, err := do("HEAD", final, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength != fi.Size() {
+		return fmt.Errorf("%s has %d bytes after the upload, not %d", final, resp.ContentLength, fi.Size())
+	}
+	return nil
+}
+
+// RemoteJoin appends an output name to a remote --outdir.
+func RemoteJoin(dir, name string) string {
+	u, err := url.Parse(dir)
+	if err != nil {
+		return strings.TrimRight(dir, "/") + "/" + name
+	}
+	u.Path = path.Join(u.Path, name)
+	return u.String()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Zstandard archives with --compression=zstd: the messages are stored
+// uncompressed in the ZIP archive, which is compressed as a whole with
+// the zstd tool once it is complete, into <archive>.zst. This is smaller
+// and much faster than deflating each message. ZIP tools need the archive
+// decompressed with 'zstd -d' first, backupimap reads it as it is.
+// Interrupted runs keep the uncompressed archive for --resume.
+
+var zstdBinary = flag.String("zstd", "zstd", "Zstandard binary used by --compression=zstd")
+
+// ZstdCompress compresses a complete archive into archive.zst and removes
+// the archive.
+func ZstdCompress(archive string) (string, error) {
+	out := archive + ".zst"
+	if err := runZstd("-q", "-f", "-T0", "--rm", "-o", out, archive); err != nil {
+		os.Remove(out)
+		return "", err
+	}
+	return out, nil
+}
+
+// FinishArchive compresses a complete ZIP archive written by a command
+// if --compression=zstd is set, and returns its final name.
+func FinishArchive(archive string) (string, error) {
+	if *compression != "zstd" {
+		return archive, nil
+	}
+	return ZstdCompress(archive)
+}
+
+// ZstdTemp decompresses an archive into a temporary file, which the
+// caller removes.
+func ZstdTemp(path string) (string, error) {
+	f, err := os.CreateTemp("", "backupimap-*.zip")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	if err := runZstd("-q", "-d", "-f", "-o", f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func runZstd(args ...string) error {
+	cmd := exec.Command(*zstdBinary, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("zstd: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}